@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func loadAcmeAccount(ctx context.Context) *cert_helper.AcmeAccount {
+	config := newAliConfig()
+
+	account, err := cert_helper.LoadAcmeAccount(
+		ctx,
+		newStorage(config),
+		viper.GetString("acme-email"),
+		viper.GetString("acme-directory-url"),
+	)
+	if err != nil {
+		log.Fatalf("Error loading acme account: %v", err)
+	}
+
+	return account
+}
+
+func printRegistration(account *cert_helper.AcmeAccount) {
+	regBytes, err := json.MarshalIndent(account.Registration(), "", "  ")
+	if err != nil {
+		log.Fatalf("Error marshaling registration: %v", err)
+	}
+
+	fmt.Println(string(regBytes))
+}
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "manage the acme account",
+}
+
+var accountShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "show the registration of the acme account",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		account := loadAcmeAccount(ctx)
+
+		if refresh, _ := cmd.Flags().GetBool("refresh"); refresh {
+			if _, err := account.Refresh(ctx); err != nil {
+				log.Fatalf("Error refreshing registration: %v", err)
+			}
+		}
+
+		printRegistration(account)
+	},
+}
+
+var accountUpdateEmailCmd = &cobra.Command{
+	Use:   "update-email <email>...",
+	Short: "replace the contact emails of the acme account",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		account := loadAcmeAccount(ctx)
+
+		if _, err := account.UpdateContacts(ctx, args); err != nil {
+			log.Fatalf("Error updating contacts: %v", err)
+		}
+
+		printRegistration(account)
+	},
+}
+
+var accountRotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "replace the acme account key",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		account := loadAcmeAccount(ctx)
+
+		if err := account.RotateKey(ctx); err != nil {
+			log.Fatalf("Error rotating account key: %v", err)
+		}
+
+		log.Printf("account key of %s rotated", account.Registration().URI)
+	},
+}
+
+var accountDeactivateCmd = &cobra.Command{
+	Use:   "deactivate",
+	Short: "deactivate the acme account, this can't be undone",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+			log.Fatal("Deactivating the account can't be undone, pass --yes to confirm")
+		}
+
+		account := loadAcmeAccount(ctx)
+
+		if err := account.Deactivate(ctx); err != nil {
+			log.Fatalf("Error deactivating account: %v", err)
+		}
+
+		log.Printf("account %s deactivated", account.Registration().URI)
+	},
+}
+
+var accountRegisterCmd = &cobra.Command{
+	Use:   "register",
+	Short: "register the acme account again, e.g. after changing the acme directory",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		account := loadAcmeAccount(ctx)
+		newKey, _ := cmd.Flags().GetBool("new-key")
+
+		if _, err := account.Register(ctx, newKey); err != nil {
+			log.Fatalf("Error registering account: %v", err)
+		}
+
+		printRegistration(account)
+	},
+}
+
+func init() {
+	accountShowCmd.Flags().Bool("refresh", false, "fetch the registration from the acme server")
+	accountDeactivateCmd.Flags().Bool("yes", false, "confirm the deactivation")
+	accountRegisterCmd.Flags().Bool("new-key", false, "register with a new account key")
+
+	accountCmd.AddCommand(accountShowCmd, accountUpdateEmailCmd, accountRotateKeyCmd, accountDeactivateCmd, accountRegisterCmd)
+	rootCmd.AddCommand(accountCmd)
+}
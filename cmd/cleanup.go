@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "delete the expired and superseded certificates the keeper uploaded to cas",
+	Long: "Delete the certificates the keeper uploaded to cas which are expired, or older\n" +
+		"than the retained versions and past the grace period. Certificates bound to any\n" +
+		"cdn, oss or live domain are always kept.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		k := newKeeper(ctx)
+		k.CleanupPolicy.DryRun, _ = cmd.Flags().GetBool("dry-run")
+
+		plan, err := k.Cleanup(ctx)
+		if err != nil {
+			log.Fatalf("Error cleaning up cas: %v", err)
+		}
+
+		failed := 0
+		for _, cleanup := range plan {
+			if cleanup.Err != nil {
+				failed++
+			}
+		}
+
+		log.Printf("%d certificates to delete, %d failed", len(plan), failed)
+		if failed > 0 {
+			log.Fatalf("%d certificates failed to delete", failed)
+		}
+	},
+}
+
+func init() {
+	cleanupCmd.Flags().Bool("dry-run", false, "only list the certificates that would be deleted")
+	rootCmd.AddCommand(cleanupCmd)
+}
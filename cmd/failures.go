@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var resetFailuresCmd = &cobra.Command{
+	Use:   "reset-failures [common-name]...",
+	Short: "clear the issuance failures of the common names, or of all of them",
+	Long: "Clear the issuance failures recorded in storage, so the next run retries the\n" +
+		"common names right away instead of waiting for their backoff. Run it once the\n" +
+		"cause of a stuck common name is fixed.",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		reset, err := newKeeper(ctx).ResetFailures(ctx, args)
+		if err != nil {
+			log.Fatalf("Error resetting failures: %v", err)
+		}
+
+		for _, commonName := range reset {
+			log.Printf("reset failures of %s", commonName)
+		}
+		log.Printf("%d common names reset", len(reset))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resetFailuresCmd)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/spf13/cobra"
+)
+
+func readFlagFile(cmd *cobra.Command, name string) []byte {
+	path, _ := cmd.Flags().GetString(name)
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", path, err)
+	}
+
+	return data
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "import an externally sourced certificate, e.g. a purchased OV/EV certificate",
+	Long: "Import a certificate from PEM files (--cert, --chain, --key) or a PKCS#12 bundle\n" +
+		"(--pkcs12, --password). It is stored and uploaded to cas like issued certificates\n" +
+		"and deployed to the services on every run, but never renewed by the keeper.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		var cert *cert_helper.Certificate
+		var err error
+
+		if bundle := readFlagFile(cmd, "pkcs12"); bundle != nil {
+			password, _ := cmd.Flags().GetString("password")
+			cert, err = cert_helper.ParsePKCS12(bundle, password)
+		} else {
+			certPEM, keyPEM := readFlagFile(cmd, "cert"), readFlagFile(cmd, "key")
+			if certPEM == nil || keyPEM == nil {
+				log.Fatal("Either --pkcs12 or both --cert and --key are required")
+			}
+			cert, err = cert_helper.ParseCertificateBundle(certPEM, readFlagFile(cmd, "chain"), keyPEM)
+		}
+		if err != nil {
+			log.Fatalf("Error validating certificate: %v", err)
+		}
+
+		config := newAliConfig()
+		certManager := newCertManager(ctx, config, newStorage(config))
+
+		if err := certManager.ImportCertificate(ctx, cert); err != nil {
+			log.Fatalf("Error importing certificate: %v", err)
+		}
+
+		log.Printf("imported certificate of %s, expires %s (cas id %d)", cert.CommonName, cert.X509Certificate().NotAfter, cert.CasCertificateId)
+	},
+}
+
+func init() {
+	importCmd.Flags().String("cert", "", "PEM certificate file, may include the chain")
+	importCmd.Flags().String("chain", "", "PEM chain file")
+	importCmd.Flags().String("key", "", "PEM private key file")
+	importCmd.Flags().String("pkcs12", "", "PKCS#12 bundle file")
+	importCmd.Flags().String("password", "", "PKCS#12 password")
+
+	rootCmd.AddCommand(importCmd)
+}
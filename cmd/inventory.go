@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/spf13/cobra"
+)
+
+var inventoryHeader = []string{"SERVICE", "DOMAIN", "REGION", "BUCKET", "CERT NAME", "CAS ID", "ISSUER", "EXPIRY", "DAYS", "RENEW"}
+
+func inventoryRow(item keeper.InventoryItem) []string {
+	expiry, certId := "", ""
+	if !item.NotAfter.IsZero() {
+		expiry = item.NotAfter.Format("2006-01-02")
+	}
+	if item.CertId != 0 {
+		certId = strconv.FormatInt(item.CertId, 10)
+	}
+
+	return []string{
+		item.Service,
+		item.Domain,
+		item.Region,
+		item.Bucket,
+		item.CertName,
+		certId,
+		item.Issuer,
+		expiry,
+		strconv.Itoa(item.DaysRemaining),
+		strconv.FormatBool(item.WouldRenew),
+	}
+}
+
+var inventoryCmd = &cobra.Command{
+	Use:     "inventory",
+	Aliases: []string{"list"},
+	Short:   "list every domain binding and the expiry of its certificate",
+	Long: "List every domain binding and the expiry of its certificate. If the bindings of\n" +
+		"any service can't be discovered, the failures are reported and it exits non-zero.",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		output, _ := cmd.Flags().GetString("output")
+
+		config := newAliConfig()
+		k := &keeper.Keeper{
+			ServiceAgents: newServiceAgents(config),
+			// read-only, no issuer needed
+			CertManager: cert_helper.NewCertManager(config, nil, nil),
+		}
+
+		items, failures := k.Inventory(ctx)
+
+		switch output {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(items); err != nil {
+				log.Fatalf("Error encoding inventory: %v", err)
+			}
+		case "csv":
+			writer := csv.NewWriter(os.Stdout)
+			writer.Write(inventoryHeader)
+			for _, item := range items {
+				writer.Write(inventoryRow(item))
+			}
+			writer.Flush()
+		case "table":
+			writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			for i, column := range inventoryHeader {
+				if i > 0 {
+					fmt.Fprint(writer, "\t")
+				}
+				fmt.Fprint(writer, column)
+			}
+			fmt.Fprintln(writer)
+			for _, item := range items {
+				for i, column := range inventoryRow(item) {
+					if i > 0 {
+						fmt.Fprint(writer, "\t")
+					}
+					fmt.Fprint(writer, column)
+				}
+				fmt.Fprintln(writer)
+			}
+			writer.Flush()
+			for _, err := range failures {
+				fmt.Printf("discovery failed: %v\n", err)
+			}
+		default:
+			log.Fatalf("Unknown output format: %s", output)
+		}
+
+		if len(failures) > 0 {
+			log.Fatalf("Error: inventory is incomplete, %d discoveries failed", len(failures))
+		}
+	},
+}
+
+func init() {
+	inventoryCmd.Flags().StringP("output", "o", "table", "output format: table, json or csv")
+	rootCmd.AddCommand(inventoryCmd)
+}
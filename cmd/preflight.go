@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var preflightCmd = &cobra.Command{
+	Use:   "preflight [domain...]",
+	Short: "check that _acme-challenge records are delegated by CNAME",
+	Long: "Check that _acme-challenge.<domain> is a CNAME into the validation zone.\n" +
+		"Without arguments, check every domain the keeper would issue a certificate for.\n" +
+		"Domains issued without DNS-01, by HTTP-01 or cas, and imported ones are skipped.",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		config := newAliConfig()
+		certManager := newCertManager(ctx, config, newStorage(config))
+
+		domains := args
+		if len(domains) == 0 {
+			for _, serviceAgent := range newServiceAgents(config) {
+				for item := range serviceAgent.CertRequest(ctx) {
+					if item.Err != nil {
+						log.Printf("discovery failed: %v", item.Err)
+						continue
+					}
+					domains = append(domains, item.Request.Domain())
+				}
+			}
+		}
+
+		// only the common names issued by DNS-01 need the delegation
+		var commonNames []string
+		seen := map[string]bool{}
+		for _, domain := range domains {
+			commonName := certManager.CommonName(ctx, domain)
+			if seen[commonName] {
+				continue
+			}
+			seen[commonName] = true
+
+			if certManager.External(ctx, commonName) {
+				fmt.Printf("%s: skipped, imported and never issued\n", commonName)
+				continue
+			}
+			if issuer := certManager.Issuer(commonName); !cert_helper.UsesDelegation(issuer) {
+				fmt.Printf("%s: skipped, issued by %s without DNS-01\n", commonName, issuer.Name())
+				continue
+			}
+			commonNames = append(commonNames, commonName)
+		}
+
+		validationZone := viper.GetString("acme-challenge-zone")
+		missing := 0
+		for _, commonName := range commonNames {
+			status := cert_helper.CheckDelegation(commonName, validationZone, nil)
+			if !status.Delegated {
+				missing++
+			}
+			fmt.Println(status)
+		}
+
+		if missing > 0 {
+			fmt.Printf("%d of %d domains lack the delegation CNAME\n", missing, len(commonNames))
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(preflightCmd)
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "bind every domain to the newest certificate covering it",
+	Long: "Compare the certificate bound to every cdn, oss and live domain with the valid\n" +
+		"cas certificate covering it which expires last, and rebind the domains bound to\n" +
+		"one expiring earlier. Domains bound to certificates the keeper neither uploaded\n" +
+		"nor imported are only listed, unless --take-over is set.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		takeOver, _ := cmd.Flags().GetBool("take-over")
+
+		report := newKeeper(ctx).Reconcile(ctx, takeOver)
+		report.Log()
+		if len(report.Failed) > 0 {
+			log.Fatalf("%d bindings failed to reconcile", len(report.Failed))
+		}
+	},
+}
+
+func init() {
+	reconcileCmd.Flags().Bool("take-over", false, "also rebind domains bound to certificates the keeper neither uploaded nor imported")
+	rootCmd.AddCommand(reconcileCmd)
+}
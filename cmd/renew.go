@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"log"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/verifier"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func newKeeper(ctx context.Context) *keeper.Keeper {
+	k := &keeper.Keeper{}
+
+	config := newAliConfig()
+
+	k.ServiceAgents = newServiceAgents(config)
+	k.Storage = newStorage(config)
+	k.CertManager = newCertManager(ctx, config, k.Storage)
+	k.CleanupPolicy = cert_helper.CleanupPolicy{
+		Retain:      viper.GetInt("cleanup-retain"),
+		GracePeriod: viper.GetDuration("cleanup-grace-period"),
+	}
+
+	k.Reserve = viper.GetDuration("deadline-reserve")
+	k.Shard = viper.GetInt("shard")
+	k.Backoff = keeper.BackoffPolicy{
+		Base:       viper.GetDuration("failure-backoff"),
+		Max:        viper.GetDuration("failure-backoff-max"),
+		StuckAfter: viper.GetInt("failure-stuck-after"),
+	}
+
+	k.Canary = keeper.CanaryPolicy{
+		Domains: viper.GetStringSlice("canary-domains"),
+		Percent: viper.GetInt("canary-percent"),
+		Soak:    viper.GetDuration("canary-soak"),
+	}
+
+	if viper.GetBool("verify") {
+		k.Verifier = verifier.NewVerifier()
+		k.Verifier.Attempts = viper.GetInt("verify-attempts")
+		k.Verifier.Interval = viper.GetDuration("verify-interval")
+		for domain, address := range viper.GetStringMapString("verify-addresses") {
+			k.Verifier.Addresses[domain] = address
+		}
+		if resolver := viper.GetString("verify-resolver"); resolver != "" {
+			k.Verifier.Resolver = verifier.NewResolver(resolver)
+		}
+	}
+
+	return k
+}
+
+var renewCmd = &cobra.Command{
+	Use:   "renew <domain>...",
+	Short: "renew the certificates of the domains even if they are not close to expiry",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		deploy, _ := cmd.Flags().GetBool("deploy")
+		k := newKeeper(ctx)
+
+		failed := 0
+		renewed := map[string]bool{}
+		for _, domain := range args {
+			commonName := k.CertManager.CommonName(ctx, domain)
+			if renewed[commonName] {
+				continue
+			}
+			renewed[commonName] = true
+
+			cert, err := k.CertManager.RenewCertificate(ctx, commonName)
+			if err != nil {
+				log.Printf("renew %s failed: %v", commonName, err)
+				failed++
+				continue
+			}
+
+			log.Printf("renewed %s, expires %s (cas id %d)", commonName, cert.X509Certificate().NotAfter, cert.CasCertificateId)
+		}
+
+		if deploy {
+			failed += k.Deploy(ctx, args, true)
+		}
+
+		if failed > 0 {
+			log.Fatalf("%d failures", failed)
+		}
+	},
+}
+
+var deployCmd = &cobra.Command{
+	Use:   "deploy <domain>...",
+	Short: "push the current certificate to the cdn, oss and live bindings of the domains",
+	Long: "Push the current certificate to the bindings of the domains, a domain may also\n" +
+		"be a common name like *.example.com to deploy to every domain it covers.",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		force, _ := cmd.Flags().GetBool("force")
+
+		if failed := newKeeper(ctx).Deploy(ctx, args, force); failed > 0 {
+			log.Fatalf("%d bindings failed", failed)
+		}
+	},
+}
+
+func init() {
+	renewCmd.Flags().Bool("deploy", false, "deploy the renewed certificates to every matching binding")
+	deployCmd.Flags().Bool("force", false, "deploy even if the bound certificate is not close to expiry")
+
+	rootCmd.AddCommand(renewCmd, deployCmd)
+}
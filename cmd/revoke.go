@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke <common-name|cas-id>",
+	Short: "revoke a certificate, reissue it with a fresh key and rebind every service using it",
+	Long: "Revoke a certificate issued by the keeper, e.g. after its key.pem leaked.\n" +
+		"A new certificate is issued with a fresh private key and every domain bound to\n" +
+		"the old certificate is rebound to it. Only then the old one is revoked and\n" +
+		"deleted from cas, it is kept if the reissue or any rebind fails.\n\n" +
+		"Reason codes (RFC 5280): 0 unspecified, 1 keyCompromise, 3 affiliationChanged,\n" +
+		"4 superseded, 5 cessationOfOperation.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		reason, _ := cmd.Flags().GetUint("reason")
+
+		if err := newKeeper(ctx).Revoke(ctx, args[0], reason); err != nil {
+			log.Fatalf("Error revoking certificate: %v", err)
+		}
+	},
+}
+
+func init() {
+	revokeCmd.Flags().Uint("reason", 1, "revocation reason code")
+	rootCmd.AddCommand(revokeCmd)
+}
@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback <domain>",
+	Short: "bind the domain to the certificate it was bound to before the last deployment",
+	Long: "Bind the domain to its previous certificate, as recorded in storage before every\n" +
+		"deployment, in every service the domain is found in. Rolling back again goes\n" +
+		"further back in the history.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		if failed := newKeeper(ctx).Rollback(ctx, args[0]); failed > 0 {
+			log.Fatalf("%d bindings failed to roll back", failed)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var resumeRolloutCmd = &cobra.Command{
+	Use:   "resume-rollout <common-name>...",
+	Short: "resume the rollouts of the common names halted by a failed canary",
+	Long: "Clear the halt recorded in storage when a canary failed, so the next run deploys\n" +
+		"the canaries of the certificate again and, once they pass, the other domains.\n" +
+		"Run it once the cause of the failed canary is fixed.",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := newContext()
+		defer cancel()
+
+		resumed, err := newKeeper(ctx).ResumeRollouts(ctx, args)
+		if err != nil {
+			log.Fatalf("Error resuming rollouts: %v", err)
+		}
+
+		for _, commonName := range resumed {
+			log.Printf("resumed rollout of %s", commonName)
+		}
+		log.Printf("%d rollouts resumed", len(resumed))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resumeRolloutCmd)
+}
@@ -1,20 +1,26 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
 	"github.com/alibabacloud-go/tea/tea"
-	"github.com/geektheripper/alicdn-ssl-keeper/keeper"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent_cdn"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent_live"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent_oss"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/challenge_oss"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage_oss"
+	"github.com/geektheripper/alicdn-ssl-keeper/utils"
 	"github.com/go-acme/lego/v4/lego"
 	"github.com/joho/godotenv"
 	"github.com/spf13/cobra"
@@ -25,44 +31,245 @@ var rootCmd = &cobra.Command{
 	Use:   "ssl-keeper",
 	Short: "auto update certificates for alibaba cloud cdn",
 	Run: func(cmd *cobra.Command, args []string) {
-		keeper := &keeper.Keeper{}
+		ctx, cancel := newContext()
+		defer cancel()
 
-		config := &aliapi.Config{
-			RegionId:        tea.String(viper.GetString("region-id")),
-			AccessKeyId:     tea.String(viper.GetString("access-key-id")),
-			AccessKeySecret: tea.String(viper.GetString("access-key-secret")),
+		newKeeper(ctx).Run(ctx).Log()
+	},
+}
+
+func newAliConfig() *aliapi.Config {
+	config := &aliapi.Config{
+		RegionId:        tea.String(viper.GetString("region-id")),
+		AccessKeyId:     tea.String(viper.GetString("access-key-id")),
+		AccessKeySecret: tea.String(viper.GetString("access-key-secret")),
+	}
+
+	if timeout := viper.GetDuration("call-timeout"); timeout > 0 {
+		config.SetReadTimeout(int(timeout.Milliseconds()))
+		config.SetConnectTimeout(int(timeout.Milliseconds()))
+	}
+
+	return config
+}
+
+// newContext bounds a command by the run deadline, when one is set.
+func newContext() (context.Context, context.CancelFunc) {
+	if deadline := viper.GetDuration("deadline"); deadline > 0 {
+		return context.WithTimeout(context.Background(), deadline)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+func newServiceAgents(config *aliapi.Config) []agent.ServiceCertAgent {
+	cdnAgent, err := agent_cdn.NewCdnCertAgent(
+		*config,
+		viper.GetString("cdn-tag"),
+		viper.GetString("cdn-resource-group"),
+	)
+	if err != nil {
+		log.Fatalf("Error creating cdn agent: %v", err)
+	}
+
+	liveAgent, err := agent_live.NewLiveCertAgent(*config)
+	if err != nil {
+		log.Fatalf("Error creating live agent: %v", err)
+	}
+
+	return []agent.ServiceCertAgent{
+		cdnAgent,
+		agent_oss.NewOssCertAgent(*config),
+		liveAgent,
+	}
+}
+
+func newStorage(config *aliapi.Config) storage.StorageService {
+	storage, err := storage_oss.NewOssBucketHelper(
+		*config,
+		viper.GetString("oss-endpoints"),
+		viper.GetString("oss-bucket"),
+		viper.GetString("oss-key-prefix"),
+	)
+	if err != nil {
+		log.Fatalf("Error creating storage: %v", err)
+	}
+
+	return storage
+}
+
+// IssuerRule picks an issuer other than the default one for a domain. A rule
+// for a wildcard or apex applies to its common name, a rule for any other
+// domain gets a certificate of the domain itself.
+type IssuerRule struct {
+	Domain string `mapstructure:"domain"`
+	Issuer string `mapstructure:"issuer"`
+}
+
+func newIssuer(ctx context.Context, name string, config *aliapi.Config, storage storage.StorageService) cert_helper.Issuer {
+	switch name {
+	case "acme":
+		var dnsProviders []cert_helper.DNSProviderConfig
+		if err := viper.UnmarshalKey("dns-providers", &dnsProviders); err != nil {
+			log.Fatalf("Error parsing dns-providers: %v", err)
 		}
 
-		// Services
-		keeper.ServiceAgents = []agent.ServiceCertAgent{
-			agent_cdn.NewCdnCertAgent(
-				*config,
-				viper.GetString("cdn-tag"),
-				viper.GetString("cdn-resource-group"),
-			),
-			agent_oss.NewOssCertAgent(*config),
-			agent_live.NewLiveCertAgent(*config),
+		legoClient, err := cert_helper.InitLego(
+			ctx,
+			storage,
+			config,
+			viper.GetString("acme-email"),
+			viper.GetString("acme-directory-url"),
+			dnsProviders,
+		)
+		if err != nil {
+			log.Fatalf("Error initializing lego: %v", err)
+		}
+
+		return cert_helper.NewAcmeIssuer(legoClient)
+	case "cas":
+		var casConfig cert_helper.CasIssuerConfig
+		if err := viper.UnmarshalKey("cas-issuer", &casConfig); err != nil {
+			log.Fatalf("Error parsing cas-issuer: %v", err)
+		}
+
+		issuer, err := cert_helper.NewCasIssuer(config, casConfig)
+		if err != nil {
+			log.Fatalf("Error initializing cas issuer: %v", err)
+		}
+
+		return issuer
+	case "local-ca":
+		issuer, err := cert_helper.NewLocalCAIssuer(ctx, storage, "local-ca", viper.GetDuration("local-ca-validity"))
+		if err != nil {
+			log.Fatalf("Error initializing local ca: %v", err)
+		}
+
+		return issuer
+	default:
+		log.Fatalf("Unknown issuer: %s", name)
+		return nil
+	}
+}
+
+func newCertManager(ctx context.Context, config *aliapi.Config, storage storage.StorageService) *cert_helper.CertManager {
+	issuers := map[string]cert_helper.Issuer{}
+	getIssuer := func(name string) cert_helper.Issuer {
+		if _, ok := issuers[name]; !ok {
+			issuers[name] = newIssuer(ctx, name, config, storage)
+		}
+		return issuers[name]
+	}
+
+	certManager := cert_helper.NewCertManager(config, getIssuer(viper.GetString("issuer")), storage)
+
+	preference, err := cert_helper.ParseCoveragePreference(viper.GetString("cas-preference"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	certManager.SetCoveragePreference(preference)
+
+	var issuerRules []IssuerRule
+	if err := viper.UnmarshalKey("issuers", &issuerRules); err != nil {
+		log.Fatalf("Error parsing issuers: %v", err)
+	}
+
+	for _, rule := range issuerRules {
+		// cas only issues exact names, and a rule for www.example.com would
+		// never match the derived common name *.example.com
+		if rule.Issuer == "cas" || utils.DomainToCertCommonName(rule.Domain) != rule.Domain {
+			certManager.SetExactIssuer(rule.Domain, getIssuer(rule.Issuer))
+		} else {
+			certManager.SetIssuer(rule.Domain, getIssuer(rule.Issuer))
+		}
+	}
+
+	var http01Domains []challenge_oss.HTTP01Domain
+	if err := viper.UnmarshalKey("http01", &http01Domains); err != nil {
+		log.Fatalf("Error parsing http01: %v", err)
+	}
+
+	if len(http01Domains) > 0 {
+		cdnAgent, err := agent_cdn.NewCdnCertAgent(*config, "", "")
+		if err != nil {
+			log.Fatalf("Error creating cdn agent: %v", err)
 		}
 
-		// Storage
-		keeper.Storage = storage_oss.NewOssBucketHelper(
+		http01Provider := challenge_oss.NewHTTP01Provider(
 			*config,
-			viper.GetString("oss-endpoints"),
-			viper.GetString("oss-bucket"),
-			viper.GetString("oss-key-prefix"),
+			cdnAgent,
+			agent_oss.NewOssCertAgent(*config),
+			http01Domains,
 		)
 
-		// CertManager
-		legoClient := cert_helper.InitLego(
-			keeper.Storage,
-			config,
+		http01Client, err := cert_helper.InitLegoHTTP01(
+			ctx,
+			storage,
 			viper.GetString("acme-email"),
 			viper.GetString("acme-directory-url"),
+			http01Provider,
 		)
-		keeper.CertManager = cert_helper.NewCertManager(config, legoClient, keeper.Storage)
+		if err != nil {
+			log.Fatalf("Error initializing lego for http-01: %v", err)
+		}
 
-		keeper.Run()
-	},
+		http01Issuer := cert_helper.NewAcmeHTTP01Issuer(http01Client)
+		for _, domain := range http01Provider.Domains() {
+			certManager.SetExactIssuer(domain, http01Issuer)
+		}
+	}
+
+	if rootsFile := viper.GetString("trusted-roots"); rootsFile != "" {
+		roots, err := os.ReadFile(rootsFile)
+		if err != nil {
+			log.Fatalf("Error reading trusted roots: %v", err)
+		}
+		if err := certManager.AddTrustedRoots(roots); err != nil {
+			log.Fatalf("Error loading trusted roots: %v", err)
+		}
+	}
+
+	// both acme issuers count against the same limits
+	if perDomain := viper.GetInt("rate-limit-per-domain"); perDomain > 0 {
+		limits := cert_helper.LetsEncryptLimits
+		limits.PerDomain = perDomain
+		limits.Duplicates = viper.GetInt("rate-limit-duplicates")
+		limits.Reserve = viper.GetInt("rate-limit-reserve")
+		limits.Urgent = viper.GetDuration("rate-limit-urgent")
+		limits.Jitter = viper.GetDuration("renew-jitter")
+		certManager.SetIssuanceSchedule("acme", cert_helper.NewIssuanceSchedule(storage, limits))
+	}
+
+	for _, issuer := range issuers {
+		if localCA, ok := issuer.(*cert_helper.LocalCAIssuer); ok {
+			if err := certManager.AddTrustedRoots(localCA.CACertificate()); err != nil {
+				log.Fatalf("Error trusting local ca: %v", err)
+			}
+		}
+	}
+
+	return certManager
+}
+
+// initRetry sets the retry policy of every service, the flags are the
+// defaults and the retry section of the config file overrides them per
+// service, like retry.cdn.budget.
+func initRetry() {
+	retry.DefaultPolicy = retry.Policy{
+		Attempts:  viper.GetInt("retry-attempts"),
+		BaseDelay: viper.GetDuration("retry-base-delay"),
+		MaxDelay:  viper.GetDuration("retry-max-delay"),
+	}
+
+	for service := range viper.GetStringMap("retry") {
+		policy := retry.DefaultPolicy
+		if err := viper.UnmarshalKey("retry."+service, &policy); err != nil {
+			log.Fatalf("Error parsing retry policy of %s: %v", service, err)
+		}
+		retry.Default.SetPolicy(service, policy)
+	}
+
+	retry.Default.SetRateLimit(viper.GetFloat64("api-rate-limit"), viper.GetInt("api-rate-burst"))
 }
 
 func Execute() {
@@ -72,31 +279,98 @@ func Execute() {
 	}
 }
 
+func initConfig() {
+	configFile := viper.GetString("config")
+	if configFile == "" {
+		return
+	}
+
+	viper.SetConfigFile(configFile)
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Error loading config file: %v", err)
+	}
+}
+
 func init() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+	// the .env file is optional, settings may come from the environment
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatalf("Error loading .env file: %v", err)
 	}
+	cobra.OnInitialize(initConfig, initRetry)
+
+	flags := rootCmd.PersistentFlags()
+
+	flags.String("config", "", "config file, per-zone dns providers, issuers, http-01 domains and per-service retry policies can only be set here")
+
+	// Deadline
+	flags.Duration("deadline", 0, "deadline of a run, like the execution limit of function compute, 0 for none")
+	flags.Duration("deadline-reserve", 2*time.Minute, "no new domain is started once less than this is left before the deadline")
+	flags.Duration("call-timeout", 30*time.Second, "timeout of a single aliyun api call")
+	flags.Int("shard", 0, "domains deployed per run, the next run resumes the pass; 0 for all")
+
+	// Issuer
+	flags.String("issuer", "acme", "default certificate issuer: acme, cas or local-ca")
+	flags.Duration("local-ca-validity", 90*24*time.Hour, "validity of certificates signed by the local ca")
+	flags.String("cas-preference", "purchased", "cas certificate to reuse when several cover a domain: purchased, longest or keeper")
+	flags.String("trusted-roots", "", "PEM file of roots trusted besides the system ones when validating certificates")
+
+	// Rate limits
+	flags.Int("rate-limit-per-domain", 50, "acme certificates per registered domain and week, 0 to not track issuance")
+	flags.Int("rate-limit-duplicates", 5, "acme certificates for the same names per week")
+	flags.Int("rate-limit-reserve", 10, "certificates per registered domain kept for urgent renewals, others are deferred")
+	flags.Duration("rate-limit-urgent", 3*24*time.Hour, "renewals expiring within this are never deferred by the reserve or jitter")
+	flags.Duration("renew-jitter", 3*24*time.Hour, "renewals not yet urgent wait a random part of this, to spread them out")
+
+	// Cleanup
+	flags.Int("cleanup-retain", 1, "previous certificate versions kept in cas for rollback")
+	flags.Duration("cleanup-grace-period", 72*time.Hour, "keep a replaced certificate in cas until its successor is this old")
+
+	// Retry
+	flags.Int("retry-attempts", 5, "attempts of aliyun api calls failing with throttling or server errors")
+	flags.Duration("retry-base-delay", time.Second, "delay before the first retry, doubled on every retry")
+	flags.Duration("retry-max-delay", 30*time.Second, "maximum delay between retries")
+	flags.Float64("api-rate-limit", 10, "calls per second of every aliyun api, 0 for unlimited")
+	flags.Int("api-rate-burst", 5, "burst of calls of every aliyun api")
+
+	// Backoff
+	flags.Duration("failure-backoff", time.Hour, "wait before retrying a common name that failed to issue, doubled on every failure")
+	flags.Duration("failure-backoff-max", 7*24*time.Hour, "maximum wait before retrying a common name that failed to issue")
+	flags.Int("failure-stuck-after", 5, "failures in a row after which a common name is reported as stuck, 0 to never report")
+
+	// Verify
+	flags.Bool("verify", false, "check by tls handshakes that domains serve the deployed certificate")
+	flags.Int("verify-attempts", 10, "handshakes before a domain is reported as serving the old certificate")
+	flags.Duration("verify-interval", 30*time.Second, "interval between handshakes, for cdn propagation")
+	flags.String("verify-resolver", "", "dns server used to resolve the verified domains, like 223.5.5.5:53")
+	flags.StringToString("verify-addresses", nil, "address overrides for verified domains, like www.example.com=1.2.3.4:443")
+
+	// Canary
+	flags.StringSlice("canary-domains", nil, "domains a renewed certificate is deployed to first")
+	flags.Int("canary-percent", 0, "percentage of the domains of a renewed certificate deployed to first")
+	flags.Duration("canary-soak", time.Hour, "wait after the canaries before deploying to the other domains")
+
 	// ACME
-	rootCmd.Flags().String("acme-directory-url", lego.LEDirectoryProduction, "acme directory url")
-	rootCmd.Flags().String("acme-email", "", "acme email")
+	flags.String("acme-directory-url", lego.LEDirectoryProduction, "acme directory url")
+	flags.String("acme-email", "", "acme email")
+	flags.String("acme-challenge-zone", "", "zone that _acme-challenge records are delegated to by CNAME")
 
 	// Aliyun Creds
-	rootCmd.Flags().String("region-id", "cn-hangzhou", "aliyun region id")
-	rootCmd.Flags().String("access-key-id", "", "aliyun access key id")
-	rootCmd.Flags().String("access-key-secret", "", "aliyun access key secret")
+	flags.String("region-id", "cn-hangzhou", "aliyun region id")
+	flags.String("access-key-id", "", "aliyun access key id")
+	flags.String("access-key-secret", "", "aliyun access key secret")
 
 	// Filters
-	rootCmd.Flags().String("cdn-tag", "", "filter domains by tag in key[:value] format")
-	rootCmd.Flags().String("cdn-resource-group", "", "filter domains by resource group id")
+	flags.String("cdn-tag", "", "filter domains by tag in key[:value] format")
+	flags.String("cdn-resource-group", "", "filter domains by resource group id")
 
 	// OSS
-	rootCmd.Flags().String("oss-endpoints", "", "oss endpoints, default to oss-{region-id}.aliyuncs.com")
-	rootCmd.Flags().String("oss-bucket", "", "oss bucket")
-	rootCmd.Flags().String("oss-key-prefix", "ssl-keeper", "oss key prefix")
+	flags.String("oss-endpoints", "", "oss endpoints, default to oss-{region-id}.aliyuncs.com")
+	flags.String("oss-bucket", "", "oss bucket")
+	flags.String("oss-key-prefix", "ssl-keeper", "oss key prefix")
 
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
-	viper.BindPFlags(rootCmd.Flags())
+	viper.BindPFlags(flags)
 
 	// https://github.com/aliyun/aliyun-cli/blob/master/README.md#supported-environment-variables
 	viper.BindEnv("region-id", "ALIBABACLOUD_REGION_ID", "ALICLOUD_REGION_ID", "REGION")
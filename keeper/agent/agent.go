@@ -1,13 +1,115 @@
 package agent
 
-import "github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+)
+
+// Binding is the certificate currently bound to a domain, CertId is the cas
+// certificate id when the service reports it.
+type Binding struct {
+	CertName string
+	CertId   int64
+	NotAfter time.Time
+}
+
+// NeedsRenewal reports whether the bound certificate expires within 7 days.
+func (b Binding) NeedsRenewal() bool {
+	return !b.NotAfter.After(time.Now().AddDate(0, 0, 7))
+}
+
+// Uses reports whether the binding refers to the given cas certificate.
+func (b Binding) Uses(certId int64, certName string) bool {
+	return (certId != 0 && b.CertId == certId) || (certName != "" && b.CertName == certName)
+}
 
 type CertRequest interface {
 	ServiceName() string
+	Domain() string
 	CommonName() string
-	SetCertificate(kc *cert_helper.Certificate) error
+	Binding() Binding
+	SetCertificate(ctx context.Context, kc *cert_helper.Certificate) error
+}
+
+// BucketCertRequest is implemented by requests of bucket scoped services.
+type BucketCertRequest interface {
+	CertRequest
+	Region() string
+	Bucket() string
+}
+
+// Discovered is a domain found by an agent, or the error of the domain,
+// bucket or page the agent failed on. Discovery goes on after an error
+// whenever the agent can.
+type Discovered struct {
+	Request CertRequest
+	Err     error
 }
 
 type ServiceCertAgent interface {
-	CertRequest() <-chan CertRequest
+	// CertRequest emits the domains whose certificate needs renewal.
+	CertRequest(ctx context.Context) <-chan Discovered
+	// Bindings emits every domain of the service, read-only.
+	Bindings(ctx context.Context) <-chan Discovered
+}
+
+// Emit sends an item unless the context is done, discovery stops when it
+// returns false.
+func Emit(ctx context.Context, ch chan<- Discovered, item Discovered) bool {
+	select {
+	case ch <- item:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// NeedsRenewal filters the bindings down to the ones that need renewal,
+// errors are passed through.
+func NeedsRenewal(ctx context.Context, bindings <-chan Discovered) <-chan Discovered {
+	ch := make(chan Discovered)
+
+	go func() {
+		defer close(ch)
+
+		for item := range bindings {
+			if item.Err != nil || item.Request.Binding().NeedsRenewal() {
+				if !Emit(ctx, ch, item) {
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+var expireTimeLayouts = []string{
+	time.RFC3339,
+	time.RFC1123,
+	"Jan _2 15:04:05 2006 MST",
+	"2006-01-02 15:04:05",
+}
+
+// ParseExpireTime parses the various time formats of aliyun apis, a zero time
+// is returned when none of them matches.
+func ParseExpireTime(value string) time.Time {
+	for _, layout := range expireTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// ParseCertId parses cas certificate ids, which may come with a region suffix
+// like 12345-cn-hangzhou.
+func ParseCertId(value string) int64 {
+	id, _ := strconv.ParseInt(strings.SplitN(value, "-", 2)[0], 10, 64)
+	return id
 }
@@ -1,8 +1,8 @@
 package agent_cdn
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
@@ -11,51 +11,78 @@ import (
 	"github.com/alibabacloud-go/tea/tea"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
 	"github.com/geektheripper/alicdn-ssl-keeper/utils"
 )
 
+// CdnClient is the part of the cdn api the keeper calls, *cdn.Client
+// implements it.
+type CdnClient interface {
+	DescribeUserDomains(request *cdn.DescribeUserDomainsRequest) (*cdn.DescribeUserDomainsResponse, error)
+	DescribeDomainCertificateInfo(request *cdn.DescribeDomainCertificateInfoRequest) (*cdn.DescribeDomainCertificateInfoResponse, error)
+	DescribeCdnDomainDetail(request *cdn.DescribeCdnDomainDetailRequest) (*cdn.DescribeCdnDomainDetailResponse, error)
+	SetCdnDomainSSLCertificate(request *cdn.SetCdnDomainSSLCertificateRequest) (*cdn.SetCdnDomainSSLCertificateResponse, error)
+	RefreshObjectCaches(request *cdn.RefreshObjectCachesRequest) (*cdn.RefreshObjectCachesResponse, error)
+}
+
 type CdnCertRequest struct {
-	cdnClient *cdn.Client
+	cdnClient CdnClient
 	domain    *cdn.DescribeUserDomainsResponseBodyDomainsPageData
+	binding   agent.Binding
 }
 
 func (r *CdnCertRequest) ServiceName() string {
 	return "cdn"
 }
 
+func (r *CdnCertRequest) Domain() string {
+	return *r.domain.DomainName
+}
+
 func (r *CdnCertRequest) CommonName() string {
 	return utils.DomainToCertCommonName(*r.domain.DomainName)
 }
 
-func (r *CdnCertRequest) SetCertificate(cert *cert_helper.Certificate) error {
-	_, err := r.cdnClient.SetCdnDomainSSLCertificate(&cdn.SetCdnDomainSSLCertificateRequest{
-		DomainName:  tea.String(*r.domain.DomainName),
-		SSLProtocol: tea.String("on"),
-		CertType:    tea.String("cas"),
-		CertName:    tea.String(cert.CasName()),
-		CertId:      &cert.CasCertificateId,
+func (r *CdnCertRequest) Binding() agent.Binding {
+	return r.binding
+}
+
+func (r *CdnCertRequest) SetCertificate(ctx context.Context, cert *cert_helper.Certificate) error {
+	err := retry.Default.Do(ctx, "cdn", "SetCdnDomainSSLCertificate", func() error {
+		_, err := r.cdnClient.SetCdnDomainSSLCertificate(&cdn.SetCdnDomainSSLCertificateRequest{
+			DomainName:  tea.String(*r.domain.DomainName),
+			SSLProtocol: tea.String("on"),
+			CertType:    tea.String("cas"),
+			CertName:    tea.String(cert.CasName()),
+			CertId:      &cert.CasCertificateId,
+		})
+		return err
 	})
 
 	if err != nil {
-		return fmt.Errorf("set cdn domain ssl certificate failed: %v", err)
+		return fmt.Errorf("set cdn domain ssl certificate failed: %w", err)
 	}
 
 	return nil
 }
 
 type CdnCertAgent struct {
-	CdnClient        *cdn.Client
+	CdnClient        CdnClient
 	CdnTag           string
 	CdnResourceGroup string
 }
 
-func NewCdnCertAgent(aliConfig aliapi.Config, cdnTag, cdnResourceGroup string) *CdnCertAgent {
+func NewCdnCertAgent(aliConfig aliapi.Config, cdnTag, cdnResourceGroup string) (*CdnCertAgent, error) {
 	aliConfig.Endpoint = tea.String("cdn.aliyuncs.com")
 	cdnClient, err := cdn.NewClient(&aliConfig)
 	if err != nil {
-		log.Fatalf("Error creating cdn client: %v", err)
+		return nil, fmt.Errorf("create cdn client failed: %v", err)
 	}
 
+	return NewCdnCertAgentWithClient(cdnClient, cdnTag, cdnResourceGroup), nil
+}
+
+func NewCdnCertAgentWithClient(cdnClient CdnClient, cdnTag, cdnResourceGroup string) *CdnCertAgent {
 	return &CdnCertAgent{
 		CdnClient:        cdnClient,
 		CdnTag:           cdnTag,
@@ -63,33 +90,73 @@ func NewCdnCertAgent(aliConfig aliapi.Config, cdnTag, cdnResourceGroup string) *
 	}
 }
 
-func (a *CdnCertAgent) isDomainExpired(domain *string) (bool, error) {
-	resp, err := a.CdnClient.DescribeDomainCertificateInfo(&cdn.DescribeDomainCertificateInfoRequest{
-		DomainName: domain,
+func (a *CdnCertAgent) describeBinding(ctx context.Context, domain *string) (agent.Binding, error) {
+	binding := agent.Binding{}
+
+	resp, err := retry.Call(ctx, retry.Default, "cdn", "DescribeDomainCertificateInfo", func() (*cdn.DescribeDomainCertificateInfoResponse, error) {
+		return a.CdnClient.DescribeDomainCertificateInfo(&cdn.DescribeDomainCertificateInfoRequest{
+			DomainName: domain,
+		})
 	})
 	if err != nil {
-		return false, fmt.Errorf("describe domain certificate info failed: %v", err)
+		return binding, fmt.Errorf("describe domain certificate info failed: %v", err)
 	}
 
-	if resp.Body.CertInfos.CertInfo != nil {
+	if resp.Body.CertInfos != nil {
 		for _, certInfo := range resp.Body.CertInfos.CertInfo {
-			if *certInfo.CertExpireTime == "" {
+			if tea.StringValue(certInfo.CertExpireTime) == "" {
 				continue
 			}
 
 			expireTime, _ := time.Parse(time.RFC3339, *certInfo.CertExpireTime)
-
-			if expireTime.After(time.Now().AddDate(0, 0, 7)) {
-				log.Printf("cert for %s is not expired", *domain)
-				return false, nil
+			if expireTime.After(binding.NotAfter) {
+				binding = agent.Binding{
+					CertName: tea.StringValue(certInfo.CertName),
+					CertId:   agent.ParseCertId(tea.StringValue(certInfo.CertId)),
+					NotAfter: expireTime,
+				}
 			}
 		}
 	}
 
-	return true, nil
+	return binding, nil
 }
 
-func (a *CdnCertAgent) listDomains(pageNumber int32) ([]*cdn.DescribeUserDomainsResponseBodyDomainsPageData, bool, error) {
+// OssOrigin returns the oss bucket and region the cdn domain pulls from.
+func (a *CdnCertAgent) OssOrigin(ctx context.Context, domain string) (string, string, error) {
+	resp, err := retry.Call(ctx, retry.Default, "cdn", "DescribeCdnDomainDetail", func() (*cdn.DescribeCdnDomainDetailResponse, error) {
+		return a.CdnClient.DescribeCdnDomainDetail(&cdn.DescribeCdnDomainDetailRequest{
+			DomainName: tea.String(domain),
+		})
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("describe cdn domain detail failed: %v", err)
+	}
+
+	detail := resp.Body.GetDomainDetailModel
+	if detail == nil || detail.SourceModels == nil {
+		return "", "", fmt.Errorf("cdn domain %s has no origin", domain)
+	}
+
+	for _, source := range detail.SourceModels.SourceModel {
+		if tea.StringValue(source.Type) != "oss" {
+			continue
+		}
+
+		// {bucket}.oss-{region}[-internal].aliyuncs.com
+		parts := strings.SplitN(tea.StringValue(source.Content), ".", 3)
+		if len(parts) < 3 || !strings.HasPrefix(parts[1], "oss-") {
+			continue
+		}
+
+		region := strings.TrimSuffix(strings.TrimPrefix(parts[1], "oss-"), "-internal")
+		return parts[0], region, nil
+	}
+
+	return "", "", fmt.Errorf("cdn domain %s has no oss origin", domain)
+}
+
+func (a *CdnCertAgent) listDomains(ctx context.Context, pageNumber int32) ([]*cdn.DescribeUserDomainsResponseBodyDomainsPageData, bool, error) {
 	request := &cdn.DescribeUserDomainsRequest{
 		PageSize:   tea.Int32(500),
 		PageNumber: tea.Int32(pageNumber),
@@ -114,7 +181,9 @@ func (a *CdnCertAgent) listDomains(pageNumber int32) ([]*cdn.DescribeUserDomains
 		request.ResourceGroupId = tea.String(a.CdnResourceGroup)
 	}
 
-	response, err := a.CdnClient.DescribeUserDomains(request)
+	response, err := retry.Call(ctx, retry.Default, "cdn", "DescribeUserDomains", func() (*cdn.DescribeUserDomainsResponse, error) {
+		return a.CdnClient.DescribeUserDomains(request)
+	})
 	if err != nil {
 		return nil, false, fmt.Errorf("list domains failed: %v", err)
 	}
@@ -125,8 +194,12 @@ func (a *CdnCertAgent) listDomains(pageNumber int32) ([]*cdn.DescribeUserDomains
 	return body.Domains.PageData, listEnd, nil
 }
 
-func (a *CdnCertAgent) CertRequest() <-chan agent.CertRequest {
-	ch := make(chan agent.CertRequest)
+func (a *CdnCertAgent) CertRequest(ctx context.Context) <-chan agent.Discovered {
+	return agent.NeedsRenewal(ctx, a.Bindings(ctx))
+}
+
+func (a *CdnCertAgent) Bindings(ctx context.Context) <-chan agent.Discovered {
+	ch := make(chan agent.Discovered)
 
 	go func() {
 		defer close(ch)
@@ -134,30 +207,34 @@ func (a *CdnCertAgent) CertRequest() <-chan agent.CertRequest {
 		pageNumber := int32(1)
 
 		for {
-			var err error
-			domains, listEnd, err := a.listDomains(pageNumber)
+			domains, listEnd, err := a.listDomains(ctx, pageNumber)
 			if err != nil {
-				log.Fatalf("list domains failed: %v", err)
+				agent.Emit(ctx, ch, agent.Discovered{Err: err})
+				return
 			}
 
 			for _, domain := range domains {
-				expired, err := a.isDomainExpired(domain.DomainName)
+				binding, err := a.describeBinding(ctx, domain.DomainName)
 				if err != nil {
-					log.Fatalf("check domain expired failed: %v", err)
-				}
-
-				if !expired {
+					err = fmt.Errorf("domain %s: %v", tea.StringValue(domain.DomainName), err)
+					if !agent.Emit(ctx, ch, agent.Discovered{Err: err}) {
+						return
+					}
 					continue
 				}
 
-				ch <- &CdnCertRequest{
+				req := &CdnCertRequest{
 					cdnClient: a.CdnClient,
 					domain:    domain,
+					binding:   binding,
+				}
+				if !agent.Emit(ctx, ch, agent.Discovered{Request: req}) {
+					return
 				}
 			}
 
 			if listEnd {
-				break
+				return
 			}
 
 			pageNumber++
@@ -1,9 +1,9 @@
 package agent_live
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"time"
 
 	"github.com/aliyun/alibaba-cloud-sdk-go/sdk"
 	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/auth/credentials"
@@ -13,23 +13,41 @@ import (
 	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
 	"github.com/geektheripper/alicdn-ssl-keeper/utils"
 )
 
+// LiveClient is the part of the live api the keeper calls, *live.Client
+// implements it.
+type LiveClient interface {
+	DescribeLiveUserDomains(request *live.DescribeLiveUserDomainsRequest) (*live.DescribeLiveUserDomainsResponse, error)
+	DescribeLiveDomainCertificateInfo(request *live.DescribeLiveDomainCertificateInfoRequest) (*live.DescribeLiveDomainCertificateInfoResponse, error)
+	SetLiveDomainCertificate(request *live.SetLiveDomainCertificateRequest) (*live.SetLiveDomainCertificateResponse, error)
+}
+
 type LiveCertRequest struct {
-	liveClient *live.Client
+	liveClient LiveClient
 	domain     *live.PageData
+	binding    agent.Binding
 }
 
 func (r *LiveCertRequest) ServiceName() string {
 	return "live"
 }
 
+func (r *LiveCertRequest) Domain() string {
+	return r.domain.DomainName
+}
+
 func (r *LiveCertRequest) CommonName() string {
 	return utils.DomainToCertCommonName(r.domain.DomainName)
 }
 
-func (r *LiveCertRequest) SetCertificate(cert *cert_helper.Certificate) error {
+func (r *LiveCertRequest) Binding() agent.Binding {
+	return r.binding
+}
+
+func (r *LiveCertRequest) SetCertificate(ctx context.Context, cert *cert_helper.Certificate) error {
 	request := live.CreateSetLiveDomainCertificateRequest()
 	request.Scheme = "https"
 	request.DomainName = r.domain.DomainName
@@ -38,72 +56,87 @@ func (r *LiveCertRequest) SetCertificate(cert *cert_helper.Certificate) error {
 	request.SSLProtocol = "on"
 	request.ForceSet = "1"
 
-	_, err := r.liveClient.SetLiveDomainCertificate(request)
+	err := retry.Default.Do(ctx, "live", "SetLiveDomainCertificate", func() error {
+		_, err := r.liveClient.SetLiveDomainCertificate(request)
+		return err
+	})
 
 	if err != nil {
-		return fmt.Errorf("set live domain ssl certificate failed: %v", err)
+		return fmt.Errorf("set live domain ssl certificate failed: %w", err)
 	}
 
 	return nil
 }
 
 type LiveCertAgent struct {
-	LiveClient *live.Client
+	LiveClient LiveClient
 }
 
-func NewLiveCertAgent(aliConfig aliapi.Config) *LiveCertAgent {
+func NewLiveCertAgent(aliConfig aliapi.Config) (*LiveCertAgent, error) {
 	config := sdk.NewConfig()
+	if timeout := utils.CallTimeout(&aliConfig); timeout > 0 {
+		config.WithTimeout(timeout)
+	}
 	credential := credentials.NewAccessKeyCredential(*aliConfig.AccessKeyId, *aliConfig.AccessKeySecret)
 	liveClient, err := live.NewClientWithOptions("cn-hangzhou", config, credential)
 	if err != nil {
-		log.Fatalf("Error creating live client: %v", err)
+		return nil, fmt.Errorf("create live client failed: %v", err)
 	}
 
+	return NewLiveCertAgentWithClient(liveClient), nil
+}
+
+func NewLiveCertAgentWithClient(liveClient LiveClient) *LiveCertAgent {
 	return &LiveCertAgent{LiveClient: liveClient}
 }
 
-func (a *LiveCertAgent) listDomains(pageNumber int) ([]*live.PageData, bool, error) {
+func (a *LiveCertAgent) listDomains(ctx context.Context, pageNumber int) ([]live.PageData, bool, error) {
 	request := live.CreateDescribeLiveUserDomainsRequest()
 	request.Scheme = "https"
 	request.PageSize = requests.NewInteger(50)
 	request.PageNumber = requests.NewInteger(pageNumber)
 
-	response, err := a.LiveClient.DescribeLiveUserDomains(request)
+	response, err := retry.Call(ctx, retry.Default, "live", "DescribeLiveUserDomains", func() (*live.DescribeLiveUserDomainsResponse, error) {
+		return a.LiveClient.DescribeLiveUserDomains(request)
+	})
 	if err != nil {
 		return nil, false, fmt.Errorf("describe user domains failed: %v", err)
 	}
 
-	results := []*live.PageData{}
+	listEnd := (response.TotalCount < response.PageSize*response.PageNumber)
+	return response.Domains.PageData, listEnd, nil
+}
+
+func (a *LiveCertAgent) describeBinding(ctx context.Context, domainName string) (agent.Binding, error) {
+	binding := agent.Binding{}
 
-loopdomain:
-	for _, domain := range response.Domains.PageData {
-		log.Printf("Checking domain %s", domain.DomainName)
-		request := live.CreateDescribeLiveDomainCertificateInfoRequest()
-		request.Scheme = "https"
-		request.DomainName = domain.DomainName
+	request := live.CreateDescribeLiveDomainCertificateInfoRequest()
+	request.Scheme = "https"
+	request.DomainName = domainName
 
-		response, err := a.LiveClient.DescribeLiveDomainCertificateInfo(request)
-		if err != nil {
-			return nil, false, fmt.Errorf("describe live domain certificate info failed: %v", err)
-		}
+	response, err := retry.Call(ctx, retry.Default, "live", "DescribeLiveDomainCertificateInfo", func() (*live.DescribeLiveDomainCertificateInfoResponse, error) {
+		return a.LiveClient.DescribeLiveDomainCertificateInfo(request)
+	})
+	if err != nil {
+		return binding, fmt.Errorf("describe live domain certificate info failed: %v", err)
+	}
 
-		for _, certInfo := range response.CertInfos.CertInfo {
-			expireTime, _ := time.Parse("", certInfo.CertExpireTime)
-			if expireTime.After(time.Now().AddDate(0, 0, 7)) {
-				continue loopdomain
-			}
+	for _, certInfo := range response.CertInfos.CertInfo {
+		expireTime := agent.ParseExpireTime(certInfo.CertExpireTime)
+		if expireTime.After(binding.NotAfter) {
+			binding = agent.Binding{CertName: certInfo.CertName, NotAfter: expireTime}
 		}
-
-		_domain := domain
-		results = append(results, &_domain)
 	}
 
-	listEnd := (response.TotalCount < response.PageSize*response.PageNumber)
-	return results, listEnd, nil
+	return binding, nil
 }
 
-func (a *LiveCertAgent) CertRequest() <-chan agent.CertRequest {
-	ch := make(chan agent.CertRequest)
+func (a *LiveCertAgent) CertRequest(ctx context.Context) <-chan agent.Discovered {
+	return agent.NeedsRenewal(ctx, a.Bindings(ctx))
+}
+
+func (a *LiveCertAgent) Bindings(ctx context.Context) <-chan agent.Discovered {
+	ch := make(chan agent.Discovered)
 
 	go func() {
 		defer close(ch)
@@ -111,25 +144,36 @@ func (a *LiveCertAgent) CertRequest() <-chan agent.CertRequest {
 		pageNumber := int(1)
 
 		for {
-			var err error
-			domains, listEnd, err := a.listDomains(pageNumber)
+			domains, listEnd, err := a.listDomains(ctx, pageNumber)
 			if err != nil {
-				log.Fatalf("list domains failed: %v", err)
+				agent.Emit(ctx, ch, agent.Discovered{Err: err})
+				return
 			}
 
 			for _, domain := range domains {
+				log.Printf("Checking domain %s", domain.DomainName)
+				binding, err := a.describeBinding(ctx, domain.DomainName)
 				if err != nil {
-					log.Fatalf("check domain expired failed: %v", err)
+					err = fmt.Errorf("domain %s: %v", domain.DomainName, err)
+					if !agent.Emit(ctx, ch, agent.Discovered{Err: err}) {
+						return
+					}
+					continue
 				}
 
-				ch <- &LiveCertRequest{
+				_domain := domain
+				req := &LiveCertRequest{
 					liveClient: a.LiveClient,
-					domain:     domain,
+					domain:     &_domain,
+					binding:    binding,
+				}
+				if !agent.Emit(ctx, ch, agent.Discovered{Request: req}) {
+					return
 				}
 			}
 
 			if listEnd {
-				break
+				return
 			}
 
 			pageNumber++
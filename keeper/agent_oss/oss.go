@@ -1,44 +1,72 @@
 package agent_oss
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strconv"
-	"time"
 
 	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
 	"github.com/geektheripper/alicdn-ssl-keeper/utils"
 )
 
+// OssClient is the part of the oss api the keeper calls, *oss.Client
+// implements it.
+type OssClient interface {
+	ListBuckets(options ...oss.Option) (oss.ListBucketsResult, error)
+	ListBucketCname(bucketName string, options ...oss.Option) (oss.ListBucketCnameResult, error)
+	PutBucketCnameWithCertificate(bucketName string, putBucketCname oss.PutBucketCname, options ...oss.Option) error
+}
+
 type OssCertRequest struct {
-	ossClient *oss.Client
+	ossClient OssClient
 	region    string
 	bucket    string
 	domain    string
+	binding   agent.Binding
 }
 
 func (r *OssCertRequest) ServiceName() string {
 	return "oss"
 }
 
+func (r *OssCertRequest) Domain() string {
+	return r.domain
+}
+
 func (r *OssCertRequest) CommonName() string {
 	return utils.DomainToCertCommonName(r.domain)
 }
 
-func (r *OssCertRequest) SetCertificate(cert *cert_helper.Certificate) error {
-	err := r.ossClient.PutBucketCnameWithCertificate(r.bucket, oss.PutBucketCname{
-		Cname: r.domain,
-		CertificateConfiguration: &oss.CertificateConfiguration{
-			CertId: strconv.FormatInt(cert.CasCertificateId, 10),
-			Force:  true,
-		},
+func (r *OssCertRequest) Region() string {
+	return r.region
+}
+
+func (r *OssCertRequest) Bucket() string {
+	return r.bucket
+}
+
+func (r *OssCertRequest) Binding() agent.Binding {
+	return r.binding
+}
+
+func (r *OssCertRequest) SetCertificate(ctx context.Context, cert *cert_helper.Certificate) error {
+	err := retry.Default.Do(ctx, "oss", "PutBucketCname", func() error {
+		return r.ossClient.PutBucketCnameWithCertificate(r.bucket, oss.PutBucketCname{
+			Cname: r.domain,
+			CertificateConfiguration: &oss.CertificateConfiguration{
+				CertId: strconv.FormatInt(cert.CasCertificateId, 10),
+				Force:  true,
+			},
+		}, oss.WithContext(ctx))
 	})
 
 	if err != nil {
-		return fmt.Errorf("set oss bucket cname failed: %v", err)
+		return fmt.Errorf("set oss bucket cname failed: %w", err)
 	}
 
 	return nil
@@ -46,26 +74,97 @@ func (r *OssCertRequest) SetCertificate(cert *cert_helper.Certificate) error {
 
 type OssCertAgent struct {
 	AliConfig *aliapi.Config
+	// newClient replaces the oss client of every region, for tests
+	newClient func(regionId string) (OssClient, error)
 }
 
-func (a *OssCertAgent) NewOssClient(regionId string) *oss.Client {
-	ossClient, err := oss.New("oss-"+regionId+".aliyuncs.com", *a.AliConfig.AccessKeyId, *a.AliConfig.AccessKeySecret)
+func (a *OssCertAgent) NewOssClient(regionId string) (OssClient, error) {
+	if a.newClient != nil {
+		return a.newClient(regionId)
+	}
+
+	options := []oss.ClientOption{}
+	if timeout := utils.CallTimeoutSeconds(a.AliConfig); timeout > 0 {
+		options = append(options, oss.Timeout(timeout, timeout))
+	}
+
+	ossClient, err := oss.New("oss-"+regionId+".aliyuncs.com", *a.AliConfig.AccessKeyId, *a.AliConfig.AccessKeySecret, options...)
 	if err != nil {
-		log.Fatalf("Error creating oss client: %v", err)
+		return nil, fmt.Errorf("create oss client failed: %v", err)
 	}
 
-	return ossClient
+	return ossClient, nil
 }
 
 func NewOssCertAgent(aliConfig aliapi.Config) *OssCertAgent {
 	return &OssCertAgent{AliConfig: &aliConfig}
 }
 
-func (a *OssCertAgent) scanCertRequest(bucket oss.BucketProperties) ([]*OssCertRequest, error) {
+// NewOssCertAgentWithClient uses the client for the buckets of every region.
+func NewOssCertAgentWithClient(aliConfig aliapi.Config, ossClient OssClient) *OssCertAgent {
+	return &OssCertAgent{
+		AliConfig: &aliConfig,
+		newClient: func(string) (OssClient, error) { return ossClient, nil },
+	}
+}
+
+// FindCnameBucket returns the bucket and region the domain is bound to as cname.
+func (a *OssCertAgent) FindCnameBucket(ctx context.Context, domain string) (string, string, error) {
+	ossClient, err := a.NewOssClient(*a.AliConfig.RegionId)
+	if err != nil {
+		return "", "", err
+	}
+
+	nextMarker := ""
+	for {
+		result, err := retry.Call(ctx, retry.Default, "oss", "ListBuckets", func() (oss.ListBucketsResult, error) {
+			return ossClient.ListBuckets(oss.Marker(nextMarker), oss.WithContext(ctx))
+		})
+		if err != nil {
+			return "", "", fmt.Errorf("list oss buckets failed: %v", err)
+		}
+
+		for _, bucket := range result.Buckets {
+			bucketClient, err := a.NewOssClient(bucket.Region)
+			if err != nil {
+				return "", "", err
+			}
+
+			cnames, err := retry.Call(ctx, retry.Default, "oss", "ListBucketCname", func() (oss.ListBucketCnameResult, error) {
+				return bucketClient.ListBucketCname(bucket.Name, oss.WithContext(ctx))
+			})
+			if err != nil {
+				return "", "", fmt.Errorf("list cname of bucket %s failed: %v", bucket.Name, err)
+			}
+
+			for _, cname := range cnames.Cname {
+				if cname.Domain == domain {
+					return bucket.Name, bucket.Region, nil
+				}
+			}
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+
+		nextMarker = result.NextMarker
+	}
+
+	return "", "", fmt.Errorf("no oss bucket has cname %s", domain)
+}
+
+func (a *OssCertAgent) scanCertRequest(ctx context.Context, bucket oss.BucketProperties) ([]*OssCertRequest, error) {
 	log.Printf("scan domains for bucket %s", bucket.Name)
 
-	ossClient := a.NewOssClient(bucket.Region)
-	result, err := ossClient.ListBucketCname(bucket.Name)
+	ossClient, err := a.NewOssClient(bucket.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := retry.Call(ctx, retry.Default, "oss", "ListBucketCname", func() (oss.ListBucketCnameResult, error) {
+		return ossClient.ListBucketCname(bucket.Name, oss.WithContext(ctx))
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -73,11 +172,10 @@ func (a *OssCertAgent) scanCertRequest(bucket oss.BucketProperties) ([]*OssCertR
 	requestList := make([]*OssCertRequest, 0)
 
 	for _, cname := range result.Cname {
+		binding := agent.Binding{}
 		if cname.Certificate.CertId != "" {
-			expireTime, _ := time.Parse("", cname.Certificate.ValidEndDate)
-			if expireTime.After(time.Now().AddDate(0, 0, 7)) {
-				continue
-			}
+			binding.CertId = agent.ParseCertId(cname.Certificate.CertId)
+			binding.NotAfter = agent.ParseExpireTime(cname.Certificate.ValidEndDate)
 		}
 
 		requestList = append(requestList, &OssCertRequest{
@@ -85,44 +183,62 @@ func (a *OssCertAgent) scanCertRequest(bucket oss.BucketProperties) ([]*OssCertR
 			region:    bucket.Region,
 			bucket:    bucket.Name,
 			domain:    cname.Domain,
+			binding:   binding,
 		})
 	}
 
 	return requestList, nil
 }
 
-func (a *OssCertAgent) CertRequest() <-chan agent.CertRequest {
-	ch := make(chan agent.CertRequest)
+func (a *OssCertAgent) CertRequest(ctx context.Context) <-chan agent.Discovered {
+	return agent.NeedsRenewal(ctx, a.Bindings(ctx))
+}
+
+func (a *OssCertAgent) Bindings(ctx context.Context) <-chan agent.Discovered {
+	ch := make(chan agent.Discovered)
 
 	go func() {
 		defer close(ch)
-		ossClient := a.NewOssClient(*a.AliConfig.RegionId)
+
+		ossClient, err := a.NewOssClient(*a.AliConfig.RegionId)
+		if err != nil {
+			agent.Emit(ctx, ch, agent.Discovered{Err: err})
+			return
+		}
 
 		nextMarker := ""
 		for {
-			result, err := ossClient.ListBuckets(oss.Marker(nextMarker))
+			result, err := retry.Call(ctx, retry.Default, "oss", "ListBuckets", func() (oss.ListBucketsResult, error) {
+				return ossClient.ListBuckets(oss.Marker(nextMarker), oss.WithContext(ctx))
+			})
 			if err != nil {
-				log.Fatalf("Error listing oss buckets: %v", err)
+				agent.Emit(ctx, ch, agent.Discovered{Err: fmt.Errorf("list oss buckets failed: %v", err)})
+				return
 			}
 
 			for _, bucket := range result.Buckets {
-				requestList, err := a.scanCertRequest(bucket)
+				requestList, err := a.scanCertRequest(ctx, bucket)
 				if err != nil {
-					log.Fatalf("Error scanning cert request: %v", err)
+					err = fmt.Errorf("bucket %s: %v", bucket.Name, err)
+					if !agent.Emit(ctx, ch, agent.Discovered{Err: err}) {
+						return
+					}
+					continue
 				}
 
 				for _, req := range requestList {
-					ch <- req
+					if !agent.Emit(ctx, ch, agent.Discovered{Request: req}) {
+						return
+					}
 				}
 			}
 
 			if !result.IsTruncated {
-				break
+				return
 			}
 
 			nextMarker = result.NextMarker
 		}
-
 	}()
 
 	return ch
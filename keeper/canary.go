@@ -0,0 +1,263 @@
+package keeper
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
+)
+
+// CanaryPolicy binds a renewed certificate to the canary domains first, the
+// other domains follow once the canaries are deployed and the soak time has
+// passed.
+type CanaryPolicy struct {
+	Domains []string
+	// Percent of the other domains of the certificate taken as canaries.
+	Percent int
+	Soak    time.Duration
+}
+
+func (p CanaryPolicy) Enabled() bool {
+	return len(p.Domains) > 0 || p.Percent > 0
+}
+
+// canaries splits the requests of a certificate into canaries and the rest.
+func (p CanaryPolicy) canaries(requests []agent.CertRequest) ([]agent.CertRequest, []agent.CertRequest) {
+	listed := make(map[string]bool)
+	for _, domain := range p.Domains {
+		listed[domain] = true
+	}
+
+	canaries, rest := []agent.CertRequest{}, []agent.CertRequest{}
+	for _, certReq := range requests {
+		if listed[certReq.Domain()] {
+			canaries = append(canaries, certReq)
+		} else {
+			rest = append(rest, certReq)
+		}
+	}
+
+	if p.Percent > 0 && len(rest) > 0 {
+		// stable across runs, so the same domains are picked again
+		sort.SliceStable(rest, func(i, j int) bool {
+			return rest[i].ServiceName()+"/"+rest[i].Domain() < rest[j].ServiceName()+"/"+rest[j].Domain()
+		})
+
+		count := (len(rest)*p.Percent + 99) / 100
+		canaries = append(canaries, rest[:count]...)
+		rest = rest[count:]
+	}
+
+	return canaries, rest
+}
+
+// RolloutState is the progress of the rollout of a certificate, kept in
+// storage so the next run picks up where the last one stopped.
+type RolloutState struct {
+	CommonName string    `json:"common_name"`
+	CertId     int64     `json:"cert_id"`
+	Started    time.Time `json:"started"`
+	// CanaryDone is set once every canary is deployed.
+	CanaryDone time.Time `json:"canary_done,omitempty"`
+	// Halted is set when a canary failed for a reason that does not pass by
+	// itself, the certificate is not rolled out any further until the rollout
+	// is resumed. Error is the failure of the canary.
+	Halted bool   `json:"halted,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func rolloutKey(commonName string) string {
+	return "rollout/" + commonName + ".json"
+}
+
+func (k *Keeper) loadRollout(ctx context.Context, commonName string, certId int64) (*RolloutState, error) {
+	state := &RolloutState{}
+
+	data, err := k.Storage.Read(ctx, rolloutKey(commonName))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, err
+		}
+	}
+
+	// a new certificate starts a new rollout
+	if state.CertId != certId {
+		state = &RolloutState{CommonName: commonName, CertId: certId, Started: time.Now()}
+	}
+
+	return state, nil
+}
+
+// ResumeRollouts clears the halt of the rollouts of the common names, the
+// next run deploys their canaries again. It returns the common names resumed.
+func (k *Keeper) ResumeRollouts(ctx context.Context, commonNames []string) ([]string, error) {
+	resumed := []string{}
+
+	for _, commonName := range commonNames {
+		data, err := k.Storage.Read(ctx, rolloutKey(commonName))
+		if err != nil {
+			return resumed, err
+		}
+		if data == nil {
+			continue
+		}
+
+		state := &RolloutState{}
+		if err := json.Unmarshal(data, state); err != nil {
+			return resumed, err
+		}
+		if !state.Halted {
+			continue
+		}
+
+		state.Halted, state.Error, state.CanaryDone = false, "", time.Time{}
+		if err := k.saveRollout(ctx, state); err != nil {
+			return resumed, err
+		}
+		resumed = append(resumed, commonName)
+	}
+
+	return resumed, nil
+}
+
+func (k *Keeper) saveRollout(ctx context.Context, state *RolloutState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return k.Storage.Write(ctx, rolloutKey(state.CommonName), data)
+}
+
+// rollout deploys the certificates due for renewal in stages.
+func (k *Keeper) rollout(ctx context.Context, report *Report) {
+	groups := make(map[string][]agent.CertRequest)
+	commonNames := []string{}
+
+	for _, serviceAgent := range k.ServiceAgents {
+		for item := range serviceAgent.CertRequest(ctx) {
+			if item.Err != nil {
+				log.Printf("discovery failed: %v", item.Err)
+				continue
+			}
+
+			certReq := item.Request
+			commonName := k.CertManager.CommonName(ctx, certReq.Domain())
+			if _, ok := groups[commonName]; !ok {
+				commonNames = append(commonNames, commonName)
+			}
+			groups[commonName] = append(groups[commonName], certReq)
+		}
+	}
+
+	for i, commonName := range commonNames {
+		if k.stopping(ctx, report) {
+			report.Stopped = true
+			for _, rest := range commonNames[i:] {
+				report.Skipped += len(groups[rest])
+			}
+			return
+		}
+
+		if err := k.rolloutCertificate(ctx, commonName, groups[commonName], report); err != nil {
+			log.Printf("rollout of %s failed: %v", commonName, err)
+		}
+	}
+}
+
+func (k *Keeper) rolloutCertificate(ctx context.Context, commonName string, requests []agent.CertRequest, report *Report) error {
+	cert, err := k.certificate(ctx, commonName)
+	if kind := held(err); kind != "" {
+		log.Printf("rollout of %s: %v", commonName, err)
+		for _, certReq := range requests {
+			report.hold(kind, certReq.ServiceName()+"/"+certReq.Domain())
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	state, err := k.loadRollout(ctx, commonName, cert.CasCertificateId)
+	if err != nil {
+		return err
+	}
+
+	if state.Halted {
+		log.Printf("rollout of %s (%d) is halted after a failed canary, %d domains left", commonName, state.CertId, len(requests))
+		report.halt(state, len(requests))
+		return nil
+	}
+
+	canaries, rest := k.Canary.canaries(requests)
+
+	if state.CanaryDone.IsZero() {
+		if k.Verifier == nil {
+			log.Printf("canaries of %s are not verified, enable verify to catch bad certificates", commonName)
+		}
+
+		// failures that may pass by themselves leave the canaries to the next
+		// run instead of halting
+		retried := false
+
+		for i, certReq := range canaries {
+			// the canaries are picked up again by the next run
+			if k.stopping(ctx, report) {
+				report.Stopped = true
+				report.Skipped += len(canaries) - i + len(rest)
+				return nil
+			}
+
+			log.Printf("canary %s domain %s", certReq.ServiceName(), certReq.Domain())
+			err := k.handle(ctx, certReq, report)
+			switch {
+			case err == nil:
+			case held(err) != "" || transient(err):
+				retried = true
+			default:
+				state.Halted, state.Error = true, err.Error()
+			}
+		}
+
+		if state.Halted {
+			log.Printf("canary of %s (%d) failed, rollout halted", commonName, state.CertId)
+			report.halt(state, len(rest))
+			return k.saveRollout(ctx, state)
+		}
+		if retried {
+			log.Printf("canary of %s (%d) failed for now, retried by the next run, %d domains left", commonName, state.CertId, len(rest))
+			return nil
+		}
+
+		state.CanaryDone = time.Now()
+		if err := k.saveRollout(ctx, state); err != nil {
+			return err
+		}
+	} else {
+		// canaries deployed in an earlier run but due again, e.g. new domains
+		rest = append(canaries, rest...)
+	}
+
+	if wait := time.Until(state.CanaryDone.Add(k.Canary.Soak)); wait > 0 {
+		log.Printf("rollout of %s soaks for %s, %d domains left", commonName, wait.Round(time.Minute), len(rest))
+		return nil
+	}
+
+	for i, certReq := range rest {
+		if k.stopping(ctx, report) {
+			report.Stopped = true
+			report.Skipped += len(rest) - i
+			return nil
+		}
+
+		k.handle(ctx, certReq, report)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package keeper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
+)
+
+func TestCanaryPolicy(t *testing.T) {
+	requests := []agent.CertRequest{}
+	for i := 9; i >= 0; i-- {
+		requests = append(requests, &testCertRequest{domain: fmt.Sprintf("d%d.example.test", i)})
+	}
+
+	canaries, rest := CanaryPolicy{Domains: []string{"d5.example.test"}, Percent: 15}.canaries(requests)
+
+	domains := []string{}
+	for _, certReq := range canaries {
+		domains = append(domains, certReq.Domain())
+	}
+
+	// the listed one, then 15% of the other 9 rounded up
+	if fmt.Sprint(domains) != "[d5.example.test d0.example.test d1.example.test]" {
+		t.Errorf("unexpected canaries %v", domains)
+	}
+	if len(rest) != 7 {
+		t.Errorf("expected 7 other domains, got %d", len(rest))
+	}
+}
+
+// canaryKeeper rolls out with www.example.test as canary.
+func (c *testCloud) canaryKeeper(t *testing.T, soak time.Duration) *Keeper {
+	k, _ := c.keeper(t)
+	k.Canary = CanaryPolicy{Domains: []string{"www.example.test"}, Soak: soak}
+	return k
+}
+
+func TestCanarySoak(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	report := c.canaryKeeper(t, time.Hour).Run(ctx)
+	newId := c.CdnBinding("www.example.test")
+	if len(report.Failed) != 0 || newId == c.oldId {
+		t.Fatalf("canary is not deployed: %+v", report)
+	}
+	if id := c.LiveBinding("live.example.test"); id != c.oldId {
+		t.Errorf("live.example.test is deployed before the soak, bound to %d", id)
+	}
+
+	// the soak carries over to the next run
+	c.canaryKeeper(t, time.Hour).Run(ctx)
+	if id := c.LiveBinding("live.example.test"); id != c.oldId {
+		t.Errorf("live.example.test is deployed before the soak, bound to %d", id)
+	}
+
+	// once soaked, the rest follows
+	k := c.canaryKeeper(t, time.Hour)
+	state, err := k.loadRollout(ctx, "*.example.test", newId)
+	if err != nil || state.CanaryDone.IsZero() {
+		t.Fatalf("rollout state is not persisted: %+v, %v", state, err)
+	}
+	state.CanaryDone = time.Now().Add(-2 * time.Hour)
+	if err := k.saveRollout(ctx, state); err != nil {
+		t.Fatal(err)
+	}
+
+	k.Run(ctx)
+	if id := c.LiveBinding("live.example.test"); id != newId {
+		t.Errorf("live.example.test is bound to %d, expected %d", id, newId)
+	}
+	if id := c.OssBinding("assets", "img.example.test"); id != newId {
+		t.Errorf("img.example.test is bound to %d, expected %d", id, newId)
+	}
+}
+
+func TestCanaryHalt(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	c.Fail("SetCdnDomainSSLCertificate", tea.NewSDKError(map[string]interface{}{"code": "InvalidCertificate", "statusCode": 400}))
+	report := c.canaryKeeper(t, 0).Run(ctx)
+	if len(report.Halted) != 1 {
+		t.Fatalf("expected the rollout halted, got %+v", report)
+	}
+
+	// the halt is kept across runs and reported, even with the cause gone
+	c.Fail("SetCdnDomainSSLCertificate", nil)
+	k := c.canaryKeeper(t, 0)
+	report = k.Run(ctx)
+	if len(report.Halted) != 1 || len(report.Deployed) != 1 {
+		t.Fatalf("expected only www.shop.test deployed with the rollout halted, got %+v", report)
+	}
+	if id := c.LiveBinding("live.example.test"); id != c.oldId {
+		t.Errorf("live.example.test is deployed by a halted rollout")
+	}
+
+	resumed, err := k.ResumeRollouts(ctx, []string{"*.example.test", "*.shop.test"})
+	if err != nil || fmt.Sprint(resumed) != "[*.example.test]" {
+		t.Fatalf("unexpected resumed rollouts %v: %v", resumed, err)
+	}
+
+	report = c.canaryKeeper(t, 0).Run(ctx)
+	if len(report.Halted) != 0 || len(report.Deployed) != 3 {
+		t.Fatalf("expected the rollout resumed, got %+v", report)
+	}
+}
+
+func TestCanaryTransientFailure(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	retry.Default.SetPolicy("cdn", retry.Policy{Attempts: 1})
+	defer retry.Default.SetPolicy("cdn", retry.DefaultPolicy)
+
+	c.Fail("SetCdnDomainSSLCertificate", tea.NewSDKError(map[string]interface{}{"code": "Throttling.User", "statusCode": 400}))
+	k := c.canaryKeeper(t, 0)
+	report := k.Run(ctx)
+	if len(report.Halted) != 0 || len(report.Failed) == 0 {
+		t.Fatalf("expected the canary failed without halting, got %+v", report)
+	}
+	if id := c.LiveBinding("live.example.test"); id != c.oldId {
+		t.Errorf("live.example.test is deployed after a failed canary")
+	}
+
+	data, err := k.Storage.Read(ctx, rolloutKey("*.example.test"))
+	state := &RolloutState{}
+	if err != nil || (data != nil && json.Unmarshal(data, state) != nil) || state.Halted {
+		t.Fatalf("rollout is halted: %s, %v", data, err)
+	}
+
+	// the next run retries the canary and goes on
+	c.Fail("SetCdnDomainSSLCertificate", nil)
+	c.canaryKeeper(t, 0).Run(ctx)
+	newId := c.CdnBinding("www.example.test")
+	if newId == c.oldId {
+		t.Fatal("canary is not retried")
+	}
+	if id := c.LiveBinding("live.example.test"); id != newId {
+		t.Errorf("live.example.test is bound to %d, expected %d", id, newId)
+	}
+}
@@ -0,0 +1,359 @@
+package cert_helper
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage"
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+// AcmeAccount is the acme account kept in storage as private.key and
+// registration.json.
+type AcmeAccount struct {
+	storage    storage.StorageService
+	caDirURL   string
+	user       *AcmeUser
+	client     *lego.Client
+	httpClient *http.Client
+}
+
+func LoadAcmeAccount(ctx context.Context, storage storage.StorageService, email string, caDirURL string) (*AcmeAccount, error) {
+	// PrivateKey
+	privateKey, err := ensurePrivateKey(ctx, storage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %v", err)
+	}
+
+	// User
+	u := &AcmeUser{Email: email, privateKey: privateKey}
+	config := lego.NewConfig(u)
+	config.CADirURL = caDirURL
+	config.Certificate.KeyType = certcrypto.RSA2048
+
+	// Registration
+	u.Registration, err = ensureRegistration(ctx, storage, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load registration: %v", err)
+	}
+
+	// Client
+	client, err := lego.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lego client: %v", err)
+	}
+
+	return &AcmeAccount{
+		storage:    storage,
+		caDirURL:   caDirURL,
+		user:       u,
+		client:     client,
+		httpClient: config.HTTPClient,
+	}, nil
+}
+
+func (a *AcmeAccount) Registration() *registration.Resource {
+	return a.user.Registration
+}
+
+func (a *AcmeAccount) saveRegistration(ctx context.Context, reg *registration.Resource) error {
+	regBytes, err := json.Marshal(reg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration: %v", err)
+	}
+
+	if err := a.storage.Write(ctx, "registration.json", regBytes); err != nil {
+		return fmt.Errorf("failed to save registration to storage: %v", err)
+	}
+
+	a.user.Registration = reg
+	return nil
+}
+
+func savePrivateKey(ctx context.Context, storage storage.StorageService, key string, privateKey *ecdsa.PrivateKey) error {
+	privateKeyBytes, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal EC private key: %v", err)
+	}
+
+	privateKeyPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	})
+
+	if err := storage.Write(ctx, key, privateKeyPem); err != nil {
+		return fmt.Errorf("failed to save private key to storage: %v", err)
+	}
+
+	return nil
+}
+
+// Refresh fetches the registration from the acme server.
+func (a *AcmeAccount) Refresh(ctx context.Context) (*registration.Resource, error) {
+	reg, err := a.client.Registration.QueryRegistration()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query registration: %v", err)
+	}
+
+	if err := a.saveRegistration(ctx, reg); err != nil {
+		return nil, err
+	}
+
+	return reg, nil
+}
+
+func (a *AcmeAccount) directory(ctx context.Context) (*acme.Directory, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.caDirURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get acme directory: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var dir acme.Directory
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+		return nil, fmt.Errorf("failed to decode acme directory: %v", err)
+	}
+
+	return &dir, nil
+}
+
+func (a *AcmeAccount) nonce(ctx context.Context, dir *acme.Directory) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dir.NewNonceURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get nonce: %v", err)
+	}
+	resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("server did not respond with a nonce")
+	}
+
+	return nonce, nil
+}
+
+// post sends a JWS signed by the current account key, for the account
+// operations lego doesn't implement.
+func (a *AcmeAccount) post(ctx context.Context, dir *acme.Directory, url string, payload []byte, result interface{}) error {
+	nonce, err := a.nonce(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{
+			Algorithm: jose.ES256,
+			Key:       jose.JSONWebKey{Key: a.user.privateKey, KeyID: a.user.Registration.URI},
+		},
+		(&jose.SignerOptions{}).WithHeader("url", url).WithHeader("nonce", nonce),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create jose signer: %v", err)
+	}
+
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(signed.FullSerialize()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var problem acme.ProblemDetails
+		if json.Unmarshal(body, &problem) == nil && problem.Detail != "" {
+			return &problem
+		}
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	if result != nil && len(body) > 0 {
+		return json.Unmarshal(body, result)
+	}
+
+	return nil
+}
+
+// UpdateContacts replaces the contact emails of the account.
+func (a *AcmeAccount) UpdateContacts(ctx context.Context, emails []string) (*registration.Resource, error) {
+	contacts := make([]string, 0, len(emails))
+	for _, email := range emails {
+		contacts = append(contacts, "mailto:"+email)
+	}
+
+	payload, err := json.Marshal(struct {
+		Contact []string `json:"contact"`
+	}{contacts})
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := a.directory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var account acme.Account
+	if err := a.post(ctx, dir, a.user.Registration.URI, payload, &account); err != nil {
+		return nil, fmt.Errorf("failed to update contacts: %v", err)
+	}
+
+	reg := &registration.Resource{Body: account, URI: a.user.Registration.URI}
+	if err := a.saveRegistration(ctx, reg); err != nil {
+		return nil, err
+	}
+
+	return reg, nil
+}
+
+// RotateKey replaces the account key with a new one (RFC 8555 7.3.5). The new
+// key is saved as private.key.next before the request, so it is not lost if
+// saving it as private.key fails, and deleted once it is.
+func (a *AcmeAccount) RotateKey(ctx context.Context) error {
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate EC private key: %v", err)
+	}
+
+	if err := savePrivateKey(ctx, a.storage, "private.key.next", newKey); err != nil {
+		return err
+	}
+
+	dir, err := a.directory(ctx)
+	if err != nil {
+		return err
+	}
+	if dir.KeyChangeURL == "" {
+		return fmt.Errorf("acme server does not support key change")
+	}
+
+	innerSigner, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: newKey},
+		(&jose.SignerOptions{EmbedJWK: true}).WithHeader("url", dir.KeyChangeURL),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create jose signer: %v", err)
+	}
+
+	innerPayload, err := json.Marshal(struct {
+		Account string          `json:"account"`
+		OldKey  jose.JSONWebKey `json:"oldKey"`
+	}{a.user.Registration.URI, jose.JSONWebKey{Key: a.user.privateKey.Public()}})
+	if err != nil {
+		return err
+	}
+
+	inner, err := innerSigner.Sign(innerPayload)
+	if err != nil {
+		return fmt.Errorf("failed to sign key change: %v", err)
+	}
+
+	if err := a.post(ctx, dir, dir.KeyChangeURL, []byte(inner.FullSerialize()), nil); err != nil {
+		return fmt.Errorf("failed to change account key: %v", err)
+	}
+
+	if err := savePrivateKey(ctx, a.storage, "private.key", newKey); err != nil {
+		return err
+	}
+	a.user.privateKey = newKey
+
+	if err := a.storage.Delete(ctx, "private.key.next"); err != nil {
+		log.Printf("delete private.key.next failed: %v", err)
+	}
+
+	return nil
+}
+
+// Deactivate deactivates the account on the acme server, a new account has to
+// be registered before issuing certificates again.
+func (a *AcmeAccount) Deactivate(ctx context.Context) error {
+	if err := a.client.Registration.DeleteRegistration(); err != nil {
+		return fmt.Errorf("failed to deactivate account: %v", err)
+	}
+
+	reg := *a.user.Registration
+	reg.Body.Status = acme.StatusDeactivated
+	return a.saveRegistration(ctx, &reg)
+}
+
+// Register registers the account again, e.g. after changing the acme
+// directory or deactivating the account, optionally with a new key.
+func (a *AcmeAccount) Register(ctx context.Context, newKey bool) (*registration.Resource, error) {
+	if newKey {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate EC private key: %v", err)
+		}
+
+		if err := savePrivateKey(ctx, a.storage, "private.key."+time.Now().Format("20060102150405"), a.user.privateKey); err != nil {
+			return nil, err
+		}
+		if err := savePrivateKey(ctx, a.storage, "private.key", privateKey); err != nil {
+			return nil, err
+		}
+
+		a.user.privateKey = privateKey
+	}
+
+	u := &AcmeUser{Email: a.user.Email, privateKey: a.user.privateKey}
+	config := lego.NewConfig(u)
+	config.CADirURL = a.caDirURL
+
+	client, err := lego.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lego client: %v", err)
+	}
+
+	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register: %v", err)
+	}
+
+	if err := a.saveRegistration(ctx, reg); err != nil {
+		return nil, err
+	}
+
+	u.Registration = reg
+	a.user, a.client = u, client
+	return reg, nil
+}
@@ -0,0 +1,259 @@
+package cert_helper
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/certcrypto"
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+// acmeStub is an acme server checking the JWS of every request against the
+// account key it knows.
+type acmeStub struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu       sync.Mutex
+	nonces   map[string]bool
+	issued   int
+	key      *jose.JSONWebKey
+	account  acme.Account
+	accounts int
+}
+
+func newAcmeStub(t *testing.T) *acmeStub {
+	s := &acmeStub{t: t, nonces: map[string]bool{}}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *acmeStub) url(path string) string {
+	return s.server.URL + path
+}
+
+func (s *acmeStub) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.issued++
+	nonce := fmt.Sprintf("nonce-%d", s.issued)
+	s.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+
+	switch r.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(acme.Directory{
+			NewNonceURL:   s.url("/new-nonce"),
+			NewAccountURL: s.url("/new-account"),
+			NewOrderURL:   s.url("/new-order"),
+			KeyChangeURL:  s.url("/key-change"),
+		})
+	case "/new-nonce":
+		w.WriteHeader(http.StatusOK)
+	case "/new-account":
+		header, payload := s.verify(r, false)
+		if header == nil {
+			break
+		}
+		s.key = header.JSONWebKey
+		s.accounts++
+		json.Unmarshal(payload, &s.account)
+		s.account.Status = acme.StatusValid
+
+		w.Header().Set("Location", s.url("/account/1"))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s.account)
+	case "/account/1":
+		_, payload := s.verify(r, true)
+		var update acme.Account
+		json.Unmarshal(payload, &update)
+		if update.Contact != nil {
+			s.account.Contact = update.Contact
+		}
+		if update.Status != "" {
+			s.account.Status = update.Status
+		}
+		json.NewEncoder(w).Encode(s.account)
+	case "/key-change":
+		_, payload := s.verify(r, true)
+		s.keyChange(string(payload))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// verify checks the protected headers and the signature of the JWS, by the
+// account key if kid is set, else by the embedded key.
+func (s *acmeStub) verify(r *http.Request, kid bool) (*jose.Header, []byte) {
+	body, _ := io.ReadAll(r.Body)
+	jws, err := jose.ParseSigned(string(body), []jose.SignatureAlgorithm{jose.ES256, jose.RS256})
+	if err != nil {
+		s.t.Errorf("%s: invalid jws: %v", r.URL.Path, err)
+		return nil, nil
+	}
+
+	header := jws.Signatures[0].Protected
+	if url, _ := header.ExtraHeaders["url"].(string); url != s.url(r.URL.Path) {
+		s.t.Errorf("%s: signed for url %q", r.URL.Path, url)
+	}
+	if !s.nonces[header.Nonce] {
+		s.t.Errorf("%s: unknown nonce %q", r.URL.Path, header.Nonce)
+	}
+	delete(s.nonces, header.Nonce)
+
+	key := header.JSONWebKey
+	if kid {
+		if header.KeyID != s.url("/account/1") || header.JSONWebKey != nil {
+			s.t.Errorf("%s: expected the account kid only, got kid %q", r.URL.Path, header.KeyID)
+		}
+		key = s.key
+	} else if key == nil {
+		s.t.Errorf("%s: no jwk embedded", r.URL.Path)
+		return nil, nil
+	}
+
+	payload, err := jws.Verify(key)
+	if err != nil {
+		s.t.Errorf("%s: signature does not verify: %v", r.URL.Path, err)
+		return nil, nil
+	}
+
+	return &header, payload
+}
+
+// keyChange checks the inner JWS of a key change, signed by the new key, and
+// switches the account to it.
+func (s *acmeStub) keyChange(inner string) {
+	jws, err := jose.ParseSigned(inner, []jose.SignatureAlgorithm{jose.ES256})
+	if err != nil {
+		s.t.Errorf("invalid inner jws: %v", err)
+		return
+	}
+
+	header := jws.Signatures[0].Protected
+	if url, _ := header.ExtraHeaders["url"].(string); url != s.url("/key-change") {
+		s.t.Errorf("inner jws signed for url %q", url)
+	}
+	if header.Nonce != "" || header.KeyID != "" || header.JSONWebKey == nil {
+		s.t.Errorf("inner jws needs the new jwk only, got nonce %q kid %q", header.Nonce, header.KeyID)
+		return
+	}
+
+	payload, err := jws.Verify(header.JSONWebKey)
+	if err != nil {
+		s.t.Errorf("inner signature does not verify: %v", err)
+		return
+	}
+
+	var change struct {
+		Account string          `json:"account"`
+		OldKey  jose.JSONWebKey `json:"oldKey"`
+	}
+	if err := json.Unmarshal(payload, &change); err != nil {
+		s.t.Errorf("invalid key change: %v", err)
+		return
+	}
+	if change.Account != s.url("/account/1") {
+		s.t.Errorf("key change of account %q", change.Account)
+	}
+	if !sameKey(&change.OldKey, s.key) {
+		s.t.Error("key change names another old key")
+	}
+
+	s.key = header.JSONWebKey
+}
+
+func sameKey(a, b *jose.JSONWebKey) bool {
+	x, errA := a.Thumbprint(crypto.SHA256)
+	y, errB := b.Thumbprint(crypto.SHA256)
+	return errA == nil && errB == nil && string(x) == string(y)
+}
+
+// storedKey returns the jwk of the key stored as name.
+func storedKey(t *testing.T, storage memoryStorage, name string) *jose.JSONWebKey {
+	key, err := certcrypto.ParsePEMPrivateKey(storage[name])
+	if err != nil {
+		t.Fatalf("invalid %s: %v", name, err)
+	}
+	return &jose.JSONWebKey{Key: key.(crypto.Signer).Public()}
+}
+
+func TestAcmeAccount(t *testing.T) {
+	ctx := context.Background()
+	stub := newAcmeStub(t)
+	storage := memoryStorage{}
+
+	account, err := LoadAcmeAccount(ctx, storage, "old@example.test", stub.url("/directory"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameKey(stub.key, storedKey(t, storage, "private.key")) {
+		t.Fatal("account registered with another key than the stored one")
+	}
+
+	reg, err := account.UpdateContacts(ctx, []string{"new@example.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reg.Body.Contact) != 1 || reg.Body.Contact[0] != "mailto:new@example.test" {
+		t.Errorf("unexpected contacts %v", reg.Body.Contact)
+	}
+	if !strings.Contains(string(storage["registration.json"]), "mailto:new@example.test") {
+		t.Error("updated registration is not stored")
+	}
+
+	oldKey := stub.key
+	if err := account.RotateKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sameKey(stub.key, oldKey) || !sameKey(stub.key, storedKey(t, storage, "private.key")) {
+		t.Error("stored key is not the rotated one")
+	}
+	if _, ok := storage["private.key.next"]; ok {
+		t.Error("private.key.next is left after the rotation")
+	}
+
+	// signed by the rotated key
+	if _, err := account.UpdateContacts(ctx, []string{"new@example.test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	account, err = LoadAcmeAccount(ctx, storage, "new@example.test", stub.url("/directory"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := account.Deactivate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stub.account.Status != acme.StatusDeactivated || account.Registration().Body.Status != acme.StatusDeactivated {
+		t.Errorf("account is %s after deactivating", stub.account.Status)
+	}
+
+	previous := storage["private.key"]
+	if _, err := account.Register(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if stub.accounts != 2 || !sameKey(stub.key, storedKey(t, storage, "private.key")) {
+		t.Error("account is not registered again with the new stored key")
+	}
+	kept := false
+	for key, data := range storage {
+		if strings.HasPrefix(key, "private.key.") && string(data) == string(previous) {
+			kept = true
+		}
+	}
+	if !kept {
+		t.Error("previous key is not kept")
+	}
+}
@@ -0,0 +1,232 @@
+package cert_helper
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	cas "github.com/alibabacloud-go/cas-20200407/v2/client"
+	util "github.com/alibabacloud-go/tea-utils/v2/service"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
+)
+
+const casPageSize = 50
+
+// CasCertificate is the parsed detail of a certificate in cas.
+type CasCertificate struct {
+	Id          int64
+	Name        string
+	CommonName  string
+	Sans        []string
+	Issuer      string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	Purchased   bool
+	Status      string
+	Fingerprint string
+}
+
+func casOrderCertificate(order *cas.ListUserCertificateOrderResponseBodyCertificateOrderList, purchased bool) *CasCertificate {
+	cert := &CasCertificate{
+		Id:          tea.Int64Value(order.CertificateId),
+		Name:        tea.StringValue(order.Name),
+		CommonName:  tea.StringValue(order.CommonName),
+		Issuer:      tea.StringValue(order.Issuer),
+		Purchased:   purchased,
+		Status:      tea.StringValue(order.Status),
+		Fingerprint: tea.StringValue(order.Fingerprint),
+	}
+
+	sans := tea.StringValue(order.Sans)
+	if sans == "" {
+		sans = tea.StringValue(order.Domain)
+	}
+	for _, san := range strings.Split(sans, ",") {
+		if san = strings.TrimSpace(san); san != "" {
+			cert.Sans = append(cert.Sans, san)
+		}
+	}
+
+	if startTime := tea.Int64Value(order.CertStartTime); startTime > 0 {
+		cert.NotBefore = time.UnixMilli(startTime)
+	} else {
+		cert.NotBefore, _ = time.Parse("2006-01-02", tea.StringValue(order.StartDate))
+	}
+
+	if endTime := tea.Int64Value(order.CertEndTime); endTime > 0 {
+		cert.NotAfter = time.UnixMilli(endTime)
+	} else {
+		cert.NotAfter, _ = time.Parse("2006-01-02", tea.StringValue(order.EndDate))
+	}
+
+	return cert
+}
+
+// listOrders reads every page of the orders the request lists.
+func listOrders(ctx context.Context, client CasClient, request cas.ListUserCertificateOrderRequest) ([]*cas.ListUserCertificateOrderResponseBodyCertificateOrderList, error) {
+	orders := []*cas.ListUserCertificateOrderResponseBodyCertificateOrderList{}
+
+	for page := int64(1); ; page++ {
+		request.CurrentPage = tea.Int64(page)
+		request.ShowSize = tea.Int64(casPageSize)
+
+		resp, err := retry.Call(ctx, retry.Default, "cas", "ListUserCertificateOrder", func() (*cas.ListUserCertificateOrderResponse, error) {
+			return client.ListUserCertificateOrderWithOptions(&request, &util.RuntimeOptions{})
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, resp.Body.CertificateOrderList...)
+
+		if len(resp.Body.CertificateOrderList) < casPageSize ||
+			page*casPageSize >= tea.Int64Value(resp.Body.TotalCount) {
+			return orders, nil
+		}
+	}
+}
+
+func (m *CertManager) listCasOrders(ctx context.Context, orderType string) ([]*CasCertificate, error) {
+	orders, err := listOrders(ctx, m.cas, cas.ListUserCertificateOrderRequest{OrderType: tea.String(orderType)})
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*CasCertificate{}
+	for _, certOrder := range orders {
+		// orders not issued yet have no certificate
+		if tea.Int64Value(certOrder.CertificateId) == 0 {
+			continue
+		}
+		certs = append(certs, casOrderCertificate(certOrder, orderType == "BUY"))
+	}
+
+	return certs, nil
+}
+
+// CasInventory lists every purchased and uploaded certificate in cas, all
+// pages are read once and cached for the lifetime of the manager.
+func (m *CertManager) CasInventory(ctx context.Context) ([]*CasCertificate, error) {
+	if m.casCerts != nil {
+		return m.casCerts, nil
+	}
+
+	certs := []*CasCertificate{}
+	for _, orderType := range []string{"BUY", "UPLOAD"} {
+		orderCerts, err := m.listCasOrders(ctx, orderType)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, orderCerts...)
+	}
+
+	for _, cert := range certs {
+		m.casDetails[cert.Id] = cert
+	}
+	m.casCerts = certs
+
+	log.Printf("cas inventory: %d certificates", len(certs))
+	return certs, nil
+}
+
+// findUploadedCertificate looks up the cas id of an uploaded certificate by
+// name, past the cached inventory. 0 if it is not found.
+func (m *CertManager) findUploadedCertificate(ctx context.Context, cert *Certificate) int64 {
+	resp, err := retry.Call(ctx, retry.Default, "cas", "ListUserCertificateOrder", func() (*cas.ListUserCertificateOrderResponse, error) {
+		return m.cas.ListUserCertificateOrder(&cas.ListUserCertificateOrderRequest{
+			OrderType: tea.String("UPLOAD"),
+			Keyword:   tea.String(cert.CommonName),
+			ShowSize:  tea.Int64(casPageSize),
+		})
+	})
+	if err != nil {
+		log.Printf("list uploaded certificates of %s failed: %v", cert.CommonName, err)
+		return 0
+	}
+
+	for _, certOrder := range resp.Body.CertificateOrderList {
+		if tea.StringValue(certOrder.Name) == cert.CasName() {
+			return tea.Int64Value(certOrder.CertificateId)
+		}
+	}
+
+	return 0
+}
+
+func (m *CertManager) addToCasInventory(cert *Certificate) {
+	if m.casCerts == nil {
+		return
+	}
+
+	x509Cert := cert.X509Certificate()
+	if x509Cert == nil {
+		return
+	}
+
+	detail := &CasCertificate{
+		Id:         cert.CasCertificateId,
+		Name:       cert.CasName(),
+		CommonName: x509Cert.Subject.CommonName,
+		Sans:       x509Cert.DNSNames,
+		Issuer:     x509Cert.Issuer.CommonName,
+		NotBefore:  x509Cert.NotBefore,
+		NotAfter:   x509Cert.NotAfter,
+		Status:     "ISSUED",
+	}
+
+	m.casDetails[detail.Id] = detail
+	m.casCerts = append(m.casCerts, detail)
+}
+
+func (m *CertManager) removeFromCasInventory(certId int64) {
+	delete(m.casDetails, certId)
+
+	for i, cert := range m.casCerts {
+		if cert.Id == certId {
+			m.casCerts = append(m.casCerts[:i:i], m.casCerts[i+1:]...)
+			return
+		}
+	}
+}
+
+// DescribeCasCertificate returns the detail of a cas certificate, from the
+// inventory when it is there.
+func (m *CertManager) DescribeCasCertificate(ctx context.Context, certId int64) (*CasCertificate, error) {
+	if detail, ok := m.casDetails[certId]; ok {
+		return detail, nil
+	}
+
+	if _, err := m.CasInventory(ctx); err != nil {
+		log.Printf("load cas inventory failed: %v", err)
+	} else if detail, ok := m.casDetails[certId]; ok {
+		return detail, nil
+	}
+
+	resp, err := retry.Call(ctx, retry.Default, "cas", "GetUserCertificateDetail", func() (*cas.GetUserCertificateDetailResponse, error) {
+		return m.cas.GetUserCertificateDetail(&cas.GetUserCertificateDetailRequest{
+			CertId:     tea.Int64(certId),
+			CertFilter: tea.Bool(true),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body := resp.Body
+	detail := &CasCertificate{
+		Id:          certId,
+		Name:        tea.StringValue(body.Name),
+		CommonName:  tea.StringValue(body.Common),
+		Issuer:      tea.StringValue(body.Issuer),
+		Fingerprint: tea.StringValue(body.Fingerprint),
+	}
+	if sans := tea.StringValue(body.Sans); sans != "" {
+		detail.Sans = strings.Split(sans, ",")
+	}
+	detail.NotAfter, _ = time.Parse("2006-01-02", tea.StringValue(body.EndDate))
+
+	m.casDetails[certId] = detail
+	return detail, nil
+}
@@ -0,0 +1,377 @@
+package cert_helper
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	cas "github.com/alibabacloud-go/cas-20200407/v2/client"
+	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/alidns"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
+	"github.com/geektheripper/alicdn-ssl-keeper/utils"
+)
+
+// CasIssuerConfig holds the applicant info of CAS certificate orders.
+type CasIssuerConfig struct {
+	ProductCode  string        `mapstructure:"product-code"`
+	Username     string        `mapstructure:"username"`
+	Phone        string        `mapstructure:"phone"`
+	Email        string        `mapstructure:"email"`
+	PollInterval time.Duration `mapstructure:"poll-interval"`
+	Timeout      time.Duration `mapstructure:"timeout"`
+}
+
+// CasIssuer orders free DV certificates from Aliyun CAS, validated by a DNS
+// record in Alidns. The certificate is issued into CAS, so it is never
+// uploaded again. Free DV certificates can't be wildcards.
+type CasIssuer struct {
+	config CasIssuerConfig
+	cas    CasClient
+	alidns DnsClient
+}
+
+func NewCasIssuer(aliConfig *aliapi.Config, config CasIssuerConfig) (*CasIssuer, error) {
+	casConfig := *aliConfig
+	casConfig.Endpoint = tea.String("cas.aliyuncs.com")
+	casClient, err := cas.NewClient(&casConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cas client: %v", err)
+	}
+
+	alidnsClient, err := alidns.NewClientWithAccessKey(*aliConfig.RegionId, *aliConfig.AccessKeyId, *aliConfig.AccessKeySecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create alidns client: %v", err)
+	}
+	if timeout := utils.CallTimeout(aliConfig); timeout > 0 {
+		alidnsClient.SetReadTimeout(timeout)
+	}
+
+	return NewCasIssuerWithClients(casClient, alidnsClient, config), nil
+}
+
+func NewCasIssuerWithClients(casClient CasClient, dnsClient DnsClient, config CasIssuerConfig) *CasIssuer {
+	if config.PollInterval == 0 {
+		config.PollInterval = 10 * time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 30 * time.Minute
+	}
+
+	return &CasIssuer{config: config, cas: casClient, alidns: dnsClient}
+}
+
+func (i *CasIssuer) Name() string {
+	return "cas"
+}
+
+func createCSR(commonName string, privateKey crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: []string{commonName},
+	}, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create csr: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// splitChain returns the first certificate of a PEM bundle and the rest of it.
+func splitChain(bundle []byte) ([]byte, []byte) {
+	block, rest := pem.Decode(bundle)
+	if block == nil {
+		return bundle, nil
+	}
+
+	return pem.EncodeToMemory(block), bytes.TrimLeft(rest, "\r\n")
+}
+
+func (i *CasIssuer) addValidationRecord(ctx context.Context, recordDomain, recordType, recordValue string) (string, error) {
+	mainReq := alidns.CreateGetMainDomainNameRequest()
+	mainReq.Scheme = "https"
+	mainReq.InputString = recordDomain
+
+	mainResp, err := retry.Call(ctx, retry.Default, "dns", "GetMainDomainName", func() (*alidns.GetMainDomainNameResponse, error) {
+		return i.alidns.GetMainDomainName(mainReq)
+	})
+	if err != nil {
+		return "", fmt.Errorf("get main domain of %s failed: %v", recordDomain, err)
+	}
+
+	addReq := alidns.CreateAddDomainRecordRequest()
+	addReq.Scheme = "https"
+	addReq.DomainName = mainResp.DomainName
+	addReq.RR = mainResp.RR
+	addReq.Type = recordType
+	addReq.Value = recordValue
+
+	addResp, err := retry.CallCreate(ctx, retry.Default, "dns", "AddDomainRecord", func() (*alidns.AddDomainRecordResponse, error) {
+		return i.alidns.AddDomainRecord(addReq)
+	})
+	if err != nil {
+		// the record may have been added before the call failed
+		recordId := ""
+		if retry.Retryable(err) {
+			recordId = i.findValidationRecord(ctx, addReq)
+		}
+		if recordId == "" {
+			return "", fmt.Errorf("add validation record %s failed: %v", recordDomain, err)
+		}
+
+		log.Printf("add validation record %s failed, but it exists as %s: %v", recordDomain, recordId, err)
+		return recordId, nil
+	}
+
+	return addResp.RecordId, nil
+}
+
+// findValidationRecord returns the id of the record the request adds, "" if
+// it does not exist.
+func (i *CasIssuer) findValidationRecord(ctx context.Context, addReq *alidns.AddDomainRecordRequest) string {
+	req := alidns.CreateDescribeDomainRecordsRequest()
+	req.Scheme = "https"
+	req.DomainName = addReq.DomainName
+	req.RRKeyWord = addReq.RR
+	req.TypeKeyWord = addReq.Type
+	req.ValueKeyWord = addReq.Value
+
+	resp, err := retry.Call(ctx, retry.Default, "dns", "DescribeDomainRecords", func() (*alidns.DescribeDomainRecordsResponse, error) {
+		return i.alidns.DescribeDomainRecords(req)
+	})
+	if err != nil {
+		log.Printf("describe records of %s failed: %v", addReq.DomainName, err)
+		return ""
+	}
+
+	for _, record := range resp.DomainRecords.Record {
+		if record.RR == addReq.RR && record.Type == addReq.Type && record.Value == addReq.Value {
+			return record.RecordId
+		}
+	}
+
+	return ""
+}
+
+func (i *CasIssuer) deleteValidationRecord(ctx context.Context, recordId string) {
+	req := alidns.CreateDeleteDomainRecordRequest()
+	req.Scheme = "https"
+	req.RecordId = recordId
+
+	err := retry.Default.Do(ctx, "dns", "DeleteDomainRecord", func() error {
+		_, err := i.alidns.DeleteDomainRecord(req)
+		return err
+	})
+	if err != nil {
+		log.Printf("delete validation record %s failed: %v", recordId, err)
+	}
+}
+
+func (i *CasIssuer) findCertificateId(ctx context.Context, orderId int64, domain string) (int64, string, error) {
+	for _, orderType := range []string{"CPACK", "BUY"} {
+		orders, err := listOrders(ctx, i.cas, cas.ListUserCertificateOrderRequest{
+			OrderType: tea.String(orderType),
+			Keyword:   tea.String(domain),
+			Status:    tea.String("ISSUED"),
+		})
+		if err != nil {
+			return 0, "", err
+		}
+
+		for _, certOrder := range orders {
+			if tea.Int64Value(certOrder.OrderId) == orderId && tea.Int64Value(certOrder.CertificateId) != 0 {
+				return *certOrder.CertificateId, tea.StringValue(certOrder.Name), nil
+			}
+		}
+	}
+
+	return 0, "", fmt.Errorf("issued certificate of order %d not found", orderId)
+}
+
+// pendingOrders lists the ids of the package orders of the domain not issued
+// yet.
+func (i *CasIssuer) pendingOrders(ctx context.Context, domain string) (map[int64]bool, error) {
+	pending, err := listOrders(ctx, i.cas, cas.ListUserCertificateOrderRequest{
+		OrderType: tea.String("CPACK"),
+		Keyword:   tea.String(domain),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	orders := map[int64]bool{}
+	for _, certOrder := range pending {
+		if tea.Int64Value(certOrder.CertificateId) == 0 && tea.StringValue(certOrder.Domain) == domain {
+			orders[tea.Int64Value(certOrder.OrderId)] = true
+		}
+	}
+
+	return orders, nil
+}
+
+// createdOrder finds the order a failed create placed anyway, the pending
+// order of the domain that was not there before. 0 if there is none.
+func (i *CasIssuer) createdOrder(ctx context.Context, domain string, before map[int64]bool) int64 {
+	after, err := i.pendingOrders(ctx, domain)
+	if err != nil {
+		log.Printf("list cas certificate orders of %s failed: %v", domain, err)
+		return 0
+	}
+
+	created := int64(0)
+	for orderId := range after {
+		if !before[orderId] {
+			if created != 0 {
+				return 0
+			}
+			created = orderId
+		}
+	}
+
+	return created
+}
+
+func (i *CasIssuer) Obtain(ctx context.Context, names []string, privateKey crypto.PrivateKey) (*Certificate, error) {
+	if len(names) != 1 {
+		return nil, errors.New("cas issuer only supports single domain certificates")
+	}
+
+	domain := names[0]
+	request := &cas.CreateCertificateForPackageRequestRequest{
+		Domain:       tea.String(domain),
+		ValidateType: tea.String("DNS"),
+	}
+	if i.config.ProductCode != "" {
+		request.ProductCode = tea.String(i.config.ProductCode)
+	}
+	if i.config.Username != "" {
+		request.Username = tea.String(i.config.Username)
+	}
+	if i.config.Phone != "" {
+		request.Phone = tea.String(i.config.Phone)
+	}
+	if i.config.Email != "" {
+		request.Email = tea.String(i.config.Email)
+	}
+
+	if privateKey != nil {
+		csr, err := createCSR(domain, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		request.Csr = tea.String(string(csr))
+	}
+
+	// the pending orders tell apart the one a failed create placed anyway
+	pending, err := i.pendingOrders(ctx, domain)
+	if err != nil {
+		return nil, fmt.Errorf("list cas certificate orders of %s failed: %v", domain, err)
+	}
+
+	var orderId int64
+	orderResp, err := retry.CallCreate(ctx, retry.Default, "cas", "CreateCertificateForPackageRequest", func() (*cas.CreateCertificateForPackageRequestResponse, error) {
+		return i.cas.CreateCertificateForPackageRequest(request)
+	})
+	if err != nil {
+		if retry.Retryable(err) {
+			orderId = i.createdOrder(ctx, domain, pending)
+		}
+		if orderId == 0 {
+			return nil, fmt.Errorf("create cas certificate order for %s failed: %v", domain, err)
+		}
+		log.Printf("create cas certificate order for %s failed, but it was placed: %v", domain, err)
+	} else {
+		orderId = *orderResp.Body.OrderId
+	}
+	log.Printf("cas certificate order %d created for %s", orderId, domain)
+
+	recordId := ""
+	defer func() {
+		if recordId != "" {
+			// the record is removed even when the context is done
+			i.deleteValidationRecord(context.WithoutCancel(ctx), recordId)
+		}
+	}()
+
+	deadline := time.Now().Add(i.config.Timeout)
+	for {
+		stateResp, err := retry.Call(ctx, retry.Default, "cas", "DescribeCertificateState", func() (*cas.DescribeCertificateStateResponse, error) {
+			return i.cas.DescribeCertificateState(&cas.DescribeCertificateStateRequest{OrderId: tea.Int64(orderId)})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("describe cas certificate order %d failed: %v", orderId, err)
+		}
+
+		state := stateResp.Body
+		switch tea.StringValue(state.Type) {
+		case "domain_verify":
+			if recordId == "" && tea.StringValue(state.ValidateType) == "DNS" {
+				recordId, err = i.addValidationRecord(ctx, *state.RecordDomain, *state.RecordType, *state.RecordValue)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case "certificate":
+			certId, casName, err := i.findCertificateId(ctx, orderId, domain)
+			if err != nil {
+				return nil, err
+			}
+
+			cert := &Certificate{
+				CommonName:       domain,
+				CasCertificateId: certId,
+				casName:          casName,
+				Updated:          true,
+			}
+			cert.Certificate, cert.IssuerCertificate = splitChain([]byte(tea.StringValue(state.Certificate)))
+
+			if privateKey != nil {
+				if cert.PrivateKey, err = encodePrivateKey(privateKey); err != nil {
+					return nil, err
+				}
+			} else {
+				cert.PrivateKey = []byte(tea.StringValue(state.PrivateKey))
+			}
+
+			return cert, nil
+		case "verify_fail":
+			return nil, fmt.Errorf("cas certificate order %d for %s failed validation", orderId, domain)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("cas certificate order %d for %s not issued in %s", orderId, domain, i.config.Timeout)
+		}
+
+		select {
+		case <-time.After(i.config.PollInterval):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("cas certificate order %d for %s not issued yet: %v", orderId, domain, ctx.Err())
+		}
+	}
+}
+
+func (i *CasIssuer) Renew(ctx context.Context, cert *Certificate) (*Certificate, error) {
+	var privateKey crypto.PrivateKey
+	if cert.PrivateKey != nil {
+		key, err := utils.ParsePrivateKey(cert.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = key
+	}
+
+	return i.Obtain(ctx, []string{cert.CommonName}, privateKey)
+}
+
+func (i *CasIssuer) Revoke(ctx context.Context, cert *Certificate, reason uint) error {
+	return errors.New("revoking cas issued certificates is not supported, revoke it in the cas console")
+}
@@ -0,0 +1,148 @@
+package cert_helper
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alibabacloud-go/tea/tea"
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/fake_cloud"
+	"github.com/geektheripper/alicdn-ssl-keeper/utils"
+)
+
+var errUnavailable = tea.NewSDKError(map[string]interface{}{"code": "ServiceUnavailable", "statusCode": 503})
+
+func TestCasIssuerObtain(t *testing.T) {
+	cloud := fake_cloud.New()
+	issuer := NewCasIssuerWithClients(cloud.Cas(), cloud.Dns(), CasIssuerConfig{PollInterval: time.Millisecond, Timeout: time.Second})
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := issuer.Obtain(context.Background(), []string{"www.example.test"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert.CasCertificateId == 0 || cloud.Certificate(cert.CasCertificateId) == nil {
+		t.Errorf("issued certificate %d is not in cas", cert.CasCertificateId)
+	}
+	if x509Cert := cert.X509Certificate(); x509Cert == nil || x509Cert.Subject.CommonName != "www.example.test" {
+		t.Errorf("unexpected certificate %v", x509Cert)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(cloud.CACertificate())
+	if err := validateMaterial(cert, "www.example.test", roots, time.Now()); err != nil {
+		t.Errorf("issued certificate is invalid: %v", err)
+	}
+
+	// the validation record is removed once the certificate is issued
+	if _, ok := cloud.Record("_dnsauth.www.example.test", "TXT"); ok {
+		t.Errorf("validation record is left behind")
+	}
+	if calls := cloud.Calls("AddDomainRecord"); calls != 1 {
+		t.Errorf("expected 1 validation record, got %d", calls)
+	}
+}
+
+func TestCasIssuerCreatesTakingEffect(t *testing.T) {
+	cloud := fake_cloud.New()
+	issuer := NewCasIssuerWithClients(cloud.Cas(), cloud.Dns(), CasIssuerConfig{PollInterval: time.Millisecond, Timeout: time.Second})
+
+	// both creates fail on their way back, after taking effect
+	cloud.FailAfter("CreateCertificateForPackageRequest", errUnavailable)
+	cloud.FailAfter("AddDomainRecord", sdkerrors.NewServerError(503, `{"Code":"ServiceUnavailable"}`, ""))
+
+	cert, err := issuer.Obtain(context.Background(), []string{"www.example.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.CasCertificateId == 0 {
+		t.Error("certificate of the placed order was not found")
+	}
+
+	if calls := cloud.Calls("CreateCertificateForPackageRequest"); calls != 1 {
+		t.Errorf("expected 1 order, got %d", calls)
+	}
+	if calls := cloud.Calls("AddDomainRecord"); calls != 1 {
+		t.Errorf("expected 1 validation record, got %d", calls)
+	}
+	if _, ok := cloud.Record("_dnsauth.www.example.test", "TXT"); ok {
+		t.Errorf("validation record is left behind")
+	}
+}
+
+func TestCasIssuerFailures(t *testing.T) {
+	cloud := fake_cloud.New()
+	issuer := NewCasIssuerWithClients(cloud.Cas(), cloud.Dns(), CasIssuerConfig{PollInterval: time.Millisecond, Timeout: time.Second})
+
+	if _, err := issuer.Obtain(context.Background(), []string{"example.test", "www.example.test"}, nil); err == nil {
+		t.Error("expected certificates of several names rejected")
+	}
+	if calls := cloud.Calls("CreateCertificateForPackageRequest"); calls != 0 {
+		t.Errorf("expected no order, got %d", calls)
+	}
+
+	// the order is left unvalidated without its record
+	cloud.Fail("AddDomainRecord", errors.New("dns denied"))
+	if _, err := issuer.Obtain(context.Background(), []string{"www.example.test"}, nil); err == nil {
+		t.Fatal("expected the obtain to fail without the validation record")
+	}
+	if calls := cloud.Calls("AddDomainRecord"); calls != 1 {
+		t.Errorf("expected a denied record not retried, got %d calls", calls)
+	}
+	if calls := cloud.Calls("DeleteDomainRecord"); calls != 0 {
+		t.Errorf("expected no record to delete, got %d", calls)
+	}
+
+	if err := issuer.Revoke(context.Background(), &Certificate{CommonName: "www.example.test"}, 0); err == nil {
+		t.Error("expected revoking cas issued certificates unsupported")
+	}
+}
+
+func TestCasIssuerRenewPages(t *testing.T) {
+	cloud := fake_cloud.New()
+	issuer := NewCasIssuerWithClients(cloud.Cas(), cloud.Dns(), CasIssuerConfig{PollInterval: time.Millisecond, Timeout: time.Second})
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the orders before fill the first page
+	var cert *Certificate
+	for n := 0; n < casPageSize; n++ {
+		if cert, err = issuer.Obtain(context.Background(), []string{"www.example.test"}, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	renewed, err := issuer.Renew(context.Background(), cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.CasCertificateId == 0 || renewed.CasCertificateId == cert.CasCertificateId {
+		t.Errorf("expected the certificate of the new order, got %d", renewed.CasCertificateId)
+	}
+
+	stored, err := utils.ParsePrivateKey(renewed.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ecKey, ok := stored.(*ecdsa.PrivateKey); !ok || !ecKey.Equal(key) {
+		t.Error("renewed certificate does not keep the ec key")
+	}
+	if publicKey, ok := renewed.X509Certificate().PublicKey.(*ecdsa.PublicKey); !ok || !publicKey.Equal(&key.PublicKey) {
+		t.Error("renewed certificate is not issued for the ec key")
+	}
+}
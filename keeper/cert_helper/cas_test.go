@@ -0,0 +1,98 @@
+package cert_helper
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/fake_cloud"
+)
+
+func testCasCertificate(t *testing.T, commonName string, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    notAfter.AddDate(0, 0, -90),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestCasInventoryPages(t *testing.T) {
+	ctx := context.Background()
+	cloud := fake_cloud.New()
+	now := time.Now()
+
+	// two full pages of purchased certificates, the wanted one last
+	for i := 0; i < 2*casPageSize-1; i++ {
+		certPem, keyPem := testCasCertificate(t, fmt.Sprintf("*.filler%d.test", i), now.AddDate(1, 0, 0))
+		cloud.AddCertificate(fmt.Sprintf("filler%d_test", i), certPem, keyPem, true)
+	}
+	certPem, keyPem := testCasCertificate(t, "*.example.test", now.AddDate(1, 0, 0))
+	purchasedId := cloud.AddCertificate("example_test", certPem, keyPem, true)
+
+	// a page of uploaded certificates, the expired one on the second page
+	for i := 0; i < casPageSize; i++ {
+		certPem, keyPem := testCasCertificate(t, fmt.Sprintf("*.upload%d.test", i), now.AddDate(0, 2, 0))
+		cloud.AddCertificate(fmt.Sprintf("sslkeeper-upload%d_test-1", i), certPem, keyPem, false)
+	}
+	certPem, keyPem = testCasCertificate(t, "*.old.test", now.AddDate(0, 0, -1))
+	expiredId := cloud.AddCertificate("sslkeeper-old_test-1", certPem, keyPem, false)
+
+	m := NewCertManagerWithClient(cloud.Cas(), nil, memoryStorage{})
+	inventory, err := m.CasInventory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inventory) != 3*casPageSize+1 {
+		t.Errorf("expected %d certificates, got %d", 3*casPageSize+1, len(inventory))
+	}
+	// the full second page of purchased ones is the last by the total count
+	if calls := cloud.Calls("ListUserCertificateOrder"); calls != 4 {
+		t.Errorf("expected 4 pages listed, got %d", calls)
+	}
+
+	cert, err := m.SearchAvailableCertificateFromCas(ctx, "*.example.test", "www.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert == nil || cert.CasCertificateId != purchasedId {
+		t.Errorf("expected the purchased certificate %d on the second page, got %v", purchasedId, cert)
+	}
+
+	cleaned, err := m.CleanCasCertificates(ctx, NewCasBindings(), CleanupPolicy{Retain: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cleaned) != 1 || cleaned[0].Cert.Id != expiredId {
+		t.Errorf("expected only the expired certificate %d cleaned up, got %v", expiredId, cleaned)
+	}
+	if cloud.Certificate(expiredId) != nil {
+		t.Errorf("expired certificate %d is not deleted", expiredId)
+	}
+}
@@ -16,6 +16,8 @@ type Certificate struct {
 	IssuerCertificate []byte
 
 	Updated bool
+	// External is set on imported certificates, which are never renewed
+	External bool
 
 	casName  string
 	x509Cert *x509.Certificate
@@ -41,6 +43,11 @@ func (c *Certificate) SetCasCertificateId(id int64) {
 }
 
 func (c *Certificate) CasName() string {
+	// certificates only known by cas id have no name to derive
+	if c.casName == "" && c.X509Certificate() == nil {
+		return ""
+	}
+
 	if c.casName == "" {
 		c.casName = "sslkeeper-" +
 			strings.ReplaceAll(strings.Replace(c.CommonName, "*.", "", 1), ".", "_") +
@@ -0,0 +1,158 @@
+package cert_helper
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+// CleanupPolicy decides which certificates uploaded by the keeper are deleted
+// from cas. Bound certificates are never deleted.
+type CleanupPolicy struct {
+	// Retain is the number of previous versions kept for rollback.
+	Retain int
+	// GracePeriod keeps a replaced version until its successor is that old.
+	GracePeriod time.Duration
+	DryRun      bool
+}
+
+// CasBindings is the set of cas certificates bound to any service domain,
+// and of those the domains may roll back to.
+type CasBindings struct {
+	ids   map[int64]bool
+	names map[string]bool
+
+	rollbackIds   map[int64]bool
+	rollbackNames map[string]bool
+}
+
+func NewCasBindings() *CasBindings {
+	return &CasBindings{
+		ids:           make(map[int64]bool),
+		names:         make(map[string]bool),
+		rollbackIds:   make(map[int64]bool),
+		rollbackNames: make(map[string]bool),
+	}
+}
+
+func (b *CasBindings) Add(certId int64, certName string) {
+	if certId != 0 {
+		b.ids[certId] = true
+	}
+	if certName != "" {
+		b.names[certName] = true
+	}
+}
+
+func (b *CasBindings) Uses(cert *CasCertificate) bool {
+	return b.ids[cert.Id] || b.names[cert.Name]
+}
+
+// AddRollback adds a certificate a domain may roll back to, it is kept past
+// the retention but still deleted once expired.
+func (b *CasBindings) AddRollback(certId int64, certName string) {
+	if certId != 0 {
+		b.rollbackIds[certId] = true
+	}
+	if certName != "" {
+		b.rollbackNames[certName] = true
+	}
+}
+
+func (b *CasBindings) RollbackTarget(cert *CasCertificate) bool {
+	return b.rollbackIds[cert.Id] || b.rollbackNames[cert.Name]
+}
+
+// CasCleanup is a certificate deleted, or to be deleted, by the cleanup.
+type CasCleanup struct {
+	Cert   *CasCertificate
+	Reason string
+	Err    error
+}
+
+// planCasCleanup groups the keeper certificates by common name, newest first,
+// and picks the expired ones and the versions beyond the retention which are
+// neither bound nor within the grace period.
+func planCasCleanup(certs []*CasCertificate, bindings *CasBindings, policy CleanupPolicy, now time.Time) []CasCleanup {
+	versions := make(map[string][]*CasCertificate)
+	commonNames := []string{}
+	for _, cert := range certs {
+		if _, ok := versions[cert.CommonName]; !ok {
+			commonNames = append(commonNames, cert.CommonName)
+		}
+		versions[cert.CommonName] = append(versions[cert.CommonName], cert)
+	}
+
+	plan := []CasCleanup{}
+	for _, commonName := range commonNames {
+		certs := versions[commonName]
+		sort.SliceStable(certs, func(i, j int) bool {
+			return certs[i].NotAfter.After(certs[j].NotAfter)
+		})
+
+		for i, cert := range certs {
+			if bindings.Uses(cert) {
+				if cert.NotAfter.Before(now) {
+					log.Printf("expired certificate %s (%d) is still bound, keep it", cert.Name, cert.Id)
+				}
+				continue
+			}
+
+			if cert.Status == "EXPIRED" || cert.NotAfter.Before(now) {
+				plan = append(plan, CasCleanup{Cert: cert, Reason: "expired"})
+				continue
+			}
+
+			if bindings.RollbackTarget(cert) {
+				continue
+			}
+
+			// the newest version and the retained previous ones
+			if i <= policy.Retain {
+				continue
+			}
+
+			if certs[i-1].NotBefore.Add(policy.GracePeriod).After(now) {
+				continue
+			}
+
+			plan = append(plan, CasCleanup{Cert: cert, Reason: "superseded"})
+		}
+	}
+
+	return plan
+}
+
+// CleanCasCertificates deletes the expired and superseded certificates the
+// keeper uploaded to cas, keeping every certificate in the bindings.
+func (m *CertManager) CleanCasCertificates(ctx context.Context, bindings *CasBindings, policy CleanupPolicy) ([]CasCleanup, error) {
+	certs, err := m.CasInventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keeperCerts := []*CasCertificate{}
+	for _, cert := range certs {
+		if !cert.Purchased && cert.KeeperIssued() {
+			keeperCerts = append(keeperCerts, cert)
+		}
+	}
+
+	plan := planCasCleanup(keeperCerts, bindings, policy, time.Now())
+	for i := range plan {
+		cert := plan[i].Cert
+
+		if policy.DryRun {
+			log.Printf("would delete certificate %s (%d): %s", cert.Name, cert.Id, plan[i].Reason)
+			continue
+		}
+
+		log.Printf("delete certificate %s (%d): %s", cert.Name, cert.Id, plan[i].Reason)
+		if plan[i].Err = m.DeleteCasCertificate(ctx, cert.Id); plan[i].Err != nil {
+			log.Printf("delete certificate %d failed: %v", cert.Id, plan[i].Err)
+		}
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,61 @@
+package cert_helper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlanCasCleanup(t *testing.T) {
+	now := time.Now()
+	version := func(id int64, issuedDaysAgo int) *CasCertificate {
+		notBefore := now.AddDate(0, 0, -issuedDaysAgo)
+		return &CasCertificate{Id: id, Name: "sslkeeper-example_test", CommonName: "*.example.test", NotBefore: notBefore, NotAfter: notBefore.AddDate(0, 0, 90)}
+	}
+
+	certs := []*CasCertificate{
+		version(1, 20),  // newest
+		version(2, 61),  // retained
+		version(3, 121), // expired but bound
+		version(4, 181), // expired
+		version(5, 100), // expired yesterday but bound
+		{Id: 6, Name: "sslkeeper-other_test", CommonName: "other.test", NotBefore: now.AddDate(0, 0, -10), NotAfter: now.AddDate(0, 0, 80)},
+		{Id: 7, Name: "sslkeeper-other_test", CommonName: "other.test", NotBefore: now.AddDate(0, 0, -70), NotAfter: now.AddDate(0, 0, 20)},
+	}
+	certs[4].NotAfter = now.AddDate(0, 0, -1)
+
+	bindings := NewCasBindings()
+	bindings.Add(3, "")
+	bindings.Add(5, "")
+
+	deleted := func(policy CleanupPolicy) map[int64]string {
+		result := map[int64]string{}
+		for _, cleanup := range planCasCleanup(certs, bindings, policy, now) {
+			result[cleanup.Cert.Id] = cleanup.Reason
+		}
+		return result
+	}
+
+	got := deleted(CleanupPolicy{Retain: 1, GracePeriod: 72 * time.Hour})
+	if len(got) != 1 || got[4] != "expired" {
+		t.Errorf("retain 1: deleted %v", got)
+	}
+
+	got = deleted(CleanupPolicy{Retain: 0, GracePeriod: 72 * time.Hour})
+	if len(got) != 3 || got[2] != "superseded" || got[4] != "expired" || got[7] != "superseded" {
+		t.Errorf("retain 0: deleted %v", got)
+	}
+
+	// the successor of 2 is 20 days old, the one of 7 is 10 days old
+	got = deleted(CleanupPolicy{Retain: 0, GracePeriod: 15 * 24 * time.Hour})
+	if _, ok := got[7]; ok || got[2] != "superseded" {
+		t.Errorf("grace period: deleted %v", got)
+	}
+
+	// rollback targets are kept past the retention, but not once expired
+	bindings.AddRollback(2, "")
+	bindings.AddRollback(4, "")
+	got = deleted(CleanupPolicy{Retain: 0, GracePeriod: 72 * time.Hour})
+	if len(got) != 2 || got[4] != "expired" || got[7] != "superseded" {
+		t.Errorf("rollback targets: deleted %v", got)
+	}
+}
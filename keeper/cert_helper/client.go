@@ -0,0 +1,28 @@
+package cert_helper
+
+import (
+	cas "github.com/alibabacloud-go/cas-20200407/v2/client"
+	util "github.com/alibabacloud-go/tea-utils/v2/service"
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/alidns"
+)
+
+// CasClient is the part of the cas api the keeper calls, *cas.Client
+// implements it.
+type CasClient interface {
+	ListUserCertificateOrder(request *cas.ListUserCertificateOrderRequest) (*cas.ListUserCertificateOrderResponse, error)
+	ListUserCertificateOrderWithOptions(request *cas.ListUserCertificateOrderRequest, runtime *util.RuntimeOptions) (*cas.ListUserCertificateOrderResponse, error)
+	GetUserCertificateDetail(request *cas.GetUserCertificateDetailRequest) (*cas.GetUserCertificateDetailResponse, error)
+	UploadUserCertificate(request *cas.UploadUserCertificateRequest) (*cas.UploadUserCertificateResponse, error)
+	DeleteUserCertificate(request *cas.DeleteUserCertificateRequest) (*cas.DeleteUserCertificateResponse, error)
+	CreateCertificateForPackageRequest(request *cas.CreateCertificateForPackageRequestRequest) (*cas.CreateCertificateForPackageRequestResponse, error)
+	DescribeCertificateState(request *cas.DescribeCertificateStateRequest) (*cas.DescribeCertificateStateResponse, error)
+}
+
+// DnsClient is the part of the alidns api the cas issuer calls for domain
+// validation, *alidns.Client implements it.
+type DnsClient interface {
+	GetMainDomainName(request *alidns.GetMainDomainNameRequest) (*alidns.GetMainDomainNameResponse, error)
+	AddDomainRecord(request *alidns.AddDomainRecordRequest) (*alidns.AddDomainRecordResponse, error)
+	DescribeDomainRecords(request *alidns.DescribeDomainRecordsRequest) (*alidns.DescribeDomainRecordsResponse, error)
+	DeleteDomainRecord(request *alidns.DeleteDomainRecordRequest) (*alidns.DeleteDomainRecordResponse, error)
+}
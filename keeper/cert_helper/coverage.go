@@ -0,0 +1,142 @@
+package cert_helper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CoveragePreference decides which cas certificate is used when several of
+// them cover a domain.
+type CoveragePreference string
+
+const (
+	// PreferPurchased uses purchased certificates over uploaded ones.
+	PreferPurchased CoveragePreference = "purchased"
+	// PreferLongest uses the certificate with the longest validity.
+	PreferLongest CoveragePreference = "longest"
+	// PreferKeeper uses certificates uploaded by the keeper over others.
+	PreferKeeper CoveragePreference = "keeper"
+)
+
+func ParseCoveragePreference(value string) (CoveragePreference, error) {
+	switch preference := CoveragePreference(value); preference {
+	case PreferPurchased, PreferLongest, PreferKeeper:
+		return preference, nil
+	default:
+		return "", fmt.Errorf("unknown cas preference %s, expected purchased, longest or keeper", value)
+	}
+}
+
+func (m *CertManager) SetCoveragePreference(preference CoveragePreference) {
+	m.preference = preference
+}
+
+// Covers reports whether one of the names of the certificate covers the
+// domain, wildcards included.
+func (c *CasCertificate) Covers(domain string) bool {
+	for _, name := range append([]string{c.CommonName}, c.Sans...) {
+		if (&Certificate{CommonName: name}).MatchDomain(domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KeeperIssued reports whether the keeper uploaded the certificate.
+func (c *CasCertificate) KeeperIssued() bool {
+	return strings.HasPrefix(c.Name, "sslkeeper-")
+}
+
+// Imported reports whether the certificate was imported into the keeper.
+func (c *CasCertificate) Imported() bool {
+	return strings.HasPrefix(c.Name, "imported-")
+}
+
+// selectCoverage picks the preferred certificate covering the domain with
+// more than 7 days left, nil if there is none.
+func selectCoverage(certs []*CasCertificate, domain string, preference CoveragePreference) *CasCertificate {
+	deadline := time.Now().AddDate(0, 0, 7)
+
+	candidates := []*CasCertificate{}
+	for _, cert := range certs {
+		if cert.Status != "REVOKED" && cert.NotAfter.After(deadline) && cert.Covers(domain) {
+			candidates = append(candidates, cert)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+
+		switch preference {
+		case PreferPurchased:
+			if a.Purchased != b.Purchased {
+				return a.Purchased
+			}
+		case PreferKeeper:
+			if a.KeeperIssued() != b.KeeperIssued() {
+				return a.KeeperIssued()
+			}
+		}
+
+		return a.NotAfter.After(b.NotAfter)
+	})
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return candidates[0]
+}
+
+// SearchAvailableCertificateFromCas resolves the cas certificate covering the
+// domain, purchased or uploaded, for the common name of the domain. nil if
+// there is none.
+func (m *CertManager) SearchAvailableCertificateFromCas(ctx context.Context, commonName, domain string) (*Certificate, error) {
+	certs, err := m.CasInventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := selectCoverage(certs, domain, m.preference)
+	if cert == nil {
+		return nil, nil
+	}
+
+	return &Certificate{
+		CommonName:       commonName,
+		CasCertificateId: cert.Id,
+		casName:          cert.Name,
+	}, nil
+}
+
+// DomainCertificate returns the cas certificate preferred for the domain if it
+// does not cover the common name of the domain, like a purchased one for the
+// exact name. nil if the certificate of the common name applies.
+func (m *CertManager) DomainCertificate(ctx context.Context, domain string) (*Certificate, error) {
+	commonName := m.CommonName(ctx, domain)
+	if commonName == domain {
+		return nil, nil
+	}
+
+	cert, err := m.SearchAvailableCertificateFromCas(ctx, commonName, domain)
+	if err != nil || cert == nil {
+		return nil, err
+	}
+
+	detail := m.casDetails[cert.CasCertificateId]
+	if detail == nil || detail.Covers(commonName) {
+		return nil, nil
+	}
+
+	// named after its own subject, not the common name it stands in for
+	cert.CommonName = detail.CommonName
+	if cert.CommonName == "" {
+		cert.CommonName = domain
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,71 @@
+package cert_helper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/fake_cloud"
+)
+
+func TestSelectCoverage(t *testing.T) {
+	now := time.Now()
+	certs := []*CasCertificate{
+		{Id: 1, Name: "sslkeeper-example_test-1", CommonName: "*.example.test", NotAfter: now.AddDate(0, 0, 60)},
+		{Id: 2, Name: "purchased", CommonName: "example.test", Sans: []string{"example.test", "*.example.test"}, NotAfter: now.AddDate(0, 0, 30), Purchased: true},
+		{Id: 3, Name: "other", CommonName: "*.example.test", NotAfter: now.AddDate(0, 0, 90)},
+		{Id: 4, Name: "expiring", CommonName: "*.example.test", NotAfter: now.AddDate(0, 0, 3), Purchased: true},
+		{Id: 5, Name: "deeper", CommonName: "*.www.example.test", NotAfter: now.AddDate(1, 0, 0), Purchased: true},
+	}
+
+	tests := []struct {
+		domain     string
+		preference CoveragePreference
+		want       int64
+	}{
+		{"www.example.test", PreferPurchased, 2},
+		{"*.example.test", PreferPurchased, 2},
+		{"www.example.test", PreferLongest, 3},
+		{"www.example.test", PreferKeeper, 1},
+		{"a.www.example.test", PreferLongest, 5},
+	}
+
+	for _, test := range tests {
+		got := selectCoverage(certs, test.domain, test.preference)
+		if got == nil || got.Id != test.want {
+			t.Errorf("selectCoverage(%s, %s) = %v, want %d", test.domain, test.preference, got, test.want)
+		}
+	}
+
+	if got := selectCoverage(certs, "example.other", PreferLongest); got != nil {
+		t.Errorf("unexpected coverage of example.other: %d", got.Id)
+	}
+}
+
+func TestDomainCertificate(t *testing.T) {
+	ctx := context.Background()
+	cloud := fake_cloud.New()
+
+	certPem, keyPem := testCasCertificate(t, "www.example.test", time.Now().AddDate(1, 0, 0))
+	exactId := cloud.AddCertificate("www_example_test", certPem, keyPem, true)
+
+	m := NewCertManagerWithClient(cloud.Cas(), nil, memoryStorage{})
+	cert, err := m.DomainCertificate(ctx, "www.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert == nil || cert.CasCertificateId != exactId {
+		t.Fatalf("expected the certificate %d of the exact name, got %v", exactId, cert)
+	}
+	if cert.CommonName != "www.example.test" {
+		t.Errorf("certificate named %s, not after its subject", cert.CommonName)
+	}
+
+	// the wildcard covers the common name, it is left to the common name
+	certPem, keyPem = testCasCertificate(t, "*.example.test", time.Now().AddDate(2, 0, 0))
+	cloud.AddCertificate("example_test", certPem, keyPem, true)
+	m = NewCertManagerWithClient(cloud.Cas(), nil, memoryStorage{})
+	if cert, err := m.DomainCertificate(ctx, "www.example.test"); err != nil || cert != nil {
+		t.Errorf("expected the certificate of the common name to apply, got %v, %v", cert, err)
+	}
+}
@@ -0,0 +1,119 @@
+package cert_helper
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DelegationStatus describes where the DNS-01 challenge record of a domain
+// lives, Target is the end of the CNAME chain of _acme-challenge.<domain>.
+type DelegationStatus struct {
+	Domain        string
+	ChallengeFQDN string
+	Target        string
+	Delegated     bool
+	Err           error
+}
+
+func (s DelegationStatus) String() string {
+	switch {
+	case s.Err != nil:
+		return fmt.Sprintf("%s: error: %v", s.Domain, s.Err)
+	case s.Delegated:
+		return fmt.Sprintf("%s: delegated to %s", s.Domain, s.Target)
+	case s.Target != s.ChallengeFQDN:
+		return fmt.Sprintf("%s: missing delegation, %s points to %s", s.Domain, s.ChallengeFQDN, s.Target)
+	default:
+		return fmt.Sprintf("%s: missing delegation, no CNAME on %s", s.Domain, s.ChallengeFQDN)
+	}
+}
+
+// UsesDelegation tells whether the issuer validates by the DNS-01 record of
+// _acme-challenge.<domain>, the one the delegation is checked for.
+func UsesDelegation(issuer Issuer) bool {
+	acmeIssuer, ok := issuer.(*AcmeIssuer)
+	return ok && !acmeIssuer.http01
+}
+
+func DefaultNameservers() []string {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(config.Servers) == 0 {
+		return []string{"223.5.5.5:53", "8.8.8.8:53"}
+	}
+
+	servers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		servers = append(servers, net.JoinHostPort(server, config.Port))
+	}
+	return servers
+}
+
+func lookupCNAME(fqdn string, nameservers []string) (string, bool, error) {
+	client := &dns.Client{Timeout: 5 * time.Second}
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeCNAME)
+	m.RecursionDesired = true
+
+	var lastErr error
+	for _, ns := range nameservers {
+		r, _, err := client.Exchange(m, ns)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("query %s on %s: %s", fqdn, ns, dns.RcodeToString[r.Rcode])
+			continue
+		}
+
+		for _, rr := range r.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, fqdn) {
+				return strings.ToLower(cname.Target), true, nil
+			}
+		}
+
+		return fqdn, false, nil
+	}
+
+	return "", false, lastErr
+}
+
+// CheckDelegation follows the CNAME chain of the challenge record of domain,
+// the same way lego does before writing the TXT record. When validationZone
+// is empty any CNAME counts as a delegation.
+func CheckDelegation(domain, validationZone string, nameservers []string) DelegationStatus {
+	domain = strings.TrimPrefix(strings.Trim(strings.ToLower(domain), "."), "*.")
+	fqdn := "_acme-challenge." + domain + "."
+	status := DelegationStatus{Domain: domain, ChallengeFQDN: fqdn, Target: fqdn}
+
+	if len(nameservers) == 0 {
+		nameservers = DefaultNameservers()
+	}
+
+	for limit := 0; limit < 50; limit++ {
+		target, ok, err := lookupCNAME(status.Target, nameservers)
+		if err != nil {
+			status.Err = err
+			return status
+		}
+		if !ok {
+			break
+		}
+		status.Target = target
+	}
+
+	if status.Target == fqdn {
+		return status
+	}
+
+	validationZone = strings.Trim(strings.ToLower(validationZone), ".")
+	status.Delegated = validationZone == "" ||
+		strings.HasSuffix(strings.TrimSuffix(status.Target, "."), "."+validationZone)
+
+	return status
+}
@@ -0,0 +1,164 @@
+package cert_helper
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/providers/dns"
+	"github.com/go-acme/lego/v4/providers/dns/alidns"
+)
+
+// DNSProviderConfig binds a zone to one of the lego DNS providers, Env holds
+// the lego environment variables of the provider, e.g. CF_DNS_API_TOKEN.
+type DNSProviderConfig struct {
+	Zone     string            `mapstructure:"zone"`
+	Provider string            `mapstructure:"provider"`
+	Env      map[string]string `mapstructure:"env"`
+}
+
+type zoneProvider struct {
+	zone     string
+	provider challenge.Provider
+}
+
+// ZoneDNSProvider dispatches DNS-01 challenges to the provider of the longest
+// configured zone matching the challenge record, falling back to the default
+// provider. The record is looked up after following the CNAME on
+// _acme-challenge.<domain>, so a delegated validation zone can have its own
+// provider and credentials.
+type ZoneDNSProvider struct {
+	zones    []zoneProvider
+	fallback challenge.Provider
+}
+
+// lego providers read their config from environment variables
+var dnsProviderEnvLock sync.Mutex
+
+func newLegoDNSProvider(name string, vars map[string]string) (challenge.Provider, error) {
+	dnsProviderEnvLock.Lock()
+	defer dnsProviderEnvLock.Unlock()
+
+	restore := map[string]*string{}
+	for key, value := range vars {
+		// viper lower cases map keys
+		key = strings.ToUpper(key)
+		if old, ok := os.LookupEnv(key); ok {
+			restore[key] = &old
+		} else {
+			restore[key] = nil
+		}
+		os.Setenv(key, value)
+	}
+
+	defer func() {
+		for key, value := range restore {
+			if value == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *value)
+			}
+		}
+	}()
+
+	return dns.NewDNSChallengeProviderByName(name)
+}
+
+func newAlidnsProvider(aliConfig *aliapi.Config) (challenge.Provider, error) {
+	alidnsConfig := alidns.NewDefaultConfig()
+	alidnsConfig.APIKey = *aliConfig.AccessKeyId
+	alidnsConfig.SecretKey = *aliConfig.AccessKeySecret
+	alidnsConfig.RegionID = *aliConfig.RegionId
+
+	return alidns.NewDNSProviderConfig(alidnsConfig)
+}
+
+func NewZoneDNSProvider(aliConfig *aliapi.Config, configs []DNSProviderConfig) (*ZoneDNSProvider, error) {
+	fallback, err := newAlidnsProvider(aliConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create alidns provider: %v", err)
+	}
+
+	p := &ZoneDNSProvider{fallback: fallback}
+
+	for _, config := range configs {
+		zone := strings.Trim(strings.ToLower(config.Zone), ".")
+		if zone == "" {
+			return nil, fmt.Errorf("dns provider %s: zone is required", config.Provider)
+		}
+
+		var provider challenge.Provider
+		if config.Provider == "alidns" && len(config.Env) == 0 {
+			provider = fallback
+		} else {
+			provider, err = newLegoDNSProvider(config.Provider, config.Env)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create dns provider %s for %s: %v", config.Provider, zone, err)
+			}
+		}
+
+		p.zones = append(p.zones, zoneProvider{zone: zone, provider: provider})
+	}
+
+	sort.SliceStable(p.zones, func(i, j int) bool {
+		return len(p.zones[i].zone) > len(p.zones[j].zone)
+	})
+
+	return p, nil
+}
+
+func (p *ZoneDNSProvider) ProviderFor(domain string) challenge.Provider {
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	domain = strings.TrimPrefix(domain, "*.")
+
+	for _, z := range p.zones {
+		if domain == z.zone || strings.HasSuffix(domain, "."+z.zone) {
+			return z.provider
+		}
+	}
+
+	return p.fallback
+}
+
+func (p *ZoneDNSProvider) providerForChallenge(domain, keyAuth string) challenge.Provider {
+	if len(p.zones) == 0 {
+		return p.fallback
+	}
+
+	return p.ProviderFor(dns01.GetChallengeInfo(domain, keyAuth).EffectiveFQDN)
+}
+
+func (p *ZoneDNSProvider) Present(domain, token, keyAuth string) error {
+	return p.providerForChallenge(domain, keyAuth).Present(domain, token, keyAuth)
+}
+
+func (p *ZoneDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	return p.providerForChallenge(domain, keyAuth).CleanUp(domain, token, keyAuth)
+}
+
+// Timeout returns the longest timeout of all providers, lego asks for it once
+// per challenge without telling which domain it is for.
+func (p *ZoneDNSProvider) Timeout() (timeout, interval time.Duration) {
+	timeout, interval = dns01.DefaultPropagationTimeout, dns01.DefaultPollingInterval
+
+	providers := []challenge.Provider{p.fallback}
+	for _, z := range p.zones {
+		providers = append(providers, z.provider)
+	}
+
+	for _, provider := range providers {
+		if pt, ok := provider.(challenge.ProviderTimeout); ok {
+			if t, i := pt.Timeout(); t > timeout {
+				timeout, interval = t, i
+			}
+		}
+	}
+
+	return timeout, interval
+}
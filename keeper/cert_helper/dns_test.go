@@ -0,0 +1,202 @@
+package cert_helper
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/miekg/dns"
+)
+
+var testAliConfig = &aliapi.Config{
+	RegionId:        tea.String("cn-hangzhou"),
+	AccessKeyId:     tea.String("test-key"),
+	AccessKeySecret: tea.String("test-secret"),
+}
+
+const (
+	testTSIGKey    = "keeper."
+	testTSIGSecret = "c2VjcmV0LWZvci1zc2wta2VlcGVyLXRlc3Q="
+)
+
+type updateServer struct {
+	sync.Mutex
+	zone    string
+	cnames  map[string]string
+	inserts []string
+	removes []string
+}
+
+func (s *updateServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	switch r.Opcode {
+	case dns.OpcodeQuery:
+		if target, ok := s.cnames[r.Question[0].Name]; ok {
+			m.Answer = append(m.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: target,
+			})
+		} else if r.Question[0].Name == s.zone {
+			m.Answer = append(m.Answer, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: s.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:     "ns." + s.zone,
+				Mbox:   "admin." + s.zone,
+				Serial: 1,
+			})
+		} else {
+			m.Ns = append(m.Ns, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: s.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns:     "ns." + s.zone,
+				Mbox:   "admin." + s.zone,
+				Serial: 1,
+			})
+		}
+	case dns.OpcodeUpdate:
+		if r.IsTsig() == nil || w.TsigStatus() != nil {
+			m.SetRcode(r, dns.RcodeNotAuth)
+			break
+		}
+
+		s.Lock()
+		for _, rr := range r.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			switch rr.Header().Class {
+			case dns.ClassINET:
+				s.inserts = append(s.inserts, txt.Hdr.Name)
+			case dns.ClassNONE:
+				s.removes = append(s.removes, txt.Hdr.Name)
+			}
+		}
+		s.Unlock()
+	}
+
+	if r.IsTsig() != nil {
+		m.SetTsig(testTSIGKey, dns.HmacSHA256, 300, int64(r.IsTsig().TimeSigned))
+	}
+
+	w.WriteMsg(m)
+}
+
+func startUpdateServer(t *testing.T, zone string) (*updateServer, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &updateServer{zone: zone}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler:    handler,
+		TsigSecret: map[string]string{testTSIGKey: testTSIGSecret},
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+	}
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return handler, conn.LocalAddr().String()
+}
+
+func TestZoneDNSProviderFor(t *testing.T) {
+	p, err := NewZoneDNSProvider(testAliConfig, []DNSProviderConfig{
+		{Zone: "example.com", Provider: "alidns"},
+		{Zone: "Internal.Example.com.", Provider: "rfc2136", Env: map[string]string{
+			"rfc2136_nameserver": "127.0.0.1:53",
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	internal := p.ProviderFor("internal.example.com")
+	if internal == p.fallback {
+		t.Fatalf("internal.example.com should not use the fallback provider")
+	}
+
+	cases := map[string]bool{
+		"*.internal.example.com":   true,
+		"a.b.internal.example.com": true,
+		"example.com":              false,
+		"www.example.com":          false,
+		"notinternal.example.com":  false,
+		"example.org":              false,
+	}
+	for domain, useInternal := range cases {
+		if got := p.ProviderFor(domain) == internal; got != useInternal {
+			t.Errorf("ProviderFor(%q) internal = %v, want %v", domain, got, useInternal)
+		}
+	}
+}
+
+func TestZoneDNSProviderRFC2136(t *testing.T) {
+	t.Setenv("LEGO_DISABLE_CNAME_SUPPORT", "true")
+
+	server, addr := startUpdateServer(t, "internal.test.")
+
+	p, err := NewZoneDNSProvider(testAliConfig, []DNSProviderConfig{
+		{Zone: "internal.test", Provider: "rfc2136", Env: map[string]string{
+			"RFC2136_NAMESERVER":     addr,
+			"RFC2136_TSIG_KEY":       testTSIGKey,
+			"RFC2136_TSIG_SECRET":    testTSIGSecret,
+			"RFC2136_TSIG_ALGORITHM": dns.HmacSHA256,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Present("www.internal.test", "token", "key-auth"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CleanUp("www.internal.test", "token", "key-auth"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "_acme-challenge.www.internal.test."
+	if len(server.inserts) != 1 || server.inserts[0] != want {
+		t.Errorf("inserts = %v, want [%s]", server.inserts, want)
+	}
+	if len(server.removes) != 1 || server.removes[0] != want {
+		t.Errorf("removes = %v, want [%s]", server.removes, want)
+	}
+}
+
+func TestCheckDelegation(t *testing.T) {
+	server, addr := startUpdateServer(t, "example.test.")
+	server.cnames = map[string]string{
+		"_acme-challenge.example.test.":     "example.test.acme.validation.test.",
+		"_acme-challenge.www.example.test.": "_acme-challenge.elsewhere.test.",
+	}
+
+	cases := []struct {
+		domain    string
+		target    string
+		delegated bool
+	}{
+		{"*.example.test", "example.test.acme.validation.test.", true},
+		{"www.example.test", "_acme-challenge.elsewhere.test.", false},
+		{"api.example.test", "_acme-challenge.api.example.test.", false},
+	}
+
+	for _, c := range cases {
+		status := CheckDelegation(c.domain, "acme.validation.test", []string{addr})
+		if status.Err != nil {
+			t.Fatalf("CheckDelegation(%q): %v", c.domain, status.Err)
+		}
+		if status.Target != c.target || status.Delegated != c.delegated {
+			t.Errorf("CheckDelegation(%q) = %s", c.domain, status)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package cert_helper
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/utils"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// ParseCertificateBundle validates a PEM certificate, its chain and private
+// key from outside the keeper, e.g. a purchased OV/EV certificate. The chain
+// may also be appended to the certificate.
+func ParseCertificateBundle(certPEM, chainPEM, keyPEM []byte) (*Certificate, error) {
+	var certs []*x509.Certificate
+	for _, data := range [][]byte{certPEM, chainPEM} {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse certificate: %v", err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+
+	privateKey, err := utils.ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	return newImportedCertificate(certs, privateKey)
+}
+
+// ParsePKCS12 validates a PKCS#12 bundle like ParseCertificateBundle.
+func ParsePKCS12(data []byte, password string) (*Certificate, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pkcs12: %v", err)
+	}
+
+	var certs []*x509.Certificate
+	var privateKey crypto.PrivateKey
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse certificate: %v", err)
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY":
+			// pkcs12.ToPEM labels PKCS#1 and SEC 1 keys as PRIVATE KEY
+			if privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				if privateKey, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+					return nil, fmt.Errorf("failed to parse private key: %v", err)
+				}
+			}
+		}
+	}
+	if len(certs) == 0 || privateKey == nil {
+		return nil, errors.New("pkcs12 bundle has no certificate or private key")
+	}
+
+	return newImportedCertificate(certs, privateKey)
+}
+
+// encodePrivateKey encodes a rsa or ec private key as PEM, the way
+// utils.ParsePrivateKey reads it back.
+func encodePrivateKey(privateKey crypto.PrivateKey) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	case *ecdsa.PrivateKey:
+		keyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), nil
+	default:
+		return nil, errors.New("only rsa and ec private keys are supported")
+	}
+}
+
+func newImportedCertificate(certs []*x509.Certificate, privateKey crypto.PrivateKey) (*Certificate, error) {
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key")
+	}
+
+	// the leaf is the certificate of the private key, wherever it is
+	leafIndex := -1
+	for i, cert := range certs {
+		if publicKey, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && publicKey.Equal(signer.Public()) {
+			leafIndex = i
+			break
+		}
+	}
+	if leafIndex < 0 {
+		return nil, errors.New("private key does not match any certificate")
+	}
+
+	leaf := certs[leafIndex]
+	chain := append(append([]*x509.Certificate{}, certs[:leafIndex]...), certs[leafIndex+1:]...)
+
+	if time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired at %s", leaf.NotAfter)
+	}
+	if len(chain) > 0 {
+		if err := leaf.CheckSignatureFrom(chain[0]); err != nil {
+			return nil, fmt.Errorf("certificate is not signed by the first certificate of the chain: %v", err)
+		}
+	}
+
+	commonName := leaf.Subject.CommonName
+	if commonName == "" && len(leaf.DNSNames) > 0 {
+		commonName = leaf.DNSNames[0]
+	}
+	if commonName == "" {
+		return nil, errors.New("certificate has no common name")
+	}
+
+	keyPEM, err := encodePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var chainPEM bytes.Buffer
+	for _, cert := range chain {
+		pem.Encode(&chainPEM, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	cert := &Certificate{
+		CommonName:        commonName,
+		PrivateKey:        keyPEM,
+		Certificate:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}),
+		IssuerCertificate: chainPEM.Bytes(),
+		External:          true,
+		x509Cert:          leaf,
+	}
+
+	if _, err := tls.X509KeyPair(append(cert.Certificate, cert.IssuerCertificate...), cert.PrivateKey); err != nil {
+		return nil, fmt.Errorf("invalid key pair: %v", err)
+	}
+
+	return cert, nil
+}
+
+func (m *CertManager) loadExternalNames(ctx context.Context) map[string]bool {
+	if m.externalNames != nil || m.storage == nil {
+		return m.externalNames
+	}
+
+	// read again on the next call if storage failed, e.g. on a cancelled run
+	data, err := m.storage.Read(ctx, "external.json")
+	if err != nil {
+		log.Printf("read external names failed: %v", err)
+		return map[string]bool{}
+	}
+
+	m.externalNames = make(map[string]bool)
+	if data == nil {
+		return m.externalNames
+	}
+
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return m.externalNames
+	}
+	for _, name := range names {
+		m.externalNames[name] = true
+	}
+
+	return m.externalNames
+}
+
+// External tells whether the certificate of the common name was imported, it
+// is never issued by the keeper.
+func (m *CertManager) External(ctx context.Context, commonName string) bool {
+	return m.loadExternalNames(ctx)[commonName]
+}
+
+// ImportCertificate stores an externally sourced certificate and uploads it
+// to cas. It is deployed like any other certificate but never renewed, and
+// its common name is used as is, so exact names don't fall back to wildcards.
+func (m *CertManager) ImportCertificate(ctx context.Context, cert *Certificate) error {
+	cert.External = true
+	cert.casName = "imported-" +
+		strings.ReplaceAll(strings.Replace(cert.CommonName, "*.", "", 1), ".", "_") +
+		"-" + cert.X509Certificate().NotAfter.Format("20060102")
+
+	if err := m.publishCertificate(ctx, cert); err != nil {
+		return err
+	}
+
+	names := m.loadExternalNames(ctx)
+	if names[cert.CommonName] {
+		return nil
+	}
+	names[cert.CommonName] = true
+
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	return m.storage.Write(ctx, "external.json", data)
+}
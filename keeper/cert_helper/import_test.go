@@ -0,0 +1,132 @@
+package cert_helper
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/fake_cloud"
+)
+
+func TestImportCertificate(t *testing.T) {
+	ctx := context.Background()
+	storage := memoryStorage{}
+	cloud := fake_cloud.New()
+
+	issuer, err := NewLocalCAIssuer(ctx, storage, "local-ca", 90*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIssuer, err := NewLocalCAIssuer(ctx, memoryStorage{}, "local-ca", 90*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := issuer.Obtain(ctx, []string{"www.example.test"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := otherIssuer.Obtain(ctx, []string{"www.example.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseCertificateBundle(issued.Certificate, issued.IssuerCertificate, []byte("not a key")); err == nil {
+		t.Error("expected an invalid private key rejected")
+	}
+	if _, err := ParseCertificateBundle(issued.Certificate, other.IssuerCertificate, issued.PrivateKey); err == nil {
+		t.Error("expected a chain of another ca rejected")
+	}
+	expiredPem, expiredKey := testCasCertificate(t, "www.example.test", time.Now().AddDate(0, 0, -1))
+	if _, err := ParseCertificateBundle(expiredPem, nil, expiredKey); err == nil {
+		t.Error("expected an expired certificate rejected")
+	}
+
+	cert, err := ParseCertificateBundle(issued.Certificate, issued.IssuerCertificate, issued.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewCertManagerWithClient(cloud.Cas(), issuer, storage)
+	if err := m.AddTrustedRoots(issuer.CACertificate()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ImportCertificate(ctx, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	// uploaded as imported-, which reconcile and cleanup rely on
+	uploaded := cloud.Certificate(cert.CasCertificateId)
+	if uploaded == nil || !strings.HasPrefix(uploaded.Name, "imported-www_example_test-") {
+		t.Fatalf("unexpected upload %+v", uploaded)
+	}
+	inventory, err := m.CasInventory(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, casCert := range inventory {
+		if casCert.Id == cert.CasCertificateId && (!casCert.Imported() || casCert.KeeperIssued()) {
+			t.Errorf("certificate %s is not taken as imported", casCert.Name)
+		}
+	}
+
+	var names []string
+	if err := json.Unmarshal(storage["external.json"], &names); err != nil || len(names) != 1 || names[0] != "www.example.test" {
+		t.Errorf("unexpected external names %s", storage["external.json"])
+	}
+	if name := m.CommonName(ctx, "www.example.test"); name != "www.example.test" {
+		t.Errorf("expected the imported name as common name, got %s", name)
+	}
+
+	// the stored record loads back with its ec key, found in cas by name
+	m = NewCertManagerWithClient(cloud.Cas(), issuer, storage)
+	stored, err := m.GetCertificateFromStorage(ctx, "www.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.External || stored.CasName() != uploaded.Name || !bytes.Equal(stored.PrivateKey, issued.PrivateKey) {
+		t.Errorf("unexpected stored certificate %s (%s)", stored.CommonName, stored.CasName())
+	}
+}
+
+func TestRenewECKey(t *testing.T) {
+	ctx := context.Background()
+	storage := memoryStorage{}
+
+	issuer, err := NewLocalCAIssuer(ctx, storage, "local-ca", 3*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := issuer.Obtain(ctx, []string{"*.example.test"}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewCertManager(testAliConfig, issuer, storage)
+	if err := m.SaveCertificate(ctx, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	// expiring in 3 days, renewed with the same ec key
+	renewed, err := m.GetCertificateFromStorage(ctx, "*.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(renewed.Certificate, cert.Certificate) || !bytes.Equal(renewed.PrivateKey, cert.PrivateKey) {
+		t.Error("expected the certificate renewed with its ec key")
+	}
+}
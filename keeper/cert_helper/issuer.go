@@ -0,0 +1,104 @@
+package cert_helper
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/utils"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/lego"
+)
+
+// Issuer obtains certificates for a set of names, the first name is the
+// common name. A nil private key lets the issuer generate a new one.
+type Issuer interface {
+	Name() string
+	Obtain(ctx context.Context, names []string, privateKey crypto.PrivateKey) (*Certificate, error)
+	Renew(ctx context.Context, cert *Certificate) (*Certificate, error)
+	Revoke(ctx context.Context, cert *Certificate, reason uint) error
+}
+
+// IssuanceError is the failure of an issuer to obtain a certificate, as
+// opposed to the failures of cas or storage around it.
+type IssuanceError struct {
+	CommonName string
+	Issuer     string
+	Err        error
+}
+
+func (e *IssuanceError) Error() string {
+	return fmt.Sprintf("issue certificate of %s by %s failed: %v", e.CommonName, e.Issuer, e.Err)
+}
+
+func (e *IssuanceError) Unwrap() error {
+	return e.Err
+}
+
+type AcmeIssuer struct {
+	client *lego.Client
+	http01 bool
+}
+
+func NewAcmeIssuer(client *lego.Client) *AcmeIssuer {
+	return &AcmeIssuer{client: client}
+}
+
+// NewAcmeHTTP01Issuer issues by a lego client validating domains by HTTP-01,
+// the _acme-challenge records are not used.
+func NewAcmeHTTP01Issuer(client *lego.Client) *AcmeIssuer {
+	return &AcmeIssuer{client: client, http01: true}
+}
+
+func (i *AcmeIssuer) Name() string {
+	return "acme"
+}
+
+// Obtain can't be cancelled once the order is placed, lego bounds it with its
+// own timeouts.
+func (i *AcmeIssuer) Obtain(ctx context.Context, names []string, privateKey crypto.PrivateKey) (*Certificate, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no domain to obtain certificate for")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	certRes, err := i.client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains:    names,
+		PrivateKey: privateKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Certificate{
+		CommonName:        names[0],
+		PrivateKey:        certRes.PrivateKey,
+		Certificate:       certRes.Certificate,
+		IssuerCertificate: certRes.IssuerCertificate,
+		Updated:           true,
+	}, nil
+}
+
+func (i *AcmeIssuer) Renew(ctx context.Context, cert *Certificate) (*Certificate, error) {
+	var privateKey crypto.PrivateKey
+	if cert.PrivateKey != nil {
+		key, err := utils.ParsePrivateKey(cert.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = key
+	}
+
+	return i.Obtain(ctx, []string{cert.CommonName}, privateKey)
+}
+
+func (i *AcmeIssuer) Revoke(ctx context.Context, cert *Certificate, reason uint) error {
+	if cert.Certificate == nil {
+		return fmt.Errorf("certificate of %s is not available", cert.CommonName)
+	}
+
+	return i.client.Certificate.RevokeWithReason(cert.Certificate, &reason)
+}
@@ -1,22 +1,19 @@
 package cert_helper
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
-	"log"
 
 	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage"
 	"github.com/geektheripper/alicdn-ssl-keeper/utils"
-	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/challenge"
 	"github.com/go-acme/lego/v4/lego"
-	"github.com/go-acme/lego/v4/providers/dns/alidns"
 	"github.com/go-acme/lego/v4/registration"
 )
 
@@ -36,8 +33,8 @@ func (u *AcmeUser) GetPrivateKey() crypto.PrivateKey {
 	return u.privateKey
 }
 
-func ensurePrivateKey(storage storage.StorageService) (*ecdsa.PrivateKey, error) {
-	privateKeyPem, err := storage.Read("private.key")
+func ensurePrivateKey(ctx context.Context, storage storage.StorageService) (*ecdsa.PrivateKey, error) {
+	privateKeyPem, err := storage.Read(ctx, "private.key")
 	if err != nil {
 		return nil, err
 	}
@@ -51,26 +48,15 @@ func ensurePrivateKey(storage storage.StorageService) (*ecdsa.PrivateKey, error)
 		return nil, fmt.Errorf("failed to generate EC private key: %v", err)
 	}
 
-	privateKeyBytes, err := x509.MarshalECPrivateKey(privateKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal EC private key: %v", err)
-	}
-
-	privateKeyPem = pem.EncodeToMemory(&pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: privateKeyBytes,
-	})
-
-	err = storage.Write("private.key", privateKeyPem)
-	if err != nil {
-		return nil, fmt.Errorf("failed to save private key to storage: %v", err)
+	if err := savePrivateKey(ctx, storage, "private.key", privateKey); err != nil {
+		return nil, err
 	}
 
 	return privateKey, nil
 }
 
-func ensureRegistration(storage storage.StorageService, config *lego.Config) (*registration.Resource, error) {
-	regBytes, err := storage.Read("registration.json")
+func ensureRegistration(ctx context.Context, storage storage.StorageService, config *lego.Config) (*registration.Resource, error) {
+	regBytes, err := storage.Read(ctx, "registration.json")
 	if err != nil {
 		return nil, err
 	}
@@ -101,7 +87,7 @@ func ensureRegistration(storage storage.StorageService, config *lego.Config) (*r
 		return nil, fmt.Errorf("failed to marshal registration: %v", err)
 	}
 
-	err = storage.Write("registration.json", newRegBytes)
+	err = storage.Write(ctx, "registration.json", newRegBytes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to save registration to storage: %v", err)
 	}
@@ -109,46 +95,45 @@ func ensureRegistration(storage storage.StorageService, config *lego.Config) (*r
 	return reg, nil
 }
 
-func InitLego(storage storage.StorageService, aliConfig *aliapi.Config, email string, caDirURL string) *lego.Client {
-	// PrivateKey
-	privateKey, err := ensurePrivateKey(storage)
+func newLegoClient(ctx context.Context, storage storage.StorageService, email string, caDirURL string) (*lego.Client, error) {
+	account, err := LoadAcmeAccount(ctx, storage, email, caDirURL)
 	if err != nil {
-		log.Fatalf("Error loading private key: %v", err)
+		return nil, err
 	}
 
-	// User
-	u := &AcmeUser{Email: email, privateKey: privateKey}
-	config := lego.NewConfig(u)
-	config.CADirURL = caDirURL
-	config.Certificate.KeyType = certcrypto.RSA2048
+	return account.client, nil
+}
+
+func InitLego(ctx context.Context, storage storage.StorageService, aliConfig *aliapi.Config, email string, caDirURL string, dnsProviders []DNSProviderConfig) (*lego.Client, error) {
+	lego, err := newLegoClient(ctx, storage, email, caDirURL)
+	if err != nil {
+		return nil, err
+	}
 
-	// Registration
-	u.Registration, err = ensureRegistration(storage, config)
+	// DNS Provider
+	dnsProvider, err := NewZoneDNSProvider(aliConfig, dnsProviders)
 	if err != nil {
-		log.Fatalf("Error loading registration: %v", err)
+		return nil, fmt.Errorf("failed to create dns provider: %v", err)
 	}
 
-	// Client
-	lego, err := lego.NewClient(config)
+	err = lego.Challenge.SetDNS01Provider(dnsProvider)
 	if err != nil {
-		log.Fatalf("Error creating lego client: %v", err)
+		return nil, fmt.Errorf("failed to set DNS01 provider: %v", err)
 	}
 
-	// DNS Provider
-	alidnsConfig := alidns.NewDefaultConfig()
-	alidnsConfig.APIKey = *aliConfig.AccessKeyId
-	alidnsConfig.SecretKey = *aliConfig.AccessKeySecret
-	alidnsConfig.RegionID = *aliConfig.RegionId
+	return lego, nil
+}
 
-	providerConifg, err := alidns.NewDNSProviderConfig(alidnsConfig)
+func InitLegoHTTP01(ctx context.Context, storage storage.StorageService, email string, caDirURL string, provider challenge.Provider) (*lego.Client, error) {
+	lego, err := newLegoClient(ctx, storage, email, caDirURL)
 	if err != nil {
-		log.Fatalf("Error creating alidns provider config: %v", err)
+		return nil, err
 	}
 
-	err = lego.Challenge.SetDNS01Provider(providerConifg)
+	err = lego.Challenge.SetHTTP01Provider(provider)
 	if err != nil {
-		log.Fatalf("Error setting DNS01 provider: %v", err)
+		return nil, fmt.Errorf("failed to set HTTP01 provider: %v", err)
 	}
 
-	return lego
+	return lego, nil
 }
@@ -0,0 +1,201 @@
+package cert_helper
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage"
+	"github.com/geektheripper/alicdn-ssl-keeper/utils"
+)
+
+// LocalCAIssuer signs certificates with a CA kept in storage under
+// <prefix>/key.pem and <prefix>/cert.pem, for staging and internal domains
+// that don't need a publicly trusted certificate.
+type LocalCAIssuer struct {
+	storage  storage.StorageService
+	prefix   string
+	validity time.Duration
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+	caPem  []byte
+}
+
+func NewLocalCAIssuer(ctx context.Context, storage storage.StorageService, prefix string, validity time.Duration) (*LocalCAIssuer, error) {
+	i := &LocalCAIssuer{storage: storage, prefix: prefix, validity: validity}
+
+	if err := i.ensureCA(ctx); err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+func (i *LocalCAIssuer) Name() string {
+	return "local-ca"
+}
+
+func (i *LocalCAIssuer) CACertificate() []byte {
+	return i.caPem
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func (i *LocalCAIssuer) ensureCA(ctx context.Context) error {
+	keyPem, err := i.storage.Read(ctx, i.prefix+"/key.pem")
+	if err != nil {
+		return err
+	}
+
+	certPem, err := i.storage.Read(ctx, i.prefix+"/cert.pem")
+	if err != nil {
+		return err
+	}
+
+	if keyPem != nil && certPem != nil {
+		if i.caKey, err = utils.ParseECKey(keyPem); err != nil {
+			return fmt.Errorf("failed to parse local ca key: %v", err)
+		}
+		if i.caCert, err = utils.ParseCertificate(certPem); err != nil {
+			return fmt.Errorf("failed to parse local ca certificate: %v", err)
+		}
+		i.caPem = certPem
+		return nil
+	}
+
+	i.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate local ca key: %v", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ssl-keeper local ca", Organization: []string{"ssl-keeper"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &i.caKey.PublicKey, i.caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create local ca certificate: %v", err)
+	}
+
+	if i.caCert, err = x509.ParseCertificate(der); err != nil {
+		return err
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(i.caKey)
+	if err != nil {
+		return err
+	}
+
+	i.caPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if err := i.storage.Write(ctx, i.prefix+"/key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})); err != nil {
+		return fmt.Errorf("failed to save local ca key: %v", err)
+	}
+	if err := i.storage.Write(ctx, i.prefix+"/cert.pem", i.caPem); err != nil {
+		return fmt.Errorf("failed to save local ca certificate: %v", err)
+	}
+
+	return nil
+}
+
+func (i *LocalCAIssuer) Obtain(ctx context.Context, names []string, privateKey crypto.PrivateKey) (*Certificate, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no domain to obtain certificate for")
+	}
+
+	if privateKey == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate private key: %v", err)
+		}
+		privateKey = key
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	keyPem, err := encodePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(i.validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, i.caCert, signer.Public(), i.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign certificate for %s: %v", names[0], err)
+	}
+
+	return &Certificate{
+		CommonName:        names[0],
+		PrivateKey:        keyPem,
+		Certificate:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		IssuerCertificate: i.caPem,
+		Updated:           true,
+	}, nil
+}
+
+func (i *LocalCAIssuer) Renew(ctx context.Context, cert *Certificate) (*Certificate, error) {
+	var privateKey crypto.PrivateKey
+	if cert.PrivateKey != nil {
+		key, err := utils.ParsePrivateKey(cert.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = key
+	}
+
+	return i.Obtain(ctx, []string{cert.CommonName}, privateKey)
+}
+
+// Revoke records the serial number, there is no CRL or OCSP for the local ca.
+func (i *LocalCAIssuer) Revoke(ctx context.Context, cert *Certificate, reason uint) error {
+	x509Cert := cert.X509Certificate()
+	if x509Cert == nil {
+		return fmt.Errorf("certificate of %s is not available", cert.CommonName)
+	}
+
+	return i.storage.Write(ctx,
+		i.prefix+"/revoked/"+x509Cert.SerialNumber.Text(16),
+		[]byte(fmt.Sprintf("%s %d %s\n", cert.CommonName, reason, time.Now().Format(time.RFC3339))),
+	)
+}
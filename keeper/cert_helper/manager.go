@@ -1,31 +1,51 @@
 package cert_helper
 
 import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"strings"
 	"time"
 
-	"github.com/go-acme/lego/v4/certificate"
-	"github.com/go-acme/lego/v4/lego"
-	"github.com/samber/lo"
-
 	cas "github.com/alibabacloud-go/cas-20200407/v2/client"
 	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
 
-	util "github.com/alibabacloud-go/tea-utils/v2/service"
 	"github.com/alibabacloud-go/tea/tea"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage"
 	"github.com/geektheripper/alicdn-ssl-keeper/utils"
 )
 
 type CertManager struct {
-	lego    *lego.Client
-	cas     *cas.Client
+	issuer  Issuer
+	cas     CasClient
 	storage storage.StorageService
 	cache   map[string]*Certificate
+	// deferrals holds the common names deferred by the issuance schedule
+	deferrals map[string]error
+
+	issuers      map[string]Issuer
+	exactDomains map[string]bool
+	casDetails   map[int64]*CasCertificate
+	casCerts     []*CasCertificate
+
+	externalNames map[string]bool
+	preference    CoveragePreference
+	schedules     map[string]*IssuanceSchedule
+	roots         *x509.CertPool
+}
+
+type casRecord struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name,omitempty"`
+	// External marks imported certificates, which are never renewed
+	External bool `json:"external,omitempty"`
 }
 
-func NewCertManager(config *aliapi.Config, lego *lego.Client, storage storage.StorageService) *CertManager {
+func NewCertManager(config *aliapi.Config, issuer Issuer, storage storage.StorageService) *CertManager {
 	config.Endpoint = tea.String("cas.aliyuncs.com")
 	casClient, err := cas.NewClient(config)
 
@@ -33,240 +53,388 @@ func NewCertManager(config *aliapi.Config, lego *lego.Client, storage storage.St
 		log.Fatalf("Error creating cas client: %v", err)
 	}
 
+	return NewCertManagerWithClient(casClient, issuer, storage)
+}
+
+func NewCertManagerWithClient(casClient CasClient, issuer Issuer, storage storage.StorageService) *CertManager {
 	return &CertManager{
-		lego:    lego,
+		issuer:  issuer,
 		cas:     casClient,
 		storage: storage,
 		cache:   make(map[string]*Certificate),
+
+		deferrals: make(map[string]error),
+
+		issuers:      make(map[string]Issuer),
+		exactDomains: make(map[string]bool),
+		casDetails:   make(map[int64]*CasCertificate),
+		preference:   PreferPurchased,
+		schedules:    make(map[string]*IssuanceSchedule),
+	}
+}
+
+// SetIssuer overrides the default issuer for a common name.
+func (m *CertManager) SetIssuer(commonName string, issuer Issuer) {
+	m.issuers[commonName] = issuer
+}
+
+// SetExactIssuer issues the certificate of the domain itself instead of its
+// wildcard, for issuers that can't issue wildcard certificates like HTTP-01
+// or CAS free DV.
+func (m *CertManager) SetExactIssuer(domain string, issuer Issuer) {
+	m.exactDomains[domain] = true
+	m.issuers[domain] = issuer
+}
+
+func (m *CertManager) CommonName(ctx context.Context, domain string) string {
+	if m.exactDomains[domain] || m.loadExternalNames(ctx)[domain] {
+		return domain
 	}
+
+	return utils.DomainToCertCommonName(domain)
 }
 
-func (m *CertManager) GetCertificateFromStorage(commonName string) (*Certificate, error) {
+func (m *CertManager) Issuer(commonName string) Issuer {
+	if issuer, ok := m.issuers[commonName]; ok {
+		return issuer
+	}
+
+	return m.issuer
+}
+
+// LoadCertificate reads the certificate of the common name from storage,
+// Certificate is nil when there is none.
+func (m *CertManager) LoadCertificate(ctx context.Context, commonName string) (*Certificate, error) {
 	var cert *Certificate = &Certificate{
 		CommonName: commonName,
 	}
 	var err error
 
-	cert.PrivateKey, err = m.storage.Read(commonName + "/key.pem")
+	cert.PrivateKey, err = m.storage.Read(ctx, commonName+"/key.pem")
 	if err != nil {
 		return nil, err
 	}
 
-	cert.Certificate, err = m.storage.Read(commonName + "/cert.pem")
+	cert.Certificate, err = m.storage.Read(ctx, commonName+"/cert.pem")
 	if err != nil {
 		return nil, err
 	}
 
-	cert.IssuerCertificate, err = m.storage.Read(commonName + "/chain.pem")
+	cert.IssuerCertificate, err = m.storage.Read(ctx, commonName+"/chain.pem")
 	if err != nil {
 		return nil, err
 	}
 
+	casBytes, err := m.storage.Read(ctx, commonName+"/cas.json")
+	if err != nil {
+		return nil, err
+	}
+	if casBytes != nil {
+		var casRecord casRecord
+		if err := json.Unmarshal(casBytes, &casRecord); err != nil {
+			return nil, err
+		}
+		cert.CasCertificateId = casRecord.Id
+		cert.casName = casRecord.Name
+		cert.External = casRecord.External
+	}
+
+	return cert, nil
+}
+
+func (m *CertManager) SaveCertificate(ctx context.Context, cert *Certificate) error {
+	commonName := cert.CommonName
+
+	if err := m.storage.Write(ctx, commonName+"/key.pem", cert.PrivateKey); err != nil {
+		return err
+	}
+	if err := m.storage.Write(ctx, commonName+"/cert.pem", cert.Certificate); err != nil {
+		return err
+	}
+	if err := m.storage.Write(ctx, commonName+"/chain.pem", cert.IssuerCertificate); err != nil {
+		return err
+	}
+	if err := m.storage.Write(ctx, commonName+"/fullchain.pem", append(cert.Certificate, cert.IssuerCertificate...)); err != nil {
+		return err
+	}
+	// certificates issued into cas by the issuer are never uploaded
+	casBytes, err := json.Marshal(casRecord{Id: cert.CasCertificateId, Name: cert.casName, External: cert.External})
+	if err != nil {
+		return err
+	}
+	if err := m.storage.Write(ctx, commonName+"/cas.json", casBytes); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *CertManager) GetCertificateFromStorage(ctx context.Context, commonName string) (*Certificate, error) {
+	cert, err := m.LoadCertificate(ctx, commonName)
+	if err != nil {
+		return nil, err
+	}
+
+	var notAfter time.Time
 	if cert.Certificate != nil {
 		x509Cert, err := utils.ParseCertificate(cert.Certificate)
 		if err != nil {
 			return nil, err
 		}
+		notAfter = x509Cert.NotAfter
+
+		if cert.External {
+			if time.Until(x509Cert.NotAfter) < 7*24*time.Hour {
+				log.Printf("imported certificate of %s expires at %s, import a new one", commonName, x509Cert.NotAfter)
+			}
+			return cert, nil
+		}
 
 		if int(x509Cert.NotAfter.Sub(time.Now()).Hours()/24) > 7 {
 			return cert, nil
 		}
 	}
 
-	request := certificate.ObtainRequest{Domains: []string{commonName}}
-
+	var privateKey crypto.PrivateKey
 	if cert.PrivateKey != nil {
-		request.PrivateKey, err = utils.ParseRSAKey(cert.PrivateKey)
+		privateKey, err = utils.ParsePrivateKey(cert.PrivateKey)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	certRes, err := m.lego.Certificate.Obtain(request)
+	cert, err = m.issue(ctx, commonName, notAfter, func(issuer Issuer) (*Certificate, error) {
+		return issuer.Obtain(ctx, []string{commonName}, privateKey)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	cert.PrivateKey = certRes.PrivateKey
-	cert.Certificate = certRes.Certificate
-	cert.IssuerCertificate = certRes.IssuerCertificate
-	cert.Updated = true
-
-	if err := m.storage.Write(commonName+"/key.pem", cert.PrivateKey); err != nil {
+	if err := m.SaveCertificate(ctx, cert); err != nil {
 		return nil, err
 	}
-	if err := m.storage.Write(commonName+"/cert.pem", cert.Certificate); err != nil {
+
+	return cert, nil
+}
+
+func (m *CertManager) publishCertificate(ctx context.Context, cert *Certificate) error {
+	if err := validateMaterial(cert, "", m.roots, time.Now()); err != nil {
+		return err
+	}
+
+	if err := m.SaveCertificate(ctx, cert); err != nil {
+		return err
+	}
+
+	if cert.CasCertificateId == 0 {
+		if err := m.UploadCertificateToCas(ctx, cert); err != nil {
+			return err
+		}
+	}
+
+	m.cache[cert.CommonName] = cert
+
+	return nil
+}
+
+// ReissueCertificate obtains a new certificate with a fresh private key and
+// uploads it to cas, regardless of the stored one.
+func (m *CertManager) ReissueCertificate(ctx context.Context, commonName string) (*Certificate, error) {
+	if err := m.checkNotExternal(ctx, commonName); err != nil {
 		return nil, err
 	}
-	if err := m.storage.Write(commonName+"/chain.pem", cert.IssuerCertificate); err != nil {
+
+	// forced by hand, only the limits themselves hold it back
+	cert, err := m.issue(ctx, commonName, time.Time{}, func(issuer Issuer) (*Certificate, error) {
+		return issuer.Obtain(ctx, []string{commonName}, nil)
+	})
+	if err != nil {
 		return nil, err
 	}
-	if err := m.storage.Write(commonName+"/fullchain.pem", append(cert.Certificate, cert.IssuerCertificate...)); err != nil {
+
+	if err := m.publishCertificate(ctx, cert); err != nil {
 		return nil, err
 	}
 
 	return cert, nil
 }
 
-func (m *CertManager) SearchAvailableCertificateFromCas(commonName string) (*Certificate, error) {
-	resp, err := m.cas.ListUserCertificateOrderWithOptions(&cas.ListUserCertificateOrderRequest{
-		OrderType: tea.String("UPLOAD"),
-		Keyword:   tea.String(commonName),
-		Status:    tea.String("ISSUED"),
-	}, &util.RuntimeOptions{})
-
+// RenewCertificate renews the stored certificate with its private key and
+// uploads it to cas, even if it is not close to expiry.
+func (m *CertManager) RenewCertificate(ctx context.Context, commonName string) (*Certificate, error) {
+	stored, err := m.LoadCertificate(ctx, commonName)
 	if err != nil {
 		return nil, err
 	}
+	if stored.External {
+		return nil, fmt.Errorf("certificate of %s is imported, import a new one instead", commonName)
+	}
 
-	for _, certOrder := range resp.Body.CertificateOrderList {
-		domains := strings.Split(*certOrder.Sans, ",")
-		if !lo.Contains(domains, commonName) {
-			continue
+	cert, err := m.issue(ctx, commonName, time.Time{}, func(issuer Issuer) (*Certificate, error) {
+		if stored.Certificate != nil && stored.PrivateKey != nil {
+			return issuer.Renew(ctx, stored)
 		}
+		return issuer.Obtain(ctx, []string{commonName}, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		certDetailResp, err := m.cas.GetUserCertificateDetail(&cas.GetUserCertificateDetailRequest{CertId: certOrder.CertificateId})
-		if err != nil {
-			return nil, err
-		}
+	if err := m.publishCertificate(ctx, cert); err != nil {
+		return nil, err
+	}
 
-		cert, err := utils.ParseCertificate([]byte(*certDetailResp.Body.Cert))
-		if err != nil {
-			return nil, err
-		}
+	return cert, nil
+}
 
-		if int(cert.NotAfter.Sub(time.Now()).Hours()/24) > 7 {
-			return &Certificate{
-				CommonName:       commonName,
-				CasCertificateId: *certOrder.CertificateId,
-				casName:          *certOrder.Name,
-			}, nil
-		}
+func (m *CertManager) checkNotExternal(ctx context.Context, commonName string) error {
+	stored, err := m.LoadCertificate(ctx, commonName)
+	if err != nil {
+		return err
+	}
+	if stored.External {
+		return fmt.Errorf("certificate of %s is imported, import a new one instead", commonName)
 	}
 
-	return nil, nil
+	return nil
 }
 
-func (m *CertManager) UploadCertificateToCas(cert *Certificate) error {
-	result, err := m.cas.UploadUserCertificate(&cas.UploadUserCertificateRequest{
-		Name: tea.String(cert.CasName()),
-		Cert: tea.String(string(cert.Certificate)),
-		Key:  tea.String(string(cert.PrivateKey)),
-	})
+func (m *CertManager) RevokeCertificate(ctx context.Context, cert *Certificate, reason uint) error {
+	return m.Issuer(cert.CommonName).Revoke(ctx, cert, reason)
+}
 
+// GetCasCertificate loads a certificate from cas by id, without private key.
+func (m *CertManager) GetCasCertificate(ctx context.Context, certId int64) (*Certificate, error) {
+	resp, err := retry.Call(ctx, retry.Default, "cas", "GetUserCertificateDetail", func() (*cas.GetUserCertificateDetailResponse, error) {
+		return m.cas.GetUserCertificateDetail(&cas.GetUserCertificateDetailRequest{CertId: tea.Int64(certId)})
+	})
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	cert.SetCasCertificateId(*result.Body.CertId)
+	certificate, chain := splitChain([]byte(tea.StringValue(resp.Body.Cert)))
 
-	return err
+	return &Certificate{
+		CommonName:        tea.StringValue(resp.Body.Common),
+		CasCertificateId:  certId,
+		Certificate:       certificate,
+		IssuerCertificate: chain,
+		casName:           tea.StringValue(resp.Body.Name),
+	}, nil
 }
 
-func (m *CertManager) GetCertificate(commonName string) (*Certificate, error) {
-	if cert, ok := m.cache[commonName]; ok {
-		return cert, nil
+// FindCasCertificateId looks up the cas id of a certificate uploaded by the
+// keeper, 0 if it is not in cas.
+func (m *CertManager) FindCasCertificateId(ctx context.Context, cert *Certificate) (int64, error) {
+	if cert.CasCertificateId != 0 {
+		return cert.CasCertificateId, nil
 	}
 
-	var cert *Certificate
-
-	cert, err := m.SearchAvailableCertificateFromCas(commonName)
+	certs, err := m.CasInventory(ctx)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	if cert == nil {
-		cert, err = m.GetCertificateFromStorage(commonName)
-		if err != nil {
-			return nil, err
-		}
-
-		err = m.UploadCertificateToCas(cert)
-		if err != nil {
-			return nil, err
+	for _, casCert := range certs {
+		if !casCert.Purchased && casCert.Name == cert.CasName() {
+			return casCert.Id, nil
 		}
 	}
 
-	m.cache[commonName] = cert
-
-	return cert, nil
+	return 0, nil
 }
 
-func (m *CertManager) tryLogAndDeleteCertificate(cert *cas.ListUserCertificateOrderResponseBodyCertificateOrderList, reason string) {
-	log.Printf("delete certificate %s (%d): %s", *cert.Name, *cert.CertificateId, reason)
-	_, err := m.cas.DeleteUserCertificate(&cas.DeleteUserCertificateRequest{CertId: cert.CertificateId})
+func (m *CertManager) DeleteCasCertificate(ctx context.Context, certId int64) error {
+	err := retry.Default.Do(ctx, "cas", "DeleteUserCertificate", func() error {
+		_, err := m.cas.DeleteUserCertificate(&cas.DeleteUserCertificateRequest{CertId: tea.Int64(certId)})
+		return err
+	})
 	if err != nil {
-		log.Printf("delete certificate %d failed: %v", *cert.CertificateId, err)
+		return err
 	}
+
+	m.removeFromCasInventory(certId)
+	return nil
 }
 
-func (m *CertManager) CleanCasExpiredCertificate() {
-	resp, err := m.cas.ListUserCertificateOrderWithOptions(&cas.ListUserCertificateOrderRequest{
-		OrderType: tea.String("UPLOAD"),
-		Status:    tea.String("EXPIRED"),
-	}, &util.RuntimeOptions{})
+func (m *CertManager) UploadCertificateToCas(ctx context.Context, cert *Certificate) error {
+	result, err := retry.CallCreate(ctx, retry.Default, "cas", "UploadUserCertificate", func() (*cas.UploadUserCertificateResponse, error) {
+		return m.cas.UploadUserCertificate(&cas.UploadUserCertificateRequest{
+			Name: tea.String(cert.CasName()),
+			Cert: tea.String(string(cert.Certificate)),
+			Key:  tea.String(string(cert.PrivateKey)),
+		})
+	})
 
 	if err != nil {
-		return
-	}
-
-	for _, certOrder := range resp.Body.CertificateOrderList {
-		if !strings.HasPrefix(*certOrder.Name, "sslkeeper-") {
-			continue
+		// the upload may have taken effect before it failed
+		certId := int64(0)
+		if retry.Retryable(err) {
+			certId = m.findUploadedCertificate(ctx, cert)
+		}
+		if certId == 0 {
+			return fmt.Errorf("upload certificate of %s to cas failed: %v", cert.CommonName, err)
 		}
 
-		m.tryLogAndDeleteCertificate(certOrder, "expired")
+		log.Printf("upload of %s failed, but it is in cas as %d: %v", cert.CasName(), certId, err)
+		cert.SetCasCertificateId(certId)
+	} else {
+		cert.SetCasCertificateId(*result.Body.CertId)
 	}
-}
+	m.addToCasInventory(cert)
 
-func (m *CertManager) CleanCasDuplicateCertificate() {
-	resp, err := m.cas.ListUserCertificateOrderWithOptions(&cas.ListUserCertificateOrderRequest{
-		OrderType: tea.String("UPLOAD"),
-	}, &util.RuntimeOptions{})
+	return nil
+}
 
-	if err != nil {
-		return
+// UseCertificate makes GetCertificate return the cas certificate for the
+// common name, like one deployed earlier in the same pass.
+func (m *CertManager) UseCertificate(commonName string, certId int64, casName string) {
+	m.cache[commonName] = &Certificate{
+		CommonName:       commonName,
+		CasCertificateId: certId,
+		casName:          casName,
 	}
+}
 
-	type CertInfo struct {
-		Cert *cas.ListUserCertificateOrderResponseBodyCertificateOrderList
-		Exp  int64
+func (m *CertManager) GetCertificate(ctx context.Context, commonName string) (*Certificate, error) {
+	if cert, ok := m.cache[commonName]; ok {
+		return cert, nil
+	}
+	if err, ok := m.deferrals[commonName]; ok {
+		return nil, err
 	}
 
-	certMap := make(map[string]*CertInfo)
-
-	for _, certOrder := range resp.Body.CertificateOrderList {
-		if !strings.HasPrefix(*certOrder.Name, "sslkeeper-") {
-			continue
-		}
+	var cert *Certificate
 
-		certResp, err := m.cas.GetUserCertificateDetail(&cas.GetUserCertificateDetailRequest{CertId: certOrder.CertificateId})
-		if err != nil {
-			log.Printf("get certificate detail for %d failed: %v", *certOrder.CertificateId, err)
-			continue
-		}
+	cert, err := m.SearchAvailableCertificateFromCas(ctx, commonName, commonName)
+	if err != nil {
+		return nil, err
+	}
 
-		cert, err := utils.ParseCertificate([]byte(*certResp.Body.Cert))
+	if cert == nil {
+		cert, err = m.GetCertificateFromStorage(ctx, commonName)
 		if err != nil {
-			log.Printf("parse certificate for %d failed: %v", *certOrder.CertificateId, err)
-			continue
+			// deferred once for every domain of the common name
+			var deferredErr *DeferredError
+			if errors.As(err, &deferredErr) {
+				m.deferrals[commonName] = err
+			}
+			return nil, err
 		}
 
-		current := &CertInfo{
-			Cert: certOrder,
-			Exp:  cert.NotAfter.Unix(),
+		if err := validateMaterial(cert, "", m.roots, time.Now()); err != nil {
+			return nil, err
 		}
 
-		if _, ok := certMap[*certOrder.CommonName]; !ok {
-			certMap[*certOrder.CommonName] = current
-		} else {
-			recorded := certMap[*certOrder.CommonName]
-			if current.Exp < recorded.Exp {
-				m.tryLogAndDeleteCertificate(current.Cert, "duplicated")
-			} else {
-				m.tryLogAndDeleteCertificate(recorded.Cert, "duplicated")
-				certMap[*certOrder.CommonName] = current
+		if cert.CasCertificateId == 0 {
+			err = m.UploadCertificateToCas(ctx, cert)
+			if err != nil {
+				return nil, err
 			}
 		}
 	}
+
+	m.cache[commonName] = cert
+
+	return cert, nil
 }
@@ -0,0 +1,233 @@
+package cert_helper
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/fake_cloud"
+)
+
+type memoryStorage map[string][]byte
+
+func (s memoryStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	return s[key], nil
+}
+
+func (s memoryStorage) Write(ctx context.Context, key string, data []byte) error {
+	s[key] = data
+	return nil
+}
+
+func (s memoryStorage) Delete(ctx context.Context, key string) error {
+	delete(s, key)
+	return nil
+}
+
+func TestLocalCAIssuer(t *testing.T) {
+	storage := memoryStorage{}
+
+	issuer, err := NewLocalCAIssuer(context.Background(), storage, "local-ca", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := issuer.Obtain(context.Background(), []string{"*.example.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewLocalCAIssuer(context.Background(), storage, "local-ca", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reloaded.CACertificate(), issuer.CACertificate()) {
+		t.Fatal("local ca was not reloaded from storage")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(reloaded.CACertificate())
+
+	_, err = cert.X509Certificate().Verify(x509.VerifyOptions{DNSName: "www.example.test", Roots: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := issuer.Revoke(context.Background(), cert, 1); err != nil {
+		t.Fatal(err)
+	}
+	if storage["local-ca/revoked/"+cert.X509Certificate().SerialNumber.Text(16)] == nil {
+		t.Error("revoked serial was not recorded")
+	}
+}
+
+func TestCertManagerGetCertificateFromStorage(t *testing.T) {
+	storage := memoryStorage{}
+
+	issuer, err := NewLocalCAIssuer(context.Background(), storage, "local-ca", 3*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewCertManager(testAliConfig, issuer, storage)
+
+	cert, err := m.GetCertificateFromStorage(context.Background(), "*.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Updated {
+		t.Error("new certificate should be marked as updated")
+	}
+
+	for _, file := range []string{"key.pem", "cert.pem", "chain.pem", "fullchain.pem"} {
+		if storage["*.example.test/"+file] == nil {
+			t.Errorf("%s was not saved", file)
+		}
+	}
+
+	// expiring in 3 days, renewed with the same key
+	renewed, err := m.GetCertificateFromStorage(context.Background(), "*.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(renewed.Certificate, cert.Certificate) {
+		t.Error("expiring certificate was not renewed")
+	}
+	if !bytes.Equal(renewed.PrivateKey, cert.PrivateKey) {
+		t.Error("private key was not reused")
+	}
+
+	issuer.validity = 30 * 24 * time.Hour
+	if _, err := m.GetCertificateFromStorage(context.Background(), "*.example.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := m.GetCertificateFromStorage(context.Background(), "*.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Updated {
+		t.Error("valid certificate should be loaded from storage")
+	}
+}
+
+func TestImportedCertificate(t *testing.T) {
+	storage := memoryStorage{}
+
+	issuer, err := NewLocalCAIssuer(context.Background(), storage, "local-ca", 3*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued, err := issuer.Obtain(context.Background(), []string{"www.example.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := issuer.Obtain(context.Background(), []string{"www.example.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseCertificateBundle(issued.Certificate, issued.IssuerCertificate, other.PrivateKey); err == nil {
+		t.Error("mismatched private key should be rejected")
+	}
+
+	// chain first, leaf last
+	cert, err := ParseCertificateBundle(append(append([]byte{}, issued.IssuerCertificate...), issued.Certificate...), nil, issued.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.CommonName != "www.example.test" || !bytes.Equal(cert.Certificate, issued.Certificate) {
+		t.Errorf("unexpected leaf %s", cert.CommonName)
+	}
+
+	m := NewCertManager(testAliConfig, issuer, storage)
+	if err := m.SaveCertificate(context.Background(), cert); err != nil {
+		t.Fatal(err)
+	}
+
+	// expiring in 3 days, but never renewed
+	stored, err := m.GetCertificateFromStorage(context.Background(), "www.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.External || !bytes.Equal(stored.Certificate, issued.Certificate) {
+		t.Error("imported certificate should be kept")
+	}
+
+	if _, err := m.RenewCertificate(context.Background(), "www.example.test"); err == nil {
+		t.Error("imported certificate should not be renewed")
+	}
+}
+
+// contextStorage fails reads once the context is done, like remote storage.
+type contextStorage struct {
+	memoryStorage
+}
+
+func (s contextStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.memoryStorage.Read(ctx, key)
+}
+
+func TestCommonNameExternal(t *testing.T) {
+	storage := contextStorage{memoryStorage{"external.json": []byte(`["www.example.test"]`)}}
+	m := NewCertManager(testAliConfig, nil, storage)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if name := m.CommonName(cancelled, "www.example.test"); name != "*.example.test" {
+		t.Errorf("expected the wildcard while storage fails, got %s", name)
+	}
+
+	// a failed read is not remembered
+	if name := m.CommonName(context.Background(), "www.example.test"); name != "www.example.test" {
+		t.Errorf("expected the imported name, got %s", name)
+	}
+}
+
+func TestUploadTakingEffect(t *testing.T) {
+	storage := memoryStorage{}
+	cloud := fake_cloud.New()
+
+	issuer, err := NewLocalCAIssuer(context.Background(), storage, "local-ca", 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewCertManagerWithClient(cloud.Cas(), issuer, storage)
+
+	cert, err := issuer.Obtain(context.Background(), []string{"*.example.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the upload fails on its way back, after taking effect
+	cloud.FailAfter("UploadUserCertificate", errUnavailable)
+	if err := m.UploadCertificateToCas(context.Background(), cert); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := cloud.Calls("UploadUserCertificate"); calls != 1 {
+		t.Errorf("expected 1 upload, got %d", calls)
+	}
+	if uploaded := cloud.Certificate(cert.CasCertificateId); uploaded == nil || uploaded.Name != cert.CasName() {
+		t.Errorf("certificate %d is not the uploaded one", cert.CasCertificateId)
+	}
+	if certs := cloud.Certificates(); len(certs) != 1 {
+		t.Errorf("expected 1 certificate in cas, got %d", len(certs))
+	}
+
+	// a failure that did not take effect is still an error
+	cert, err = issuer.Obtain(context.Background(), []string{"*.other.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud.Fail("UploadUserCertificate", errUnavailable)
+	if err := m.UploadCertificateToCas(context.Background(), cert); err == nil {
+		t.Error("expected the failed upload to fail")
+	}
+}
@@ -0,0 +1,301 @@
+package cert_helper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage"
+	"golang.org/x/net/publicsuffix"
+)
+
+// renewBefore is when certificates in storage are due for renewal.
+const renewBefore = 7 * 24 * time.Hour
+
+// RateLimits are the issuance limits of an acme ca.
+type RateLimits struct {
+	// PerDomain is the number of certificates per registered domain and
+	// Duplicates the number for the same set of names, within Window.
+	PerDomain  int
+	Duplicates int
+	Window     time.Duration
+	// Reserve of PerDomain is kept for urgent renewals, the others are
+	// deferred to later runs once only the reserve is left.
+	Reserve int
+	// Urgent renewals expire within this, they are only held back by the
+	// limits themselves.
+	Urgent time.Duration
+	// Jitter spreads out renewals coming due together, a renewal which is
+	// not urgent waits a part of it, stable per certificate.
+	Jitter time.Duration
+}
+
+// LetsEncryptLimits are the limits of Let's Encrypt, a fifth of the
+// certificates per week is kept for urgent renewals.
+var LetsEncryptLimits = RateLimits{
+	PerDomain:  50,
+	Duplicates: 5,
+	Window:     7 * 24 * time.Hour,
+	Reserve:    10,
+	Urgent:     3 * 24 * time.Hour,
+	Jitter:     3 * 24 * time.Hour,
+}
+
+// IssuanceRecord is a certificate obtained for a registered domain.
+type IssuanceRecord struct {
+	Time  time.Time `json:"time"`
+	Names []string  `json:"names"`
+}
+
+// DeferredError is returned for a certificate held back to a later run.
+type DeferredError struct {
+	CommonName string
+	Reason     string
+	Until      time.Time
+}
+
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("issuance of %s deferred until %s: %s", e.CommonName, e.Until.Format(time.RFC3339), e.Reason)
+}
+
+// IssuanceBudget is the projected use of the limits of a registered domain.
+type IssuanceBudget struct {
+	Domain   string
+	Used     int
+	Limit    int
+	Deferred int
+	// Next is when the oldest issuance leaves the window
+	Next time.Time
+}
+
+// IssuanceSchedule tracks the certificates obtained per registered domain in
+// storage and predicts the limits of the ca before every issuance.
+type IssuanceSchedule struct {
+	storage storage.StorageService
+	limits  RateLimits
+
+	history map[string][]IssuanceRecord
+	// deferred holds the common names deferred per registered domain
+	deferred map[string]map[string]bool
+}
+
+func NewIssuanceSchedule(storage storage.StorageService, limits RateLimits) *IssuanceSchedule {
+	return &IssuanceSchedule{
+		storage:  storage,
+		limits:   limits,
+		history:  make(map[string][]IssuanceRecord),
+		deferred: make(map[string]map[string]bool),
+	}
+}
+
+// RegisteredDomain returns the domain the limits of a name are counted for,
+// like example.com for *.www.example.com.
+func RegisteredDomain(name string) string {
+	name = strings.TrimPrefix(name, "*.")
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		return domain
+	}
+
+	return name
+}
+
+func issuanceKey(domain string) string {
+	return "issuance/" + domain + ".json"
+}
+
+// records returns the issuances of the registered domain within the window.
+func (s *IssuanceSchedule) records(ctx context.Context, domain string) ([]IssuanceRecord, error) {
+	records, ok := s.history[domain]
+	if !ok {
+		data, err := s.storage.Read(ctx, issuanceKey(domain))
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			if err := json.Unmarshal(data, &records); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	since := time.Now().Add(-s.limits.Window)
+	current := []IssuanceRecord{}
+	for _, record := range records {
+		if record.Time.After(since) {
+			current = append(current, record)
+		}
+	}
+	sort.Slice(current, func(i, j int) bool { return current[i].Time.Before(current[j].Time) })
+
+	s.history[domain] = current
+	return current, nil
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a, b = append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// jitter is the part of the jitter a renewal waits, the same in every run
+// for the same certificate.
+func (s *IssuanceSchedule) jitter(names []string, notAfter time.Time) time.Duration {
+	if s.limits.Jitter <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(names, ",") + "@" + notAfter.UTC().Format(time.RFC3339)))
+	return time.Duration(h.Sum64() % uint64(s.limits.Jitter))
+}
+
+// Allow reports by a DeferredError whether the names are held back, notAfter
+// is the expiry of the current certificate, zero for a new one. New and
+// urgent certificates are only held back by the limits themselves.
+func (s *IssuanceSchedule) Allow(ctx context.Context, names []string, notAfter time.Time) error {
+	now := time.Now()
+	commonName := names[0]
+	domain := RegisteredDomain(commonName)
+	urgent := notAfter.IsZero() || notAfter.Sub(now) <= s.limits.Urgent
+
+	deferTo := func(reason string, until time.Time) error {
+		if s.deferred[domain] == nil {
+			s.deferred[domain] = make(map[string]bool)
+		}
+		s.deferred[domain][commonName] = true
+		return &DeferredError{CommonName: commonName, Reason: reason, Until: until}
+	}
+
+	if !urgent {
+		if due := notAfter.Add(-renewBefore).Add(s.jitter(names, notAfter)); now.Before(due) {
+			return deferTo("renewals are spread out", due)
+		}
+	}
+
+	records, err := s.records(ctx, domain)
+	if err != nil {
+		return fmt.Errorf("load issuance history of %s failed: %v", domain, err)
+	}
+
+	// the limits free up as the issuances leave the window
+	freeAt := func(i int) time.Time {
+		return records[i].Time.Add(s.limits.Window)
+	}
+
+	if s.limits.PerDomain > 0 {
+		if len(records) >= s.limits.PerDomain {
+			return deferTo(fmt.Sprintf("%d certificates of %s in %s", len(records), domain, s.limits.Window), freeAt(len(records)-s.limits.PerDomain))
+		}
+
+		if !urgent && len(records) >= s.limits.PerDomain-s.limits.Reserve {
+			return deferTo(fmt.Sprintf("only the reserve of %s is left for urgent renewals", domain), freeAt(len(records)-s.limits.PerDomain+s.limits.Reserve))
+		}
+	}
+
+	if s.limits.Duplicates > 0 {
+		duplicates := []int{}
+		for i, record := range records {
+			if sameNames(record.Names, names) {
+				duplicates = append(duplicates, i)
+			}
+		}
+		if len(duplicates) >= s.limits.Duplicates {
+			return deferTo(fmt.Sprintf("%d duplicate certificates in %s", len(duplicates), s.limits.Window), freeAt(duplicates[len(duplicates)-s.limits.Duplicates]))
+		}
+	}
+
+	return nil
+}
+
+// Record adds an issuance of the names to the history.
+func (s *IssuanceSchedule) Record(ctx context.Context, names []string) error {
+	domain := RegisteredDomain(names[0])
+
+	records, err := s.records(ctx, domain)
+	if err != nil {
+		return err
+	}
+
+	records = append(records, IssuanceRecord{Time: time.Now(), Names: names})
+	s.history[domain] = records
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	return s.storage.Write(ctx, issuanceKey(domain), data)
+}
+
+// Budget returns the projected use of the limits of the registered domains
+// seen so far.
+func (s *IssuanceSchedule) Budget() []IssuanceBudget {
+	budgets := []IssuanceBudget{}
+	for domain, records := range s.history {
+		budget := IssuanceBudget{Domain: domain, Used: len(records), Limit: s.limits.PerDomain, Deferred: len(s.deferred[domain])}
+		if len(records) > 0 {
+			budget.Next = records[0].Time.Add(s.limits.Window)
+		}
+		budgets = append(budgets, budget)
+	}
+	sort.Slice(budgets, func(i, j int) bool { return budgets[i].Domain < budgets[j].Domain })
+
+	return budgets
+}
+
+// issue obtains a certificate within the schedule of the issuer, notAfter is
+// the expiry of the current certificate.
+func (m *CertManager) issue(ctx context.Context, commonName string, notAfter time.Time, obtain func(issuer Issuer) (*Certificate, error)) (*Certificate, error) {
+	issuer := m.Issuer(commonName)
+	names := []string{commonName}
+
+	schedule := m.schedules[issuer.Name()]
+	if schedule != nil {
+		if err := schedule.Allow(ctx, names, notAfter); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := obtain(issuer)
+	if err != nil {
+		return nil, &IssuanceError{CommonName: commonName, Issuer: issuer.Name(), Err: err}
+	}
+
+	if schedule != nil {
+		if err := schedule.Record(ctx, names); err != nil {
+			log.Printf("record issuance of %s failed: %v", commonName, err)
+		}
+	}
+
+	return cert, nil
+}
+
+// SetIssuanceSchedule applies the schedule to the certificates of the issuer.
+func (m *CertManager) SetIssuanceSchedule(issuerName string, schedule *IssuanceSchedule) {
+	m.schedules[issuerName] = schedule
+}
+
+func (m *CertManager) IssuanceBudget() []IssuanceBudget {
+	budgets := []IssuanceBudget{}
+	for _, schedule := range m.schedules {
+		budgets = append(budgets, schedule.Budget()...)
+	}
+
+	return budgets
+}
@@ -0,0 +1,112 @@
+package cert_helper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegisteredDomain(t *testing.T) {
+	for name, want := range map[string]string{
+		"*.example.com":         "example.com",
+		"www.a.example.com":     "example.com",
+		"*.www.example.co.uk":   "example.co.uk",
+		"example.com":           "example.com",
+		"img.shop.example.cn":   "example.cn",
+		"static.example.com.cn": "example.com.cn",
+	} {
+		if domain := RegisteredDomain(name); domain != want {
+			t.Errorf("registered domain of %s is %s, expected %s", name, domain, want)
+		}
+	}
+}
+
+func TestIssuanceSchedule(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	limits := RateLimits{PerDomain: 3, Duplicates: 2, Window: 7 * 24 * time.Hour, Reserve: 1, Urgent: 3 * 24 * time.Hour}
+	schedule := NewIssuanceSchedule(memoryStorage{}, limits)
+
+	soon, later := now.Add(24*time.Hour), now.Add(5*24*time.Hour)
+	deferred := func(err error) bool {
+		var deferredErr *DeferredError
+		return errors.As(err, &deferredErr)
+	}
+
+	for _, name := range []string{"a.example.test", "b.example.test"} {
+		if err := schedule.Allow(ctx, []string{name}, later); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := schedule.Record(ctx, []string{name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the reserve is left, for urgent and new certificates
+	if err := schedule.Allow(ctx, []string{"c.example.test"}, later); !deferred(err) {
+		t.Errorf("expected c.example.test deferred, got %v", err)
+	}
+	if err := schedule.Allow(ctx, []string{"c.example.test"}, soon); err != nil {
+		t.Errorf("expected urgent c.example.test allowed, got %v", err)
+	}
+	if err := schedule.Allow(ctx, []string{"other.test"}, later); err != nil {
+		t.Errorf("expected other.test allowed, got %v", err)
+	}
+
+	// the limit holds back urgent certificates too, until the first leaves the window
+	schedule.Record(ctx, []string{"c.example.test"})
+	var deferredErr *DeferredError
+	if err := schedule.Allow(ctx, []string{"d.example.test"}, time.Time{}); !errors.As(err, &deferredErr) {
+		t.Fatalf("expected d.example.test deferred, got %v", err)
+	}
+	if first := schedule.history["example.test"][0].Time; !deferredErr.Until.Equal(first.Add(limits.Window)) {
+		t.Errorf("deferred until %s, expected %s", deferredErr.Until, first.Add(limits.Window))
+	}
+	// deferred again for another domain of it, counted once
+	schedule.Allow(ctx, []string{"d.example.test"}, time.Time{})
+
+	// duplicates
+	schedule.Record(ctx, []string{"other.test"})
+	schedule.Record(ctx, []string{"other.test"})
+	if err := schedule.Allow(ctx, []string{"other.test"}, soon); !deferred(err) {
+		t.Errorf("expected duplicate other.test deferred, got %v", err)
+	}
+
+	// the history is kept in storage
+	reloaded := NewIssuanceSchedule(schedule.storage, limits)
+	if records, err := reloaded.records(ctx, "example.test"); err != nil || len(records) != 3 {
+		t.Errorf("expected 3 records in storage, got %d: %v", len(records), err)
+	}
+
+	budget := schedule.Budget()
+	if len(budget) != 2 || budget[0].Domain != "example.test" || budget[0].Used != 3 || budget[0].Deferred != 2 {
+		t.Errorf("unexpected budget %+v", budget)
+	}
+}
+
+func TestIssuanceJitter(t *testing.T) {
+	ctx := context.Background()
+	limits := RateLimits{Window: 7 * 24 * time.Hour, Urgent: 3 * 24 * time.Hour, Jitter: 3 * 24 * time.Hour}
+	schedule := NewIssuanceSchedule(memoryStorage{}, limits)
+
+	// due right now without jitter, so it waits for its part of the jitter
+	notAfter := time.Now().Add(renewBefore)
+	for _, name := range []string{"a.example.test", "b.example.test", "c.example.test"} {
+		var deferredErr *DeferredError
+		err := schedule.Allow(ctx, []string{name}, notAfter)
+		if err != nil && !errors.As(err, &deferredErr) {
+			t.Fatal(err)
+		}
+		if err == nil {
+			continue
+		}
+
+		if deferredErr.Until.After(notAfter.Add(-renewBefore + limits.Jitter)) {
+			t.Errorf("%s deferred until %s, beyond the jitter", name, deferredErr.Until)
+		}
+		if again := schedule.Allow(ctx, []string{name}, notAfter); again == nil || again.Error() != err.Error() {
+			t.Errorf("jitter of %s is not stable: %v, %v", name, err, again)
+		}
+	}
+}
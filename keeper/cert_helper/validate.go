@@ -0,0 +1,195 @@
+package cert_helper
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ValidationError lists every problem found in a certificate.
+type ValidationError struct {
+	CommonName string
+	Problems   []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid certificate %s: %s", e.CommonName, strings.Join(e.Problems, "; "))
+}
+
+func (e *ValidationError) addf(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// decodePEM decodes the blocks of data, all of the given types and without
+// anything else but whitespace around them.
+func decodePEM(data []byte, types ...string) ([]*pem.Block, error) {
+	blocks := []*pem.Block{}
+
+	rest := bytes.TrimSpace(data)
+	for len(rest) > 0 {
+		block, next := pem.Decode(rest)
+		if block == nil {
+			return nil, fmt.Errorf("unexpected data after %d blocks", len(blocks))
+		}
+
+		known := false
+		for _, t := range types {
+			known = known || block.Type == t
+		}
+		if !known {
+			return nil, fmt.Errorf("unexpected %s block", block.Type)
+		}
+
+		blocks = append(blocks, block)
+		rest = bytes.TrimSpace(next)
+	}
+
+	return blocks, nil
+}
+
+// AddTrustedRoots trusts the PEM root certificates besides the system ones,
+// e.g. the local ca or the roots of a staging acme directory.
+func (m *CertManager) AddTrustedRoots(pemCerts []byte) error {
+	if m.roots == nil {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		m.roots = roots
+	}
+
+	if !m.roots.AppendCertsFromPEM(pemCerts) {
+		return fmt.Errorf("no certificate found in trusted roots")
+	}
+
+	return nil
+}
+
+// validateMaterial checks the PEM material of a certificate before it is
+// uploaded or bound, domain is skipped when empty.
+func validateMaterial(cert *Certificate, domain string, roots *x509.CertPool, now time.Time) error {
+	verr := &ValidationError{CommonName: cert.CommonName}
+
+	certBlocks, err := decodePEM(cert.Certificate, "CERTIFICATE")
+	if err != nil {
+		verr.addf("certificate: %v", err)
+	} else if len(certBlocks) != 1 {
+		verr.addf("certificate: %d blocks, expected 1", len(certBlocks))
+	}
+
+	chainBlocks, err := decodePEM(cert.IssuerCertificate, "CERTIFICATE")
+	if err != nil {
+		verr.addf("chain: %v", err)
+	}
+
+	keyBlocks, err := decodePEM(cert.PrivateKey, "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY")
+	if err != nil {
+		verr.addf("private key: %v", err)
+	} else if len(keyBlocks) != 1 {
+		verr.addf("private key: %d blocks, expected 1", len(keyBlocks))
+	}
+
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+
+	leaf, err := x509.ParseCertificate(certBlocks[0].Bytes)
+	if err != nil {
+		verr.addf("certificate: %v", err)
+		return verr
+	}
+
+	if _, err := tls.X509KeyPair(cert.Certificate, cert.PrivateKey); err != nil {
+		verr.addf("private key does not match: %v", err)
+	}
+
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			verr.addf("rsa key of %d bits, at least 2048 required", key.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize < 256 {
+			verr.addf("ec key of %d bits, at least 256 required", key.Curve.Params().BitSize)
+		}
+	default:
+		verr.addf("unsupported %T public key", key)
+	}
+
+	if now.Before(leaf.NotBefore) {
+		verr.addf("not valid before %s", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		verr.addf("expired at %s", leaf.NotAfter)
+	}
+
+	if domain != "" {
+		if err := leaf.VerifyHostname(domain); err != nil {
+			verr.addf("does not cover %s", domain)
+		}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, block := range chainBlocks {
+		chainCert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			verr.addf("chain: %v", err)
+			continue
+		}
+		intermediates.AddCert(chainCert)
+	}
+
+	// expiry is reported above, verify the chain as of the validity period
+	verifyTime := now
+	if verifyTime.Before(leaf.NotBefore) || verifyTime.After(leaf.NotAfter) {
+		verifyTime = leaf.NotBefore
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         roots,
+		CurrentTime:   verifyTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		verr.addf("chain: %v", err)
+	}
+
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+
+	return nil
+}
+
+// ValidateCertificate checks a certificate before it is bound to the domain,
+// certificates only in cas are checked by their cas detail.
+func (m *CertManager) ValidateCertificate(ctx context.Context, cert *Certificate, domain string) error {
+	if cert.Certificate != nil {
+		return validateMaterial(cert, domain, m.roots, time.Now())
+	}
+
+	detail, err := m.DescribeCasCertificate(ctx, cert.CasCertificateId)
+	if err != nil {
+		return err
+	}
+
+	verr := &ValidationError{CommonName: cert.CommonName}
+	if detail.NotAfter.Before(time.Now()) {
+		verr.addf("expired at %s", detail.NotAfter)
+	}
+	if domain != "" && !detail.Covers(domain) {
+		verr.addf("does not cover %s", domain)
+	}
+
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+
+	return nil
+}
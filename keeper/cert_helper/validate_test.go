@@ -0,0 +1,59 @@
+package cert_helper
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateMaterial(t *testing.T) {
+	issuer, err := NewLocalCAIssuer(context.Background(), memoryStorage{}, "local-ca", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := issuer.Obtain(context.Background(), []string{"*.example.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := issuer.Obtain(context.Background(), []string{"*.example.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(issuer.CACertificate())
+
+	if err := validateMaterial(cert, "www.example.test", roots, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *Certificate)
+		domain  string
+		roots   *x509.CertPool
+		now     time.Time
+		problem string
+	}{
+		{"other domain", func(c *Certificate) {}, "www.other.test", roots, time.Now(), "does not cover"},
+		{"deeper domain", func(c *Certificate) {}, "a.www.example.test", roots, time.Now(), "does not cover"},
+		{"expired", func(c *Certificate) {}, "", roots, time.Now().Add(48 * time.Hour), "expired"},
+		{"untrusted", func(c *Certificate) {}, "", x509.NewCertPool(), time.Now(), "chain"},
+		{"other key", func(c *Certificate) { c.PrivateKey = other.PrivateKey }, "", roots, time.Now(), "does not match"},
+		{"trailing data", func(c *Certificate) { c.Certificate = append(c.Certificate, "garbage"...) }, "", roots, time.Now(), "unexpected data"},
+		{"key in chain", func(c *Certificate) { c.IssuerCertificate = c.PrivateKey }, "", roots, time.Now(), "unexpected RSA PRIVATE KEY block"},
+	}
+
+	for _, test := range tests {
+		modified := *cert
+		test.modify(&modified)
+
+		err := validateMaterial(&modified, test.domain, test.roots, test.now)
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.problem)
+		}
+	}
+}
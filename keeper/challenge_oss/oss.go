@@ -0,0 +1,196 @@
+package challenge_oss
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	cdn "github.com/alibabacloud-go/cdn-20180510/v4/client"
+	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent_cdn"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent_oss"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage_oss"
+	"github.com/go-acme/lego/v4/challenge/http01"
+)
+
+// HTTP01Domain selects HTTP-01 validation for a domain, the token is written
+// to the bucket behind it. Bucket and Region are discovered from the oss cname
+// bindings or the cdn origin when left empty.
+type HTTP01Domain struct {
+	Domain   string `mapstructure:"domain"`
+	Bucket   string `mapstructure:"bucket"`
+	Region   string `mapstructure:"region"`
+	PurgeCdn bool   `mapstructure:"purge-cdn"`
+}
+
+type HTTP01Provider struct {
+	aliConfig aliapi.Config
+	cdnAgent  *agent_cdn.CdnCertAgent
+	ossAgent  *agent_oss.OssCertAgent
+	domains   map[string]*HTTP01Domain
+
+	lock      sync.Mutex
+	buckets   map[string]storage_oss.Bucket
+	newBucket func(region, name string) (storage_oss.Bucket, error)
+}
+
+func NewHTTP01Provider(aliConfig aliapi.Config, cdnAgent *agent_cdn.CdnCertAgent, ossAgent *agent_oss.OssCertAgent, domains []HTTP01Domain) *HTTP01Provider {
+	p := &HTTP01Provider{
+		aliConfig: aliConfig,
+		cdnAgent:  cdnAgent,
+		ossAgent:  ossAgent,
+		domains:   make(map[string]*HTTP01Domain),
+		buckets:   make(map[string]storage_oss.Bucket),
+	}
+
+	for i := range domains {
+		p.domains[domains[i].Domain] = &domains[i]
+	}
+
+	return p
+}
+
+// NewHTTP01ProviderWithBuckets opens the buckets with newBucket instead of the
+// oss sdk.
+func NewHTTP01ProviderWithBuckets(cdnAgent *agent_cdn.CdnCertAgent, ossAgent *agent_oss.OssCertAgent, domains []HTTP01Domain, newBucket func(region, name string) (storage_oss.Bucket, error)) *HTTP01Provider {
+	p := NewHTTP01Provider(aliapi.Config{}, cdnAgent, ossAgent, domains)
+	p.newBucket = newBucket
+	return p
+}
+
+func (p *HTTP01Provider) Domains() []string {
+	domains := make([]string, 0, len(p.domains))
+	for domain := range p.domains {
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+func (p *HTTP01Provider) resolveOrigin(ctx context.Context, d *HTTP01Domain) error {
+	if d.Bucket != "" && d.Region != "" {
+		return nil
+	}
+
+	bucket, region, err := p.ossAgent.FindCnameBucket(ctx, d.Domain)
+	if err != nil {
+		bucket, region, err = p.cdnAgent.OssOrigin(ctx, d.Domain)
+	}
+	if err != nil {
+		return fmt.Errorf("no oss origin found for %s: %v", d.Domain, err)
+	}
+
+	log.Printf("http-01 challenge for %s goes to bucket %s (%s)", d.Domain, bucket, region)
+	d.Bucket, d.Region = bucket, region
+	return nil
+}
+
+func (p *HTTP01Provider) bucket(ctx context.Context, domain string) (storage_oss.Bucket, *HTTP01Domain, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	d, ok := p.domains[domain]
+	if !ok {
+		return nil, nil, fmt.Errorf("http-01 is not configured for %s", domain)
+	}
+
+	if err := p.resolveOrigin(ctx, d); err != nil {
+		return nil, nil, err
+	}
+
+	key := d.Region + "/" + d.Bucket
+	if bucket, ok := p.buckets[key]; ok {
+		return bucket, d, nil
+	}
+
+	newBucket := p.newBucket
+	if newBucket == nil {
+		newBucket = p.openBucket
+	}
+	bucket, err := newBucket(d.Region, d.Bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.buckets[key] = bucket
+	return bucket, d, nil
+}
+
+func (p *HTTP01Provider) openBucket(region, name string) (storage_oss.Bucket, error) {
+	aliConfig := p.aliConfig
+	aliConfig.RegionId = tea.String(region)
+	helper, err := storage_oss.NewOssBucketHelper(aliConfig, "", name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return helper.OssBucket, nil
+}
+
+// purge drops a cached 404 of the token path, in case the ca was ahead of the
+// token.
+func (p *HTTP01Provider) purge(ctx context.Context, domain, token string) {
+	err := retry.Default.Do(ctx, "cdn", "RefreshObjectCaches", func() error {
+		_, err := p.cdnAgent.CdnClient.RefreshObjectCaches(&cdn.RefreshObjectCachesRequest{
+			ObjectPath: tea.String("http://" + domain + http01.ChallengePath(token)),
+			ObjectType: tea.String("File"),
+		})
+		return err
+	})
+	if err != nil {
+		log.Printf("purge cdn cache of %s failed: %v", domain, err)
+	}
+}
+
+// Present and CleanUp are called by lego without a context, every call is
+// bounded by the api timeouts.
+func (p *HTTP01Provider) Present(domain, token, keyAuth string) error {
+	ctx := context.Background()
+
+	bucket, d, err := p.bucket(ctx, domain)
+	if err != nil {
+		return err
+	}
+
+	key := strings.TrimPrefix(http01.ChallengePath(token), "/")
+	err = retry.Default.Do(ctx, "oss", "PutObject", func() error {
+		return bucket.PutObject(key, bytes.NewReader([]byte(keyAuth)),
+			oss.ObjectACL(oss.ACLPublicRead),
+			oss.ContentType("text/plain"),
+			oss.WithContext(ctx),
+		)
+	})
+	if err != nil {
+		return fmt.Errorf("write http-01 token to bucket %s failed: %v", d.Bucket, err)
+	}
+
+	if d.PurgeCdn {
+		p.purge(ctx, domain, token)
+	}
+
+	return nil
+}
+
+func (p *HTTP01Provider) CleanUp(domain, token, keyAuth string) error {
+	ctx := context.Background()
+
+	bucket, d, err := p.bucket(ctx, domain)
+	if err != nil {
+		return err
+	}
+
+	key := strings.TrimPrefix(http01.ChallengePath(token), "/")
+	err = retry.Default.Do(ctx, "oss", "DeleteObject", func() error {
+		return bucket.DeleteObject(key, oss.WithContext(ctx))
+	})
+	if err != nil {
+		return fmt.Errorf("delete http-01 token from bucket %s failed: %v", d.Bucket, err)
+	}
+
+	return nil
+}
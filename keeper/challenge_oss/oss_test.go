@@ -0,0 +1,67 @@
+package challenge_oss
+
+import (
+	"testing"
+
+	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent_cdn"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent_oss"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/fake_cloud"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage_oss"
+)
+
+func TestHTTP01Provider(t *testing.T) {
+	c := fake_cloud.New()
+	c.AddBucket("assets", "cn-hangzhou")
+	c.AddBucketCname("assets", "img.example.test", 0)
+	c.AddBucket("site", "cn-shanghai")
+	c.AddCdnDomain("www.example.test", 0)
+	c.SetCdnOrigin("www.example.test", "site.oss-cn-shanghai.aliyuncs.com")
+
+	opened := map[string]string{}
+	p := NewHTTP01ProviderWithBuckets(
+		agent_cdn.NewCdnCertAgentWithClient(c.Cdn(), "", ""),
+		agent_oss.NewOssCertAgentWithClient(aliapi.Config{RegionId: tea.String("cn-hangzhou")}, c.Oss()),
+		[]HTTP01Domain{{Domain: "img.example.test"}, {Domain: "www.example.test", PurgeCdn: true}},
+		func(region, name string) (storage_oss.Bucket, error) {
+			opened[name] = region
+			return c.Bucket(name), nil
+		},
+	)
+
+	tests := []struct {
+		domain, bucket, region string
+		purges                 int
+	}{
+		{"img.example.test", "assets", "cn-hangzhou", 0}, // by the oss cname
+		{"www.example.test", "site", "cn-shanghai", 1},   // by the cdn origin
+	}
+
+	for _, test := range tests {
+		if err := p.Present(test.domain, "token", "token.key"); err != nil {
+			t.Fatal(err)
+		}
+		if opened[test.bucket] != test.region {
+			t.Errorf("%s: bucket %s opened in region %q", test.domain, test.bucket, opened[test.bucket])
+		}
+		if data := c.Bucket(test.bucket).Object(".well-known/acme-challenge/token"); string(data) != "token.key" {
+			t.Errorf("%s: token is %q", test.domain, data)
+		}
+
+		// the cache is purged when the token is written, not when removed
+		if err := p.CleanUp(test.domain, "token", "token.key"); err != nil {
+			t.Fatal(err)
+		}
+		if data := c.Bucket(test.bucket).Object(".well-known/acme-challenge/token"); data != nil {
+			t.Errorf("%s: token is left in the bucket", test.domain)
+		}
+		if calls := c.Calls("RefreshObjectCaches"); calls != test.purges {
+			t.Errorf("%s: expected %d purges, got %d", test.domain, test.purges, calls)
+		}
+	}
+
+	if err := p.Present("other.example.test", "token", "token.key"); err == nil {
+		t.Error("expected a domain without http-01 rejected")
+	}
+}
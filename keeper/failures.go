@@ -0,0 +1,199 @@
+package keeper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+)
+
+const failuresKey = "failures.json"
+
+// FailureRecord is the issuance failures in a row of a common name.
+type FailureRecord struct {
+	Attempts int       `json:"attempts"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	Error    string    `json:"error"`
+}
+
+// BackoffPolicy spaces out the runs retrying a common name that failed to
+// issue, so failed validations don't burn the rate limits of the issuer.
+type BackoffPolicy struct {
+	// Base is the wait after the first failure, doubled on every failure.
+	Base time.Duration
+	Max  time.Duration
+	// StuckAfter failures in a row the common name is reported as stuck, 0
+	// to never report.
+	StuckAfter int
+}
+
+func (p BackoffPolicy) delay(attempts int) time.Duration {
+	if p.Base <= 0 || attempts <= 0 {
+		return 0
+	}
+
+	delay := p.Base
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if p.Max > 0 && delay >= p.Max {
+			return p.Max
+		}
+	}
+
+	return delay
+}
+
+func (p BackoffPolicy) stuck(record *FailureRecord) bool {
+	return p.StuckAfter > 0 && record.Attempts >= p.StuckAfter
+}
+
+// BackoffError is returned for a common name waiting to be retried.
+type BackoffError struct {
+	CommonName string
+	Attempts   int
+	RetryAt    time.Time
+}
+
+func (e *BackoffError) Error() string {
+	return fmt.Sprintf("%s failed %d times, retried after %s", e.CommonName, e.Attempts, e.RetryAt.Format(time.RFC3339))
+}
+
+func (k *Keeper) LoadFailures(ctx context.Context) (map[string]*FailureRecord, error) {
+	failures := make(map[string]*FailureRecord)
+
+	data, err := k.Storage.Read(ctx, failuresKey)
+	if err != nil || data == nil {
+		return failures, err
+	}
+
+	if err := json.Unmarshal(data, &failures); err != nil {
+		return nil, err
+	}
+
+	return failures, nil
+}
+
+func (k *Keeper) saveFailures(ctx context.Context, failures map[string]*FailureRecord) error {
+	data, err := json.Marshal(failures)
+	if err != nil {
+		return err
+	}
+
+	return k.Storage.Write(ctx, failuresKey, data)
+}
+
+// ResetFailures clears the failures of the common names, of all of them when
+// none is given, so the next run retries them right away.
+func (k *Keeper) ResetFailures(ctx context.Context, commonNames []string) ([]string, error) {
+	failures, err := k.LoadFailures(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reset := []string{}
+	for commonName := range failures {
+		if len(commonNames) == 0 || contains(commonNames, commonName) {
+			reset = append(reset, commonName)
+			delete(failures, commonName)
+		}
+	}
+	sort.Strings(reset)
+
+	return reset, k.saveFailures(ctx, failures)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// issuanceFailed tells whether the error is a failure of the issuer itself.
+// Failures of cas or storage, and issuances cut short by the end of the run,
+// are not backed off.
+func issuanceFailed(ctx context.Context, err error) bool {
+	var issuanceErr *cert_helper.IssuanceError
+
+	return errors.As(err, &issuanceErr) && ctx.Err() == nil &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// certificate returns the certificate of the common name, unless it is in
+// backoff after failures in earlier runs. The outcome is recorded while a
+// run is going on, only failures of the issuer count.
+func (k *Keeper) certificate(ctx context.Context, commonName string) (*cert_helper.Certificate, error) {
+	if k.failures == nil {
+		return k.CertManager.GetCertificate(ctx, commonName)
+	}
+
+	record := k.failures[commonName]
+	if record != nil {
+		retryAt := record.Last.Add(k.Backoff.delay(record.Attempts))
+		if time.Now().Before(retryAt) {
+			return nil, &BackoffError{CommonName: commonName, Attempts: record.Attempts, RetryAt: retryAt}
+		}
+	}
+
+	cert, err := k.CertManager.GetCertificate(ctx, commonName)
+	if (err == nil && record == nil) || (err != nil && !issuanceFailed(ctx, err)) {
+		return cert, err
+	}
+
+	if err != nil {
+		if record == nil {
+			record = &FailureRecord{First: time.Now()}
+			k.failures[commonName] = record
+		}
+		record.Attempts++
+		record.Last = time.Now()
+		record.Error = err.Error()
+	} else {
+		log.Printf("%s recovered after %d failures", commonName, record.Attempts)
+		delete(k.failures, commonName)
+	}
+
+	if err := k.saveFailures(context.WithoutCancel(ctx), k.failures); err != nil {
+		log.Printf("save failures failed: %v", err)
+	}
+
+	return cert, err
+}
+
+// loadRunFailures reads the failure records for the run, without storage
+// failures are neither recorded nor backed off.
+func (k *Keeper) loadRunFailures(ctx context.Context) {
+	if k.Storage == nil {
+		return
+	}
+
+	failures, err := k.LoadFailures(ctx)
+	if err != nil {
+		log.Printf("load failures failed, no backoff in this run: %v", err)
+		return
+	}
+
+	k.failures = failures
+}
+
+// reportStuck adds the common names failing for too long to the report.
+func (k *Keeper) reportStuck(report *Report) {
+	for commonName, record := range k.failures {
+		if k.Backoff.stuck(record) {
+			report.Stuck = append(report.Stuck, fmt.Sprintf("%s (%d failures since %s: %s)",
+				commonName, record.Attempts, record.First.Format(time.RFC3339), record.Error))
+		}
+	}
+	sort.Strings(report.Stuck)
+
+	k.failures = nil
+}
@@ -0,0 +1,405 @@
+package fake_cloud
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	cas "github.com/alibabacloud-go/cas-20200407/v2/client"
+	util "github.com/alibabacloud-go/tea-utils/v2/service"
+	"github.com/alibabacloud-go/tea/tea"
+)
+
+// CasClient implements cert_helper.CasClient. Certificate orders are issued
+// by the ca of the cloud once their dns validation record is added.
+type CasClient struct {
+	cloud *Cloud
+}
+
+func (c *Cloud) Cas() *CasClient {
+	return &CasClient{cloud: c}
+}
+
+func casError(code, message string) error {
+	return tea.NewSDKError(map[string]interface{}{
+		"code":       code,
+		"message":    message,
+		"statusCode": 400,
+	})
+}
+
+func (cert *Certificate) sans() string {
+	x509Cert := cert.X509Certificate()
+	if x509Cert == nil {
+		return ""
+	}
+
+	return strings.Join(x509Cert.DNSNames, ",")
+}
+
+func (cert *Certificate) fingerprint() string {
+	x509Cert := cert.X509Certificate()
+	if x509Cert == nil {
+		return ""
+	}
+
+	sum := sha1.Sum(x509Cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func (cert *Certificate) matches(keyword string) bool {
+	x509Cert := cert.X509Certificate()
+	if keyword == "" {
+		return true
+	}
+	if x509Cert == nil {
+		return false
+	}
+
+	return strings.Contains(x509Cert.Subject.CommonName, keyword) || strings.Contains(cert.sans(), keyword)
+}
+
+func (f *CasClient) ListUserCertificateOrder(request *cas.ListUserCertificateOrderRequest) (*cas.ListUserCertificateOrderResponse, error) {
+	return f.ListUserCertificateOrderWithOptions(request, &util.RuntimeOptions{})
+}
+
+func (f *CasClient) ListUserCertificateOrderWithOptions(request *cas.ListUserCertificateOrderRequest, runtime *util.RuntimeOptions) (*cas.ListUserCertificateOrderResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("ListUserCertificateOrder"); err != nil {
+		return nil, err
+	}
+
+	orderType := tea.StringValue(request.OrderType)
+	if orderType == "" {
+		orderType = "CPACK"
+	}
+
+	certs := []*Certificate{}
+	for _, cert := range c.certs {
+		if cert.OrderType != orderType || !cert.matches(tea.StringValue(request.Keyword)) {
+			continue
+		}
+		if status := tea.StringValue(request.Status); status != "" && status != cert.status() {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Id < certs[j].Id })
+
+	list := []*cas.ListUserCertificateOrderResponseBodyCertificateOrderList{}
+	for _, cert := range certs {
+		list = append(list, cert.order())
+	}
+
+	// orders of packages are listed before they are issued
+	if orderType == "CPACK" {
+		list = append(list, c.pendingOrders(tea.StringValue(request.Keyword), tea.StringValue(request.Status))...)
+	}
+
+	page, size := tea.Int64Value(request.CurrentPage), tea.Int64Value(request.ShowSize)
+	if page == 0 {
+		page = 1
+	}
+	if size == 0 {
+		size = 50
+	}
+
+	pageList := []*cas.ListUserCertificateOrderResponseBodyCertificateOrderList{}
+	for i := (page - 1) * size; i < page*size && i < int64(len(list)); i++ {
+		pageList = append(pageList, list[i])
+	}
+
+	return &cas.ListUserCertificateOrderResponse{Body: &cas.ListUserCertificateOrderResponseBody{
+		CertificateOrderList: pageList,
+		CurrentPage:          tea.Int64(page),
+		ShowSize:             tea.Int64(size),
+		TotalCount:           tea.Int64(int64(len(list))),
+	}}, nil
+}
+
+// pendingOrders lists the orders waiting for validation, as CHECKING.
+func (c *Cloud) pendingOrders(keyword, status string) []*cas.ListUserCertificateOrderResponseBodyCertificateOrderList {
+	if status != "" && status != "CHECKING" {
+		return nil
+	}
+
+	orders := []*order{}
+	for _, o := range c.orders {
+		if o.certId == 0 && strings.Contains(o.domain, keyword) {
+			orders = append(orders, o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].id < orders[j].id })
+
+	list := []*cas.ListUserCertificateOrderResponseBodyCertificateOrderList{}
+	for _, o := range orders {
+		list = append(list, &cas.ListUserCertificateOrderResponseBodyCertificateOrderList{
+			OrderId: tea.Int64(o.id),
+			Domain:  tea.String(o.domain),
+			Status:  tea.String("CHECKING"),
+		})
+	}
+
+	return list
+}
+
+func (cert *Certificate) status() string {
+	if x509Cert := cert.X509Certificate(); x509Cert != nil && x509Cert.NotAfter.Before(time.Now()) {
+		return "EXPIRED"
+	}
+
+	return "ISSUED"
+}
+
+func (cert *Certificate) order() *cas.ListUserCertificateOrderResponseBodyCertificateOrderList {
+	order := &cas.ListUserCertificateOrderResponseBodyCertificateOrderList{
+		CertificateId: tea.Int64(cert.Id),
+		Name:          tea.String(cert.Name),
+		Status:        tea.String(cert.status()),
+		Fingerprint:   tea.String(cert.fingerprint()),
+		Sans:          tea.String(cert.sans()),
+	}
+	if cert.OrderId != 0 {
+		order.OrderId = tea.Int64(cert.OrderId)
+	}
+
+	if x509Cert := cert.X509Certificate(); x509Cert != nil {
+		order.CommonName = tea.String(x509Cert.Subject.CommonName)
+		order.Domain = tea.String(x509Cert.Subject.CommonName)
+		order.Issuer = tea.String(x509Cert.Issuer.CommonName)
+		order.CertStartTime = tea.Int64(x509Cert.NotBefore.UnixMilli())
+		order.CertEndTime = tea.Int64(x509Cert.NotAfter.UnixMilli())
+		order.StartDate = tea.String(x509Cert.NotBefore.Format("2006-01-02"))
+		order.EndDate = tea.String(x509Cert.NotAfter.Format("2006-01-02"))
+	}
+
+	return order
+}
+
+func (f *CasClient) GetUserCertificateDetail(request *cas.GetUserCertificateDetailRequest) (*cas.GetUserCertificateDetailResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("GetUserCertificateDetail"); err != nil {
+		return nil, err
+	}
+
+	cert := c.certs[tea.Int64Value(request.CertId)]
+	if cert == nil {
+		return nil, casError("NotFound", fmt.Sprintf("certificate %d not found", tea.Int64Value(request.CertId)))
+	}
+
+	body := &cas.GetUserCertificateDetailResponseBody{
+		Id:          tea.Int64(cert.Id),
+		Name:        tea.String(cert.Name),
+		Fingerprint: tea.String(cert.fingerprint()),
+		Sans:        tea.String(cert.sans()),
+		Expired:     tea.Bool(cert.status() == "EXPIRED"),
+	}
+	if x509Cert := cert.X509Certificate(); x509Cert != nil {
+		body.Common = tea.String(x509Cert.Subject.CommonName)
+		body.Issuer = tea.String(x509Cert.Issuer.CommonName)
+		body.StartDate = tea.String(x509Cert.NotBefore.Format("2006-01-02"))
+		body.EndDate = tea.String(x509Cert.NotAfter.Format("2006-01-02"))
+	}
+	if !tea.BoolValue(request.CertFilter) {
+		body.Cert = tea.String(cert.Cert)
+		body.Key = tea.String(cert.Key)
+	}
+
+	return &cas.GetUserCertificateDetailResponse{Body: body}, nil
+}
+
+func (f *CasClient) UploadUserCertificate(request *cas.UploadUserCertificateRequest) (*cas.UploadUserCertificateResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("UploadUserCertificate"); err != nil {
+		return nil, err
+	}
+
+	name := tea.StringValue(request.Name)
+	if c.certificateByName(name) != nil {
+		return nil, casError("NameRepeat", "certificate name "+name+" already exists")
+	}
+
+	cert := &Certificate{Name: name, OrderType: "UPLOAD", Cert: tea.StringValue(request.Cert), Key: tea.StringValue(request.Key)}
+	if cert.X509Certificate() == nil {
+		return nil, casError("InvalidCertificate", "certificate of "+name+" cannot be parsed")
+	}
+
+	certId := c.addCertificate(cert)
+	if err := c.took("UploadUserCertificate"); err != nil {
+		return nil, err
+	}
+
+	return &cas.UploadUserCertificateResponse{Body: &cas.UploadUserCertificateResponseBody{CertId: tea.Int64(certId)}}, nil
+}
+
+// DeleteUserCertificate refuses certificates bound to a domain, like cas does.
+func (f *CasClient) DeleteUserCertificate(request *cas.DeleteUserCertificateRequest) (*cas.DeleteUserCertificateResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("DeleteUserCertificate"); err != nil {
+		return nil, err
+	}
+
+	certId := tea.Int64Value(request.CertId)
+	if c.certs[certId] == nil {
+		return nil, casError("NotFound", fmt.Sprintf("certificate %d not found", certId))
+	}
+	if c.bound(certId) {
+		return nil, casError("CertificateInUse", fmt.Sprintf("certificate %d is in use", certId))
+	}
+
+	delete(c.certs, certId)
+	return &cas.DeleteUserCertificateResponse{Body: &cas.DeleteUserCertificateResponseBody{}}, nil
+}
+
+func (f *CasClient) CreateCertificateForPackageRequest(request *cas.CreateCertificateForPackageRequestRequest) (*cas.CreateCertificateForPackageRequestResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("CreateCertificateForPackageRequest"); err != nil {
+		return nil, err
+	}
+
+	domain := tea.StringValue(request.Domain)
+	if domain == "" {
+		return nil, casError("InvalidDomain", "domain is required")
+	}
+
+	o := &order{
+		id:     c.id(),
+		domain: domain,
+		csr:    tea.StringValue(request.Csr),
+		token:  fmt.Sprintf("fake-token-%d", c.nextId),
+	}
+	c.orders[o.id] = o
+	if err := c.took("CreateCertificateForPackageRequest"); err != nil {
+		return nil, err
+	}
+
+	return &cas.CreateCertificateForPackageRequestResponse{Body: &cas.CreateCertificateForPackageRequestResponseBody{OrderId: tea.Int64(o.id)}}, nil
+}
+
+func (o *order) recordDomain() string {
+	return "_dnsauth." + strings.TrimPrefix(o.domain, "*.")
+}
+
+func (f *CasClient) DescribeCertificateState(request *cas.DescribeCertificateStateRequest) (*cas.DescribeCertificateStateResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("DescribeCertificateState"); err != nil {
+		return nil, err
+	}
+
+	o := c.orders[tea.Int64Value(request.OrderId)]
+	if o == nil {
+		return nil, casError("NotFound", fmt.Sprintf("order %d not found", tea.Int64Value(request.OrderId)))
+	}
+
+	if o.certId == 0 && c.validated(o) {
+		if err := c.issue(o); err != nil {
+			return nil, err
+		}
+	}
+
+	body := &cas.DescribeCertificateStateResponseBody{}
+	if cert := c.certs[o.certId]; cert != nil {
+		body.Type = tea.String("certificate")
+		body.Domain = tea.String(o.domain)
+		body.Certificate = tea.String(cert.Cert)
+		body.PrivateKey = tea.String(cert.Key)
+	} else {
+		body.Type = tea.String("domain_verify")
+		body.ValidateType = tea.String("DNS")
+		body.Domain = tea.String(o.domain)
+		body.RecordDomain = tea.String(o.recordDomain())
+		body.RecordType = tea.String("TXT")
+		body.RecordValue = tea.String(o.token)
+	}
+
+	return &cas.DescribeCertificateStateResponse{Body: body}, nil
+}
+
+func (c *Cloud) validated(o *order) bool {
+	for _, r := range c.records {
+		if r.fqdn == o.recordDomain() && r.typ == "TXT" && r.value == o.token {
+			return true
+		}
+	}
+
+	return false
+}
+
+// issue signs the certificate of the order with the key of its csr, or with a
+// new key when it came without one.
+func (c *Cloud) issue(o *order) error {
+	if err := c.ensureCA(); err != nil {
+		return err
+	}
+
+	var publicKey crypto.PublicKey
+	keyPem := ""
+	if block, _ := pem.Decode([]byte(o.csr)); block != nil {
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return casError("InvalidCsr", err.Error())
+		}
+		publicKey = csr.PublicKey
+	} else {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		publicKey = &key.PublicKey
+		keyPem = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(o.id),
+		Subject:      pkix.Name{CommonName: o.domain},
+		DNSNames:     []string{o.domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 3, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, c.caCert, publicKey, c.caKey)
+	if err != nil {
+		return err
+	}
+
+	certPem := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) + string(c.caPem)
+	o.certId = c.addCertificate(&Certificate{
+		Name:      fmt.Sprintf("cert-%d", o.id),
+		OrderType: "CPACK",
+		OrderId:   o.id,
+		Cert:      certPem,
+		Key:       keyPem,
+	})
+
+	return nil
+}
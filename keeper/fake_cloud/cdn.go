@@ -0,0 +1,169 @@
+package fake_cloud
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	cdn "github.com/alibabacloud-go/cdn-20180510/v4/client"
+	"github.com/alibabacloud-go/tea/tea"
+)
+
+// CdnClient implements agent_cdn.CdnClient.
+type CdnClient struct {
+	cloud *Cloud
+}
+
+func (c *Cloud) Cdn() *CdnClient {
+	return &CdnClient{cloud: c}
+}
+
+func notFound(code, message string) error {
+	return tea.NewSDKError(map[string]interface{}{
+		"code":       code,
+		"message":    message,
+		"statusCode": 404,
+	})
+}
+
+func (f *CdnClient) DescribeUserDomains(request *cdn.DescribeUserDomainsRequest) (*cdn.DescribeUserDomainsResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("DescribeUserDomains"); err != nil {
+		return nil, err
+	}
+
+	domains := make([]string, 0, len(c.cdn))
+	for domain := range c.cdn {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	pageSize, pageNumber := int64(tea.Int32Value(request.PageSize)), int64(tea.Int32Value(request.PageNumber))
+	if pageSize == 0 {
+		pageSize = 20
+	}
+	if pageNumber == 0 {
+		pageNumber = 1
+	}
+
+	pageData := []*cdn.DescribeUserDomainsResponseBodyDomainsPageData{}
+	for i := (pageNumber - 1) * pageSize; i < pageNumber*pageSize && i < int64(len(domains)); i++ {
+		pageData = append(pageData, &cdn.DescribeUserDomainsResponseBodyDomainsPageData{
+			DomainName:   tea.String(domains[i]),
+			DomainStatus: tea.String("online"),
+		})
+	}
+
+	return &cdn.DescribeUserDomainsResponse{Body: &cdn.DescribeUserDomainsResponseBody{
+		Domains:    &cdn.DescribeUserDomainsResponseBodyDomains{PageData: pageData},
+		PageNumber: tea.Int64(pageNumber),
+		PageSize:   tea.Int64(pageSize),
+		TotalCount: tea.Int64(int64(len(domains))),
+	}}, nil
+}
+
+func (f *CdnClient) DescribeDomainCertificateInfo(request *cdn.DescribeDomainCertificateInfoRequest) (*cdn.DescribeDomainCertificateInfoResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("DescribeDomainCertificateInfo"); err != nil {
+		return nil, err
+	}
+
+	domain := tea.StringValue(request.DomainName)
+	certId, ok := c.cdn[domain]
+	if !ok {
+		return nil, notFound("InvalidDomain.NotFound", "domain "+domain+" not found")
+	}
+
+	certInfos := &cdn.DescribeDomainCertificateInfoResponseBodyCertInfos{}
+	if cert := c.certs[certId]; cert != nil && cert.X509Certificate() != nil {
+		certInfos.CertInfo = append(certInfos.CertInfo, &cdn.DescribeDomainCertificateInfoResponseBodyCertInfosCertInfo{
+			DomainName:              tea.String(domain),
+			CertId:                  tea.String(strconv.FormatInt(cert.Id, 10)),
+			CertName:                tea.String(cert.Name),
+			CertExpireTime:          tea.String(cert.X509Certificate().NotAfter.UTC().Format(time.RFC3339)),
+			ServerCertificateStatus: tea.String("on"),
+		})
+	}
+
+	return &cdn.DescribeDomainCertificateInfoResponse{Body: &cdn.DescribeDomainCertificateInfoResponseBody{CertInfos: certInfos}}, nil
+}
+
+func (f *CdnClient) DescribeCdnDomainDetail(request *cdn.DescribeCdnDomainDetailRequest) (*cdn.DescribeCdnDomainDetailResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("DescribeCdnDomainDetail"); err != nil {
+		return nil, err
+	}
+
+	domain := tea.StringValue(request.DomainName)
+	if _, ok := c.cdn[domain]; !ok {
+		return nil, notFound("InvalidDomain.NotFound", "domain "+domain+" not found")
+	}
+
+	sources := &cdn.DescribeCdnDomainDetailResponseBodyGetDomainDetailModelSourceModels{}
+	if origin, ok := c.origins[domain]; ok {
+		sources.SourceModel = append(sources.SourceModel, &cdn.DescribeCdnDomainDetailResponseBodyGetDomainDetailModelSourceModelsSourceModel{
+			Type:    tea.String("oss"),
+			Content: tea.String(origin),
+		})
+	}
+
+	return &cdn.DescribeCdnDomainDetailResponse{Body: &cdn.DescribeCdnDomainDetailResponseBody{
+		GetDomainDetailModel: &cdn.DescribeCdnDomainDetailResponseBodyGetDomainDetailModel{
+			DomainName:   tea.String(domain),
+			SourceModels: sources,
+		},
+	}}, nil
+}
+
+func (f *CdnClient) SetCdnDomainSSLCertificate(request *cdn.SetCdnDomainSSLCertificateRequest) (*cdn.SetCdnDomainSSLCertificateResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("SetCdnDomainSSLCertificate"); err != nil {
+		return nil, err
+	}
+
+	domain := tea.StringValue(request.DomainName)
+	if _, ok := c.cdn[domain]; !ok {
+		return nil, notFound("InvalidDomain.NotFound", "domain "+domain+" not found")
+	}
+
+	if tea.StringValue(request.SSLProtocol) == "off" {
+		c.cdn[domain] = 0
+		return &cdn.SetCdnDomainSSLCertificateResponse{Body: &cdn.SetCdnDomainSSLCertificateResponseBody{}}, nil
+	}
+
+	// cas certificates are bound by id, or by name without one
+	cert := c.certs[tea.Int64Value(request.CertId)]
+	if cert == nil {
+		cert = c.certificateByName(tea.StringValue(request.CertName))
+	}
+	if cert == nil {
+		return nil, notFound("Certificate.NotFound", "certificate not found")
+	}
+
+	c.cdn[domain] = cert.Id
+	return &cdn.SetCdnDomainSSLCertificateResponse{Body: &cdn.SetCdnDomainSSLCertificateResponseBody{}}, nil
+}
+
+func (f *CdnClient) RefreshObjectCaches(request *cdn.RefreshObjectCachesRequest) (*cdn.RefreshObjectCachesResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("RefreshObjectCaches"); err != nil {
+		return nil, err
+	}
+
+	return &cdn.RefreshObjectCachesResponse{Body: &cdn.RefreshObjectCachesResponseBody{}}, nil
+}
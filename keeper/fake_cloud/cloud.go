@@ -0,0 +1,339 @@
+// Package fake_cloud is an in-memory stand-in for the aliyun apis the keeper
+// calls, for tests. Cas, cdn, live, oss and alidns share one state, so a
+// certificate uploaded to cas can be bound to cdn, oss and live domains.
+package fake_cloud
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Certificate is a certificate in cas.
+type Certificate struct {
+	Id   int64
+	Name string
+	// OrderType is BUY for purchased, UPLOAD for uploaded and CPACK for
+	// ordered with a certificate package.
+	OrderType string
+	OrderId   int64
+	Cert      string
+	Key       string
+
+	x509 *x509.Certificate
+}
+
+func (c *Certificate) X509Certificate() *x509.Certificate {
+	if c.x509 == nil {
+		if block, _ := pem.Decode([]byte(c.Cert)); block != nil {
+			c.x509, _ = x509.ParseCertificate(block.Bytes)
+		}
+	}
+
+	return c.x509
+}
+
+type bucket struct {
+	region  string
+	cnames  map[string]int64
+	objects map[string][]byte
+}
+
+type record struct {
+	fqdn  string
+	typ   string
+	value string
+}
+
+type order struct {
+	id     int64
+	domain string
+	csr    string
+	token  string
+	certId int64
+}
+
+// Cloud is the state behind the fake clients. Bindings are kept by cas
+// certificate id, 0 is unbound.
+type Cloud struct {
+	mu     sync.Mutex
+	nextId int64
+
+	certs   map[int64]*Certificate
+	cdn     map[string]int64
+	origins map[string]string
+	live    map[string]int64
+	buckets map[string]*bucket
+	records map[string]*record
+	orders  map[int64]*order
+
+	failures map[string]error
+	after    map[string]error
+	calls    map[string]int
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+	caPem  []byte
+}
+
+func New() *Cloud {
+	return &Cloud{
+		nextId:   1000,
+		certs:    make(map[int64]*Certificate),
+		cdn:      make(map[string]int64),
+		origins:  make(map[string]string),
+		live:     make(map[string]int64),
+		buckets:  make(map[string]*bucket),
+		records:  make(map[string]*record),
+		orders:   make(map[int64]*order),
+		failures: make(map[string]error),
+		after:    make(map[string]error),
+		calls:    make(map[string]int),
+	}
+}
+
+func (c *Cloud) id() int64 {
+	c.nextId++
+	return c.nextId
+}
+
+// call counts a call of the api and returns the failure set for it, the
+// lock is held by the caller.
+func (c *Cloud) call(api string) error {
+	c.calls[api]++
+	return c.failures[api]
+}
+
+// Fail makes every call of the api fail with err, nil lets it succeed again.
+func (c *Cloud) Fail(api string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		delete(c.failures, api)
+	} else {
+		c.failures[api] = err
+	}
+}
+
+// FailAfter makes the next call of the api take effect and still fail with
+// err, like a create timing out on its way back.
+func (c *Cloud) FailAfter(api string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.after[api] = err
+}
+
+// took returns the failure set by FailAfter once the call took effect, the
+// lock is held by the caller.
+func (c *Cloud) took(api string) error {
+	err := c.after[api]
+	delete(c.after, api)
+	return err
+}
+
+// Calls returns the number of calls of the api.
+func (c *Cloud) Calls(api string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.calls[api]
+}
+
+func (c *Cloud) addCertificate(cert *Certificate) int64 {
+	cert.Id = c.id()
+	c.certs[cert.Id] = cert
+	return cert.Id
+}
+
+// AddCertificate puts a certificate into cas, purchased or uploaded.
+func (c *Cloud) AddCertificate(name string, certPEM, keyPEM []byte, purchased bool) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	orderType := "UPLOAD"
+	if purchased {
+		orderType = "BUY"
+	}
+
+	return c.addCertificate(&Certificate{Name: name, OrderType: orderType, Cert: string(certPEM), Key: string(keyPEM)})
+}
+
+// Certificate returns the cas certificate, nil if there is none.
+func (c *Cloud) Certificate(id int64) *Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.certs[id]
+}
+
+// Certificates returns every cas certificate by id.
+func (c *Cloud) Certificates() []*Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	certs := make([]*Certificate, 0, len(c.certs))
+	for _, cert := range c.certs {
+		certs = append(certs, cert)
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Id < certs[j].Id })
+
+	return certs
+}
+
+func (c *Cloud) certificateByName(name string) *Certificate {
+	for _, cert := range c.certs {
+		if cert.Name == name {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+// bound reports whether a domain of any service is bound to the certificate.
+func (c *Cloud) bound(id int64) bool {
+	for _, bindings := range []map[string]int64{c.cdn, c.live} {
+		for _, certId := range bindings {
+			if certId == id {
+				return true
+			}
+		}
+	}
+
+	for _, b := range c.buckets {
+		for _, certId := range b.cnames {
+			if certId == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c *Cloud) AddCdnDomain(domain string, certId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cdn[domain] = certId
+}
+
+// SetCdnOrigin sets the oss origin of a cdn domain, like
+// bucket.oss-cn-hangzhou.aliyuncs.com.
+func (c *Cloud) SetCdnOrigin(domain, origin string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.origins[domain] = origin
+}
+
+func (c *Cloud) CdnBinding(domain string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cdn[domain]
+}
+
+func (c *Cloud) AddLiveDomain(domain string, certId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.live[domain] = certId
+}
+
+func (c *Cloud) LiveBinding(domain string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.live[domain]
+}
+
+func (c *Cloud) AddBucket(name, region string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.buckets[name]; !ok {
+		c.buckets[name] = &bucket{region: region, cnames: make(map[string]int64), objects: make(map[string][]byte)}
+	}
+}
+
+// AddBucketCname binds the domain to an existing bucket as cname.
+func (c *Cloud) AddBucketCname(bucketName, domain string, certId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buckets[bucketName].cnames[domain] = certId
+}
+
+func (c *Cloud) OssBinding(bucketName, domain string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.buckets[bucketName].cnames[domain]
+}
+
+// Record returns the value of a dns record added through alidns.
+func (c *Cloud) Record(fqdn, typ string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, r := range c.records {
+		if r.fqdn == fqdn && r.typ == typ {
+			return r.value, true
+		}
+	}
+
+	return "", false
+}
+
+// CACertificate is the root of the certificates issued for cas orders.
+func (c *Cloud) CACertificate() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.ensureCA(); err != nil {
+		return nil
+	}
+
+	return c.caPem
+}
+
+func (c *Cloud) ensureCA() error {
+	if c.caCert != nil {
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake cas ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	c.caKey = key
+	c.caCert, _ = x509.ParseCertificate(der)
+	c.caPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return nil
+}
@@ -0,0 +1,125 @@
+package fake_cloud
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/services/alidns"
+)
+
+// DnsClient implements cert_helper.DnsClient, the main domain of a name is
+// its last two labels.
+type DnsClient struct {
+	cloud *Cloud
+}
+
+func (c *Cloud) Dns() *DnsClient {
+	return &DnsClient{cloud: c}
+}
+
+func (f *DnsClient) GetMainDomainName(request *alidns.GetMainDomainNameRequest) (*alidns.GetMainDomainNameResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("GetMainDomainName"); err != nil {
+		return nil, err
+	}
+
+	labels := strings.Split(strings.TrimSuffix(request.InputString, "."), ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("invalid domain name %s", request.InputString)
+	}
+
+	response := alidns.CreateGetMainDomainNameResponse()
+	response.DomainName = strings.Join(labels[len(labels)-2:], ".")
+	response.RR = strings.Join(labels[:len(labels)-2], ".")
+	return response, nil
+}
+
+func (f *DnsClient) AddDomainRecord(request *alidns.AddDomainRecordRequest) (*alidns.AddDomainRecordResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("AddDomainRecord"); err != nil {
+		return nil, err
+	}
+
+	fqdn := request.DomainName
+	if request.RR != "" && request.RR != "@" {
+		fqdn = request.RR + "." + fqdn
+	}
+
+	recordId := strconv.FormatInt(c.id(), 10)
+	c.records[recordId] = &record{fqdn: fqdn, typ: request.Type, value: request.Value}
+	if err := c.took("AddDomainRecord"); err != nil {
+		return nil, err
+	}
+
+	response := alidns.CreateAddDomainRecordResponse()
+	response.RecordId = recordId
+	return response, nil
+}
+
+func (f *DnsClient) DeleteDomainRecord(request *alidns.DeleteDomainRecordRequest) (*alidns.DeleteDomainRecordResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("DeleteDomainRecord"); err != nil {
+		return nil, err
+	}
+
+	if _, ok := c.records[request.RecordId]; !ok {
+		return nil, fmt.Errorf("domain record %s not found", request.RecordId)
+	}
+	delete(c.records, request.RecordId)
+
+	response := alidns.CreateDeleteDomainRecordResponse()
+	response.RecordId = request.RecordId
+	return response, nil
+}
+
+// DescribeDomainRecords lists the records of the domain matching the rr,
+// type and value keywords exactly.
+func (f *DnsClient) DescribeDomainRecords(request *alidns.DescribeDomainRecordsRequest) (*alidns.DescribeDomainRecordsResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("DescribeDomainRecords"); err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for recordId := range c.records {
+		ids = append(ids, recordId)
+	}
+	sort.Strings(ids)
+
+	response := alidns.CreateDescribeDomainRecordsResponse()
+	for _, recordId := range ids {
+		r := c.records[recordId]
+		rr := strings.TrimSuffix(strings.TrimSuffix(r.fqdn, request.DomainName), ".")
+		if !strings.HasSuffix(r.fqdn, request.DomainName) ||
+			(request.RRKeyWord != "" && rr != request.RRKeyWord) ||
+			(request.TypeKeyWord != "" && r.typ != request.TypeKeyWord) ||
+			(request.ValueKeyWord != "" && r.value != request.ValueKeyWord) {
+			continue
+		}
+
+		response.DomainRecords.Record = append(response.DomainRecords.Record, alidns.Record{
+			RecordId:   recordId,
+			DomainName: request.DomainName,
+			RR:         rr,
+			Type:       r.typ,
+			Value:      r.value,
+		})
+	}
+	response.TotalCount = int64(len(response.DomainRecords.Record))
+
+	return response, nil
+}
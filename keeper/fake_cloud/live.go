@@ -0,0 +1,113 @@
+package fake_cloud
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	live "github.com/aliyun/alibaba-cloud-sdk-go/services/live"
+)
+
+// LiveClient implements agent_live.LiveClient.
+type LiveClient struct {
+	cloud *Cloud
+}
+
+func (c *Cloud) Live() *LiveClient {
+	return &LiveClient{cloud: c}
+}
+
+func (f *LiveClient) DescribeLiveUserDomains(request *live.DescribeLiveUserDomainsRequest) (*live.DescribeLiveUserDomainsResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("DescribeLiveUserDomains"); err != nil {
+		return nil, err
+	}
+
+	domains := make([]string, 0, len(c.live))
+	for domain := range c.live {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	pageSize, _ := strconv.ParseInt(string(request.PageSize), 10, 64)
+	pageNumber, _ := strconv.ParseInt(string(request.PageNumber), 10, 64)
+	if pageSize == 0 {
+		pageSize = 20
+	}
+	if pageNumber == 0 {
+		pageNumber = 1
+	}
+
+	response := live.CreateDescribeLiveUserDomainsResponse()
+	response.PageNumber, response.PageSize, response.TotalCount = pageNumber, pageSize, int64(len(domains))
+	for i := (pageNumber - 1) * pageSize; i < pageNumber*pageSize && i < int64(len(domains)); i++ {
+		response.Domains.PageData = append(response.Domains.PageData, live.PageData{
+			DomainName:       domains[i],
+			LiveDomainStatus: "online",
+		})
+	}
+
+	return response, nil
+}
+
+func (f *LiveClient) DescribeLiveDomainCertificateInfo(request *live.DescribeLiveDomainCertificateInfoRequest) (*live.DescribeLiveDomainCertificateInfoResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("DescribeLiveDomainCertificateInfo"); err != nil {
+		return nil, err
+	}
+
+	certId, ok := c.live[request.DomainName]
+	if !ok {
+		return nil, fmt.Errorf("live domain %s not found", request.DomainName)
+	}
+
+	response := live.CreateDescribeLiveDomainCertificateInfoResponse()
+	if cert := c.certs[certId]; cert != nil && cert.X509Certificate() != nil {
+		response.CertInfos.CertInfo = append(response.CertInfos.CertInfo, live.CertInfo{
+			DomainName:     request.DomainName,
+			CertName:       cert.Name,
+			CertExpireTime: cert.X509Certificate().NotAfter.UTC().Format(time.RFC3339),
+			SSLProtocol:    "on",
+		})
+	}
+
+	return response, nil
+}
+
+// SetLiveDomainCertificate binds cas certificates by name, like live does.
+func (f *LiveClient) SetLiveDomainCertificate(request *live.SetLiveDomainCertificateRequest) (*live.SetLiveDomainCertificateResponse, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("SetLiveDomainCertificate"); err != nil {
+		return nil, err
+	}
+
+	if _, ok := c.live[request.DomainName]; !ok {
+		return nil, fmt.Errorf("live domain %s not found", request.DomainName)
+	}
+
+	if request.SSLProtocol == "off" {
+		c.live[request.DomainName] = 0
+		return live.CreateSetLiveDomainCertificateResponse(), nil
+	}
+
+	cert := c.certificateByName(request.CertName)
+	if cert == nil {
+		return nil, fmt.Errorf("certificate %s not found", request.CertName)
+	}
+
+	c.live[request.DomainName] = cert.Id
+	if err := c.took("SetLiveDomainCertificate"); err != nil {
+		return nil, err
+	}
+	return live.CreateSetLiveDomainCertificateResponse(), nil
+}
@@ -0,0 +1,181 @@
+package fake_cloud
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// OssClient implements agent_oss.OssClient for the buckets of every region,
+// list options like markers are ignored and every bucket comes in one page.
+type OssClient struct {
+	cloud *Cloud
+}
+
+func (c *Cloud) Oss() *OssClient {
+	return &OssClient{cloud: c}
+}
+
+func noSuchBucket(name string) error {
+	return oss.ServiceError{Code: "NoSuchBucket", Message: "bucket " + name + " does not exist", StatusCode: 404}
+}
+
+func (f *OssClient) ListBuckets(options ...oss.Option) (oss.ListBucketsResult, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := oss.ListBucketsResult{}
+	if err := c.call("ListBuckets"); err != nil {
+		return result, err
+	}
+
+	for name, b := range c.buckets {
+		result.Buckets = append(result.Buckets, oss.BucketProperties{
+			Name:     name,
+			Location: "oss-" + b.region,
+			Region:   b.region,
+		})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool { return result.Buckets[i].Name < result.Buckets[j].Name })
+
+	return result, nil
+}
+
+func (f *OssClient) ListBucketCname(bucketName string, options ...oss.Option) (oss.ListBucketCnameResult, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := oss.ListBucketCnameResult{Bucket: bucketName}
+	if err := c.call("ListBucketCname"); err != nil {
+		return result, err
+	}
+
+	b, ok := c.buckets[bucketName]
+	if !ok {
+		return result, noSuchBucket(bucketName)
+	}
+
+	for domain, certId := range b.cnames {
+		cname := oss.Cname{Domain: domain, Status: "Enabled"}
+		if cert := c.certs[certId]; cert != nil && cert.X509Certificate() != nil {
+			cname.Certificate = oss.Certificate{
+				Type:         "CAS",
+				CertId:       strconv.FormatInt(cert.Id, 10) + "-" + b.region,
+				Status:       "Enabled",
+				ValidEndDate: cert.X509Certificate().NotAfter.UTC().Format("Jan _2 15:04:05 2006 MST"),
+			}
+		}
+		result.Cname = append(result.Cname, cname)
+	}
+	sort.Slice(result.Cname, func(i, j int) bool { return result.Cname[i].Domain < result.Cname[j].Domain })
+
+	return result, nil
+}
+
+func (f *OssClient) PutBucketCnameWithCertificate(bucketName string, putBucketCname oss.PutBucketCname, options ...oss.Option) error {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("PutBucketCname"); err != nil {
+		return err
+	}
+
+	b, ok := c.buckets[bucketName]
+	if !ok {
+		return noSuchBucket(bucketName)
+	}
+
+	certId := int64(0)
+	if config := putBucketCname.CertificateConfiguration; config != nil && !config.DeleteCertificate {
+		certId, _ = strconv.ParseInt(config.CertId, 10, 64)
+		if c.certs[certId] == nil {
+			return oss.ServiceError{Code: "CertificateNotExist", Message: "certificate " + config.CertId + " does not exist", StatusCode: 400}
+		}
+	}
+
+	b.cnames[putBucketCname.Cname] = certId
+	return nil
+}
+
+// Bucket is an object store implementing storage_oss.Bucket, options are
+// ignored.
+type Bucket struct {
+	cloud *Cloud
+	name  string
+}
+
+// Bucket returns the objects of a bucket, the bucket is created without a
+// region if there is none.
+func (c *Cloud) Bucket(name string) *Bucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.buckets[name]; !ok {
+		c.buckets[name] = &bucket{cnames: make(map[string]int64), objects: make(map[string][]byte)}
+	}
+
+	return &Bucket{cloud: c, name: name}
+}
+
+func (f *Bucket) GetObject(objectKey string, options ...oss.Option) (io.ReadCloser, error) {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("GetObject"); err != nil {
+		return nil, err
+	}
+
+	data, ok := c.buckets[f.name].objects[objectKey]
+	if !ok {
+		return nil, oss.ServiceError{Code: "NoSuchKey", Message: "the specified key does not exist", StatusCode: 404}
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (f *Bucket) PutObject(objectKey string, reader io.Reader, options ...oss.Option) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("PutObject"); err != nil {
+		return err
+	}
+
+	c.buckets[f.name].objects[objectKey] = data
+	return nil
+}
+
+func (f *Bucket) DeleteObject(objectKey string, options ...oss.Option) error {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.call("DeleteObject"); err != nil {
+		return err
+	}
+
+	delete(c.buckets[f.name].objects, objectKey)
+	return nil
+}
+
+// Object returns an object of the bucket, nil if there is none.
+func (f *Bucket) Object(objectKey string) []byte {
+	c := f.cloud
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.buckets[f.name].objects[objectKey]
+}
@@ -0,0 +1,197 @@
+package keeper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+)
+
+const historyLimit = 10
+
+// HistoryEntry is a certificate a domain was bound to before the keeper
+// replaced it.
+type HistoryEntry struct {
+	Time     time.Time `json:"time"`
+	CertId   int64     `json:"cert_id,omitempty"`
+	CertName string    `json:"cert_name,omitempty"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+func historyKey(certReq agent.CertRequest) string {
+	return "history/" + certReq.ServiceName() + "/" + certReq.Domain() + ".json"
+}
+
+func (k *Keeper) loadHistory(ctx context.Context, certReq agent.CertRequest) ([]HistoryEntry, error) {
+	history := []HistoryEntry{}
+
+	data, err := k.Storage.Read(ctx, historyKey(certReq))
+	if err != nil || data == nil {
+		return history, err
+	}
+
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+func (k *Keeper) saveHistory(ctx context.Context, certReq agent.CertRequest, history []HistoryEntry) error {
+	if len(history) > historyLimit {
+		history = history[len(history)-historyLimit:]
+	}
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+
+	return k.Storage.Write(ctx, historyKey(certReq), data)
+}
+
+// recordBinding appends the current binding of the domain to its history
+// before it is replaced.
+func (k *Keeper) recordBinding(ctx context.Context, certReq agent.CertRequest) error {
+	binding := certReq.Binding()
+
+	history, err := k.loadHistory(ctx, certReq)
+	if err != nil {
+		return err
+	}
+
+	history = append(history, HistoryEntry{
+		Time:     time.Now(),
+		CertId:   binding.CertId,
+		CertName: binding.CertName,
+		NotAfter: binding.NotAfter,
+	})
+
+	return k.saveHistory(ctx, certReq, history)
+}
+
+// bindingCertificate returns the certificate of a recorded binding to bind
+// it again, services bind by cas id or by name so both are filled in.
+func (k *Keeper) bindingCertificate(ctx context.Context, certReq agent.CertRequest, entry HistoryEntry) *cert_helper.Certificate {
+	cert := &cert_helper.Certificate{
+		CommonName:       k.CertManager.CommonName(ctx, certReq.Domain()),
+		CasCertificateId: entry.CertId,
+	}
+
+	name := entry.CertName
+	if name == "" && entry.CertId != 0 {
+		if detail, err := k.CertManager.DescribeCasCertificate(ctx, entry.CertId); err == nil {
+			name = detail.Name
+		}
+	}
+	cert.SetCasName(name)
+
+	return cert
+}
+
+// restore binds the previous certificate again after a failed deployment,
+// even when the context is done.
+func (k *Keeper) restore(ctx context.Context, certReq agent.CertRequest, previous agent.Binding) {
+	ctx = context.WithoutCancel(ctx)
+	entry := HistoryEntry{CertId: previous.CertId, CertName: previous.CertName}
+
+	log.Printf("roll back %s domain %s to certificate %s (%d)", certReq.ServiceName(), certReq.Domain(), entry.CertName, entry.CertId)
+	if err := certReq.SetCertificate(ctx, k.bindingCertificate(ctx, certReq, entry)); err != nil {
+		log.Printf("roll back %s failed, the domain may be left broken: %v", certReq.Domain(), err)
+	}
+}
+
+// Rollback binds the domain to the certificate it was bound to before the
+// last deployment of the keeper, for every service it is found in. It returns
+// the number of failed bindings.
+func (k *Keeper) Rollback(ctx context.Context, domain string) int {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failed, found := 0, 0
+
+	for _, serviceAgent := range k.ServiceAgents {
+		for item := range serviceAgent.Bindings(ctx) {
+			if item.Err != nil {
+				log.Printf("discovery failed: %v", item.Err)
+				continue
+			}
+
+			certReq := item.Request
+			if certReq.Domain() != domain {
+				continue
+			}
+			found++
+
+			if err := k.rollback(ctx, certReq); err != nil {
+				log.Printf("roll back %s domain %s failed: %v", certReq.ServiceName(), domain, err)
+				failed++
+			}
+		}
+	}
+
+	if found == 0 {
+		log.Printf("domain %s not found in any service", domain)
+		failed++
+	}
+
+	return failed
+}
+
+// bindable checks that the certificate of the entry is still in cas and
+// valid, cleanup may have deleted it or it may have expired since.
+func (k *Keeper) bindable(ctx context.Context, entry HistoryEntry) error {
+	inventory, err := k.CertManager.CasInventory(ctx)
+	if err != nil {
+		return fmt.Errorf("list cas certificates failed: %v", err)
+	}
+
+	binding := agent.Binding{CertId: entry.CertId, CertName: entry.CertName}
+	for _, cert := range inventory {
+		if !binding.Uses(cert.Id, cert.Name) {
+			continue
+		}
+		if cert.Status == "REVOKED" {
+			return fmt.Errorf("certificate %s (%d) is revoked", cert.Name, cert.Id)
+		}
+		if !cert.NotAfter.After(time.Now()) {
+			return fmt.Errorf("certificate %s (%d) expired at %s", cert.Name, cert.Id, cert.NotAfter)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("certificate %s (%d) is no longer in cas", entry.CertName, entry.CertId)
+}
+
+func (k *Keeper) rollback(ctx context.Context, certReq agent.CertRequest) error {
+	history, err := k.loadHistory(ctx, certReq)
+	if err != nil {
+		return err
+	}
+
+	// skip the entries of the certificate bound right now
+	current := certReq.Binding()
+	for len(history) > 0 && current.Uses(history[len(history)-1].CertId, history[len(history)-1].CertName) {
+		history = history[:len(history)-1]
+	}
+	if len(history) == 0 {
+		return fmt.Errorf("no previous certificate recorded")
+	}
+
+	entry := history[len(history)-1]
+	if err := k.bindable(ctx, entry); err != nil {
+		return err
+	}
+	cert := k.bindingCertificate(ctx, certReq, entry)
+
+	log.Printf("roll back %s domain %s to certificate %s (%d)", certReq.ServiceName(), certReq.Domain(), entry.CertName, entry.CertId)
+	if err := certReq.SetCertificate(ctx, cert); err != nil {
+		return err
+	}
+
+	return k.saveHistory(ctx, certReq, history[:len(history)-1])
+}
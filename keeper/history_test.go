@@ -0,0 +1,192 @@
+package keeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/fake_cloud"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/verifier"
+)
+
+type memoryStorage map[string][]byte
+
+func (s memoryStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	return s[key], nil
+}
+
+func (s memoryStorage) Write(ctx context.Context, key string, data []byte) error {
+	s[key] = data
+	return nil
+}
+
+func (s memoryStorage) Delete(ctx context.Context, key string) error {
+	delete(s, key)
+	return nil
+}
+
+type testCertRequest struct {
+	domain  string
+	binding agent.Binding
+}
+
+func (r *testCertRequest) ServiceName() string    { return "test" }
+func (r *testCertRequest) Domain() string         { return r.domain }
+func (r *testCertRequest) CommonName() string     { return r.domain }
+func (r *testCertRequest) Binding() agent.Binding { return r.binding }
+
+func (r *testCertRequest) SetCertificate(ctx context.Context, cert *cert_helper.Certificate) error {
+	r.binding = agent.Binding{CertId: cert.CasCertificateId, CertName: cert.CasName()}
+	return nil
+}
+
+type testAgent []*testCertRequest
+
+func (a testAgent) Bindings(ctx context.Context) <-chan agent.Discovered {
+	ch := make(chan agent.Discovered, len(a))
+	for _, req := range a {
+		ch <- agent.Discovered{Request: req}
+	}
+	close(ch)
+	return ch
+}
+
+func (a testAgent) CertRequest(ctx context.Context) <-chan agent.Discovered {
+	return agent.NeedsRenewal(ctx, a.Bindings(ctx))
+}
+
+func TestRollback(t *testing.T) {
+	storage := memoryStorage{}
+	c := fake_cloud.New()
+
+	ids := []int64{}
+	for i := 1; i <= 3; i++ {
+		certPem, keyPem := testCertificate(t, "www.example.test", time.Now().AddDate(0, 0, 30*i))
+		ids = append(ids, c.AddCertificate(fmt.Sprintf("sslkeeper-%d", i), certPem, keyPem, false))
+	}
+	certPem, keyPem := testCertificate(t, "www.example.test", time.Now().AddDate(0, 0, -1))
+	expiredId := c.AddCertificate("sslkeeper-expired", certPem, keyPem, false)
+
+	req := &testCertRequest{domain: "www.example.test", binding: agent.Binding{CertId: expiredId, CertName: "sslkeeper-expired"}}
+	k := &Keeper{
+		ServiceAgents: []agent.ServiceCertAgent{testAgent{req}},
+		Storage:       storage,
+		CertManager:   cert_helper.NewCertManagerWithClient(c.Cas(), nil, storage),
+	}
+
+	// three deployments, expired -> 1 -> 2 -> 3
+	for i, id := range ids {
+		if err := k.recordBinding(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		req.binding = agent.Binding{CertId: id, CertName: fmt.Sprintf("sslkeeper-%d", i+1)}
+	}
+
+	for _, want := range []int{2, 1} {
+		if failed := k.Rollback(context.Background(), "www.example.test"); failed != 0 {
+			t.Fatalf("rollback to %d failed", want)
+		}
+		if req.binding.CertId != ids[want-1] || req.binding.CertName != fmt.Sprintf("sslkeeper-%d", want) {
+			t.Fatalf("rolled back to %+v, want %d", req.binding, want)
+		}
+	}
+
+	// never back to an expired certificate
+	if failed := k.Rollback(context.Background(), "www.example.test"); failed == 0 {
+		t.Error("rollback to an expired certificate should fail")
+	}
+	if req.binding.CertId != ids[0] {
+		t.Errorf("rolled back to %+v", req.binding)
+	}
+
+	if failed := k.Rollback(context.Background(), "other.example.test"); failed == 0 {
+		t.Error("rollback of unknown domain should fail")
+	}
+}
+
+func TestDeployRestore(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	// the binding takes effect, yet the call fails
+	c.FailAfter("SetLiveDomainCertificate", errors.New("set failed"))
+	k, _ := c.keeper(t)
+	report := k.Run(ctx)
+	if len(report.Failed) != 1 || report.Failed[0] != "live/live.example.test" {
+		t.Fatalf("expected live.example.test failed, got %+v", report)
+	}
+	if id := c.LiveBinding("live.example.test"); id != c.oldId {
+		t.Errorf("live.example.test is bound to %d, expected %d restored", id, c.oldId)
+	}
+
+	// nothing listens on the verified address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	certPem, keyPem := testCertificate(t, "*.example.test", time.Now().AddDate(0, 0, 3))
+	otherId := c.AddCertificate("sslkeeper-example_test-other", certPem, keyPem, false)
+	c.AddCdnDomain("api.example.test", otherId)
+
+	k, _ = c.keeper(t)
+	k.Verifier = verifier.NewVerifier()
+	k.Verifier.Addresses["api.example.test"] = listener.Addr().String()
+	k.Verifier.Attempts = 1
+	if failed := k.Deploy(ctx, []string{"api.example.test"}, false); failed != 1 {
+		t.Fatalf("expected the deployment to fail verifying, got %d failed", failed)
+	}
+	if id := c.CdnBinding("api.example.test"); id != otherId {
+		t.Errorf("api.example.test is bound to %d, expected %d restored", id, otherId)
+	}
+}
+
+func TestCleanupKeepsHistory(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	k, _ := c.keeper(t)
+	if report := k.Run(ctx); len(report.Failed) != 0 {
+		t.Fatalf("run failed: %+v", report)
+	}
+
+	// www.example.test moves on, live.example.test may still roll back to
+	// the oldest version, past the retention of one previous version
+	k, _ = c.keeper(t)
+	if _, err := k.CertManager.RenewCertificate(ctx, "*.example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if failed := k.Deploy(ctx, []string{"www.example.test"}, true); failed != 0 {
+		t.Fatalf("%d deployments failed", failed)
+	}
+
+	k, _ = c.keeper(t)
+	cleaned, err := k.Cleanup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cleanup := range cleaned {
+		if cleanup.Cert.Id == c.oldId {
+			t.Errorf("certificate %d in the history is cleaned up", c.oldId)
+		}
+	}
+	if c.Certificate(c.oldId) == nil {
+		t.Errorf("certificate %d in the history is deleted", c.oldId)
+	}
+
+	// without retention nothing is kept for rollback
+	k, _ = c.keeper(t)
+	k.CleanupPolicy = cert_helper.CleanupPolicy{}
+	if _, err := k.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c.Certificate(c.oldId) != nil {
+		t.Errorf("certificate %d is kept without retention", c.oldId)
+	}
+}
@@ -0,0 +1,81 @@
+package keeper
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
+)
+
+type InventoryItem struct {
+	Service       string    `json:"service"`
+	Domain        string    `json:"domain"`
+	Region        string    `json:"region,omitempty"`
+	Bucket        string    `json:"bucket,omitempty"`
+	CertName      string    `json:"cert_name,omitempty"`
+	CertId        int64     `json:"cert_id,omitempty"`
+	Issuer        string    `json:"issuer,omitempty"`
+	NotAfter      time.Time `json:"not_after"`
+	DaysRemaining int       `json:"days_remaining"`
+	WouldRenew    bool      `json:"would_renew"`
+}
+
+// Inventory walks every binding of every service without changing anything.
+// The discovery failures are returned along, the inventory is incomplete if
+// there are any.
+func (k *Keeper) Inventory(ctx context.Context) ([]InventoryItem, []error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	items := []InventoryItem{}
+	failures := []error{}
+
+	for _, serviceAgent := range k.ServiceAgents {
+		for discovered := range serviceAgent.Bindings(ctx) {
+			if discovered.Err != nil {
+				log.Printf("discovery failed: %v", discovered.Err)
+				failures = append(failures, discovered.Err)
+				continue
+			}
+
+			certReq := discovered.Request
+			binding := certReq.Binding()
+
+			item := InventoryItem{
+				Service:    certReq.ServiceName(),
+				Domain:     certReq.Domain(),
+				CertName:   binding.CertName,
+				CertId:     binding.CertId,
+				NotAfter:   binding.NotAfter,
+				WouldRenew: binding.NeedsRenewal(),
+			}
+
+			if !binding.NotAfter.IsZero() {
+				item.DaysRemaining = int(math.Floor(time.Until(binding.NotAfter).Hours() / 24))
+			}
+
+			if bucketReq, ok := certReq.(agent.BucketCertRequest); ok {
+				item.Region = bucketReq.Region()
+				item.Bucket = bucketReq.Bucket()
+			}
+
+			if binding.CertId != 0 && k.CertManager != nil {
+				detail, err := k.CertManager.DescribeCasCertificate(ctx, binding.CertId)
+				if err != nil {
+					log.Printf("describe cas certificate %d failed: %v", binding.CertId, err)
+				} else {
+					item.Issuer = detail.Issuer
+					if item.CertName == "" {
+						item.CertName = detail.Name
+					}
+				}
+			}
+
+			items = append(items, item)
+		}
+	}
+
+	return items, failures
+}
@@ -0,0 +1,29 @@
+package keeper
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestInventoryDiscoveryFailure(t *testing.T) {
+	c := newTestCloud(t)
+	c.Fail("DescribeDomainCertificateInfo", errors.New("cdn is down"))
+
+	k, _ := c.keeper(t)
+	items, failures := k.Inventory(context.Background())
+	if len(failures) == 0 {
+		t.Fatal("expected the cdn discovery failure reported")
+	}
+
+	domains := map[string]string{}
+	for _, item := range items {
+		if item.Service == "cdn" {
+			t.Errorf("unexpected cdn item %s", item.Domain)
+		}
+		domains[item.Domain] = item.CertName
+	}
+	if len(items) != 2 || domains["img.example.test"] != "sslkeeper-example_test-old" || domains["live.example.test"] != "sslkeeper-example_test-old" {
+		t.Errorf("expected the oss and live bindings listed, got %+v", items)
+	}
+}
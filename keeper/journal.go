@@ -0,0 +1,172 @@
+package keeper
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+)
+
+const journalKey = "journal/run.json"
+
+// Journal is the progress of a pass over the domains due for renewal, kept in
+// storage so a pass cut short by the deadline, the shard size or a crash is
+// resumed by the next run. The pass ends with a run that leaves nothing.
+type Journal struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	Runs     int       `json:"runs"`
+	// Processed holds the outcome by service/domain, these domains are not
+	// started again in the pass.
+	Processed map[string]string `json:"processed"`
+	// Certificates are the certificates deployed in the pass by common name,
+	// used again without searching cas or issuing.
+	Certificates map[string]JournalCertificate `json:"certificates"`
+	// Pending are the bindings started and not finished, by service/domain.
+	Pending map[string]JournalCertificate `json:"pending,omitempty"`
+}
+
+type JournalCertificate struct {
+	CertId   int64  `json:"cert_id"`
+	CertName string `json:"cert_name"`
+}
+
+func newJournal() *Journal {
+	return &Journal{
+		Started:      time.Now(),
+		Processed:    make(map[string]string),
+		Certificates: make(map[string]JournalCertificate),
+		Pending:      make(map[string]JournalCertificate),
+	}
+}
+
+func (k *Keeper) loadJournal(ctx context.Context) (*Journal, error) {
+	data, err := k.Storage.Read(ctx, journalKey)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	journal := newJournal()
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, err
+	}
+
+	return journal, nil
+}
+
+func (k *Keeper) saveJournal(ctx context.Context, journal *Journal) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	return k.Storage.Write(ctx, journalKey, data)
+}
+
+// resume picks up the journal of an unfinished pass, or starts a new one.
+// Without storage nothing is journaled.
+func (k *Keeper) resume(ctx context.Context) {
+	if k.Storage == nil {
+		return
+	}
+
+	journal, err := k.loadJournal(ctx)
+	if err != nil {
+		log.Printf("load run journal failed, starting a new pass: %v", err)
+	}
+
+	if journal == nil || !journal.Finished.IsZero() {
+		k.journal = newJournal()
+		return
+	}
+
+	log.Printf("resume the pass started at %s, %d domains done in %d runs", journal.Started.Format(time.RFC3339), len(journal.Processed), journal.Runs)
+
+	// the domain is found again by discovery if the binding did not go through
+	for name, cert := range journal.Pending {
+		log.Printf("binding of %s to %s (%d) was interrupted, it is checked again", name, cert.CertName, cert.CertId)
+		delete(journal.Pending, name)
+	}
+
+	for commonName, cert := range journal.Certificates {
+		k.CertManager.UseCertificate(commonName, cert.CertId, cert.CertName)
+	}
+
+	k.journal = journal
+}
+
+// journalUpdate applies the change to the journal and saves it, even when the
+// context is done, so the journal tells what happened.
+func (k *Keeper) journalUpdate(ctx context.Context, update func(journal *Journal)) {
+	if k.journal == nil {
+		return
+	}
+
+	update(k.journal)
+	if err := k.saveJournal(context.WithoutCancel(ctx), k.journal); err != nil {
+		log.Printf("save run journal failed: %v", err)
+	}
+}
+
+func (k *Keeper) journaled(name string) bool {
+	if k.journal == nil {
+		return false
+	}
+
+	_, ok := k.journal.Processed[name]
+	return ok
+}
+
+func (k *Keeper) journalCertificate(ctx context.Context, commonName string, cert *cert_helper.Certificate) {
+	if k.journal == nil || cert.CasCertificateId == 0 {
+		return
+	}
+	if _, ok := k.journal.Certificates[commonName]; ok {
+		return
+	}
+
+	k.journalUpdate(ctx, func(journal *Journal) {
+		journal.Certificates[commonName] = JournalCertificate{CertId: cert.CasCertificateId, CertName: cert.CasName()}
+	})
+}
+
+func (k *Keeper) journalPending(ctx context.Context, name string, cert *cert_helper.Certificate) {
+	k.journalUpdate(ctx, func(journal *Journal) {
+		journal.Pending[name] = JournalCertificate{CertId: cert.CasCertificateId, CertName: cert.CasName()}
+	})
+}
+
+// journalProcessed records the outcome of the domain. A domain cut off by the
+// end of the run or failing transiently is left pending, the next run of the
+// pass starts it again.
+func (k *Keeper) journalProcessed(ctx context.Context, name string, err error) {
+	if err != nil && held(err) == "" && transient(err) {
+		return
+	}
+
+	k.journalUpdate(ctx, func(journal *Journal) {
+		delete(journal.Pending, name)
+		switch kind := held(err); {
+		case kind != "":
+			journal.Processed[name] = kind
+		case err != nil:
+			journal.Processed[name] = "failed"
+		default:
+			journal.Processed[name] = "deployed"
+		}
+	})
+}
+
+// journalRun closes the run in the journal, the pass is finished unless the
+// run stopped early.
+func (k *Keeper) journalRun(ctx context.Context, report *Report) {
+	k.journalUpdate(ctx, func(journal *Journal) {
+		journal.Runs++
+		if !report.Stopped {
+			journal.Finished = time.Now()
+		}
+	})
+	k.journal = nil
+}
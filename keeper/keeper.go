@@ -1,36 +1,344 @@
 package keeper
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
 	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/verifier"
 )
 
 type Keeper struct {
 	ServiceAgents []agent.ServiceCertAgent
 	Storage       storage.StorageService
 	CertManager   *cert_helper.CertManager
+	CleanupPolicy cert_helper.CleanupPolicy
+	// Verifier checks the domains serve the deployed certificate, optional
+	Verifier *verifier.Verifier
+	// Canary stages the rollout of renewed certificates, optional
+	Canary CanaryPolicy
+	// Reserve is the time kept before the deadline of a run, no new domain
+	// is started once less is left.
+	Reserve time.Duration
+	// Shard is the number of domains deployed per run, the next run resumes
+	// the pass. 0 for all.
+	Shard int
+	// Backoff spaces out the retries of common names failing to issue
+	Backoff BackoffPolicy
+
+	journal  *Journal
+	failures map[string]*FailureRecord
+}
+
+// stopping reports whether the run is too close to its deadline, or done with
+// its shard, to start another domain.
+func (k *Keeper) stopping(ctx context.Context, report *Report) bool {
+	if k.Shard > 0 && len(report.Deployed)+len(report.Failed) >= k.Shard {
+		return true
+	}
+
+	if ctx.Err() != nil {
+		return true
+	}
+
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < k.Reserve
+}
+
+func (k *Keeper) process(ctx context.Context, certReq agent.CertRequest) error {
+	commonName := k.CertManager.CommonName(ctx, certReq.Domain())
+	log.Printf("cert request from %s: %s (%s)", certReq.ServiceName(), certReq.Domain(), commonName)
+
+	// a cas certificate of the domain itself, like a purchased one for the
+	// exact name, goes before the certificate of the common name
+	cert, err := k.CertManager.DomainCertificate(ctx, certReq.Domain())
+	if err != nil {
+		return fmt.Errorf("search cas failed: %w", err)
+	}
+	if cert == nil {
+		cert, err = k.certificate(ctx, commonName)
+		if err != nil {
+			return fmt.Errorf("load cert failed: %w", err)
+		}
+		k.journalCertificate(ctx, commonName, cert)
+	}
+
+	return k.deploy(ctx, certReq, cert)
+}
+
+// deploy binds the certificate to the domain. The previous binding is
+// recorded for rollback and restored when binding or verifying fails.
+func (k *Keeper) deploy(ctx context.Context, certReq agent.CertRequest, cert *cert_helper.Certificate) error {
+	if err := k.CertManager.ValidateCertificate(ctx, cert, certReq.Domain()); err != nil {
+		return err
+	}
+
+	// the previous binding is recorded for rollback, unless it is the same
+	previous := certReq.Binding()
+	rollback := k.Storage != nil && (previous.CertId != 0 || previous.CertName != "") &&
+		!(previous.CertId != 0 && previous.CertId == cert.CasCertificateId)
+	if rollback {
+		if err := k.recordBinding(ctx, certReq); err != nil {
+			return fmt.Errorf("record previous binding failed: %v", err)
+		}
+	}
+
+	k.journalPending(ctx, certReq.ServiceName()+"/"+certReq.Domain(), cert)
+	if err := certReq.SetCertificate(ctx, cert); err != nil {
+		if rollback {
+			k.restore(ctx, certReq, previous)
+		}
+		return fmt.Errorf("set cert failed: %w", err)
+	}
+
+	if k.Verifier != nil {
+		if err := k.verify(ctx, certReq.Domain(), cert); err != nil {
+			if rollback {
+				k.restore(ctx, certReq, previous)
+			}
+			return fmt.Errorf("verify failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (k *Keeper) verify(ctx context.Context, domain string, cert *cert_helper.Certificate) error {
+	if strings.HasPrefix(domain, "*.") {
+		log.Printf("skip verifying wildcard domain %s", domain)
+		return nil
+	}
+
+	// certificates reused from cas come without pem
+	if cert.Certificate == nil {
+		casCert, err := k.CertManager.GetCasCertificate(ctx, cert.CasCertificateId)
+		if err != nil {
+			return err
+		}
+		cert = casCert
+	}
+
+	expected := cert.X509Certificate()
+	if expected == nil {
+		return fmt.Errorf("failed to parse certificate of %s", cert.CommonName)
+	}
+
+	return k.Verifier.Verify(ctx, domain, expected)
+}
+
+// held tells how the error holds a domain back without a failure: "backoff"
+// after failures in earlier runs, "deferred" by the issuance schedule, or ""
+// if it does not.
+func held(err error) string {
+	var backoffErr *BackoffError
+	var deferredErr *cert_helper.DeferredError
+
+	switch {
+	case errors.As(err, &backoffErr):
+		return "backoff"
+	case errors.As(err, &deferredErr):
+		return "deferred"
+	default:
+		return ""
+	}
+}
+
+// transient tells whether the error may pass by itself: throttling, server
+// errors and timeouts of the apis, the end of the run, or a domain still
+// propagating or timing out on the handshake.
+func transient(err error) bool {
+	var staleErr *verifier.StaleError
+	var netErr net.Error
+
+	return retry.Retryable(err) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &staleErr) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// handle deploys to a domain and records the outcome in the report and the
+// journal. Domains done earlier in the pass are skipped.
+func (k *Keeper) handle(ctx context.Context, certReq agent.CertRequest, report *Report) error {
+	name := certReq.ServiceName() + "/" + certReq.Domain()
+
+	if k.journaled(name) {
+		log.Printf("%s was done earlier in this pass, skipped", name)
+		report.Resumed++
+		return nil
+	}
+
+	err := k.process(ctx, certReq)
+	k.journalProcessed(ctx, name, err)
+	report.add(certReq, err)
+
+	return err
+}
+
+// Run deploys to every domain due for renewal and cleans up cas. Close to the
+// deadline of the context, or once the shard is done, no new domain is
+// started; the report tells what is left and the next run resumes the pass.
+func (k *Keeper) Run(ctx context.Context) *Report {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	report := newReport()
+	k.resume(ctx)
+	k.loadRunFailures(ctx)
+
+	if k.Canary.Enabled() {
+		k.rollout(ctx, report)
+	} else {
+	agents:
+		for _, serviceAgent := range k.ServiceAgents {
+			for item := range serviceAgent.CertRequest(ctx) {
+				if item.Err != nil {
+					log.Printf("discovery failed: %v", item.Err)
+					continue
+				}
+
+				if k.stopping(ctx, report) {
+					report.Stopped = true
+					report.Skipped++
+					break agents
+				}
+
+				k.handle(ctx, item.Request, report)
+			}
+		}
+	}
+
+	if report.Stopped {
+		log.Printf("cleanup skipped, the pass is resumed by the next run")
+	} else if _, err := k.Cleanup(ctx); err != nil {
+		log.Printf("cleanup failed: %v", err)
+	}
+	k.journalRun(ctx, report)
+	k.reportStuck(report)
+	k.reportBudget(report)
+
+	report.Finished = time.Now()
+	return report
 }
 
-func (k *Keeper) Run() {
-	for _, agent := range k.ServiceAgents {
-		for certReq := range agent.CertRequest() {
-			log.Printf("cert request from %s: %s", certReq.ServiceName(), certReq.CommonName())
-			cert, err := k.CertManager.GetCertificate(certReq.CommonName())
-			if err != nil {
-				log.Printf("load cert failed: %v", err)
+// reportBudget adds the projected use of the rate limits to the report, the
+// deferred issuances are still to come.
+func (k *Keeper) reportBudget(report *Report) {
+	for _, budget := range k.CertManager.IssuanceBudget() {
+		line := fmt.Sprintf("%s: %d of %d used, %d deferred, %d projected", budget.Domain, budget.Used, budget.Limit, budget.Deferred, budget.Used+budget.Deferred)
+		if !budget.Next.IsZero() {
+			line += ", next frees up at " + budget.Next.Format(time.RFC3339)
+		}
+		report.Budget = append(report.Budget, line)
+	}
+}
+
+// Cleanup deletes the certificates the keeper uploaded to cas and no domain
+// of any service is bound to, following the cleanup policy. The certificates
+// retained for rollback are kept until they expire. Nothing is deleted if the
+// bindings of any domain are unknown.
+func (k *Keeper) Cleanup(ctx context.Context) ([]cert_helper.CasCleanup, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	bindings := cert_helper.NewCasBindings()
+	for _, serviceAgent := range k.ServiceAgents {
+		for item := range serviceAgent.Bindings(ctx) {
+			if item.Err != nil {
+				return nil, fmt.Errorf("bindings are incomplete: %v", item.Err)
+			}
+
+			binding := item.Request.Binding()
+			bindings.Add(binding.CertId, binding.CertName)
+
+			if err := k.addRollbackTargets(ctx, item.Request, bindings); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return k.CertManager.CleanCasCertificates(ctx, bindings, k.CleanupPolicy)
+}
+
+// addRollbackTargets adds the latest certificates the domain may still roll
+// back to, as many as the cleanup policy retains.
+func (k *Keeper) addRollbackTargets(ctx context.Context, certReq agent.CertRequest, bindings *cert_helper.CasBindings) error {
+	if k.Storage == nil || k.CleanupPolicy.Retain <= 0 {
+		return nil
+	}
+
+	history, err := k.loadHistory(ctx, certReq)
+	if err != nil {
+		return fmt.Errorf("load history of %s failed: %v", certReq.Domain(), err)
+	}
+
+	current, kept := certReq.Binding(), 0
+	for i := len(history) - 1; i >= 0 && kept < k.CleanupPolicy.Retain; i-- {
+		entry := history[i]
+		if current.Uses(entry.CertId, entry.CertName) || k.bindable(ctx, entry) != nil {
+			continue
+		}
+
+		bindings.AddRollback(entry.CertId, entry.CertName)
+		kept++
+	}
+
+	return nil
+}
+
+// Deploy pushes the current certificate to the bindings matching the targets,
+// by domain or by common name. Unless forced, only bindings due for renewal
+// are touched. It returns the number of failed bindings.
+func (k *Keeper) Deploy(ctx context.Context, targets []string, force bool) int {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	failed := 0
+
+	for _, serviceAgent := range k.ServiceAgents {
+		var requests <-chan agent.Discovered
+		if force {
+			requests = serviceAgent.Bindings(ctx)
+		} else {
+			requests = serviceAgent.CertRequest(ctx)
+		}
+
+		for item := range requests {
+			if item.Err != nil {
+				log.Printf("discovery failed: %v", item.Err)
+				failed++
 				continue
 			}
 
-			if err := certReq.SetCertificate(cert); err != nil {
-				log.Printf("set cert failed: %v", err)
+			certReq := item.Request
+			if !k.matchTargets(ctx, certReq, targets) {
 				continue
 			}
+
+			if err := k.process(ctx, certReq); err != nil {
+				log.Printf("%s: %v", certReq.Domain(), err)
+				failed++
+			}
+		}
+	}
+
+	return failed
+}
+
+func (k *Keeper) matchTargets(ctx context.Context, certReq agent.CertRequest, targets []string) bool {
+	commonName := k.CertManager.CommonName(ctx, certReq.Domain())
+
+	for _, target := range targets {
+		if target == certReq.Domain() || target == commonName {
+			return true
 		}
 	}
 
-	k.CertManager.CleanCasDuplicateCertificate()
-	k.CertManager.CleanCasExpiredCertificate()
+	return false
 }
@@ -0,0 +1,43 @@
+package keeper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+)
+
+func TestRunStopsAtDeadline(t *testing.T) {
+	agents := []agent.ServiceCertAgent{testAgent{
+		&testCertRequest{domain: "a.example.test"},
+		&testCertRequest{domain: "b.example.test"},
+	}}
+	k := &Keeper{
+		ServiceAgents: agents,
+		CertManager: cert_helper.NewCertManager(&aliapi.Config{
+			RegionId:        tea.String("cn-hangzhou"),
+			AccessKeyId:     tea.String("test-key"),
+			AccessKeySecret: tea.String("test-secret"),
+		}, nil, nil),
+		Reserve: time.Minute,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// no domain is started within the reserve
+	report := k.Run(ctx)
+	if !report.Stopped || report.Skipped != 1 || len(report.Deployed)+len(report.Failed) != 0 {
+		t.Errorf("expected a stopped run, got %+v", report)
+	}
+
+	k.Canary = CanaryPolicy{Percent: 50}
+	report = k.Run(ctx)
+	if !report.Stopped || report.Skipped != 2 {
+		t.Errorf("expected a stopped rollout with 2 domains left, got %+v", report)
+	}
+}
@@ -0,0 +1,120 @@
+package keeper
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+)
+
+// newestCertificate returns the valid certificate covering the domain which
+// expires last, whoever uploaded it. nil if there is none.
+func newestCertificate(inventory []*cert_helper.CasCertificate, domain string) *cert_helper.CasCertificate {
+	var newest *cert_helper.CasCertificate
+	now := time.Now()
+
+	for _, cert := range inventory {
+		if cert.Status == "REVOKED" || !cert.NotAfter.After(now) || !cert.Covers(domain) {
+			continue
+		}
+
+		if newest == nil || cert.NotAfter.After(newest.NotAfter) {
+			newest = cert
+		}
+	}
+
+	return newest
+}
+
+// boundCertificate returns the certificate of the binding from the inventory,
+// nil if it is not there.
+func boundCertificate(binding agent.Binding, inventory []*cert_helper.CasCertificate) *cert_helper.CasCertificate {
+	for _, cert := range inventory {
+		if binding.Uses(cert.Id, cert.Name) {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+// keeperBound reports whether the binding uses a certificate the keeper
+// uploaded or imported, looked up in the inventory or else by its name.
+func keeperBound(binding agent.Binding, bound *cert_helper.CasCertificate) bool {
+	if bound != nil {
+		return bound.KeeperIssued() || bound.Imported()
+	}
+
+	return strings.HasPrefix(binding.CertName, "sslkeeper-") || strings.HasPrefix(binding.CertName, "imported-")
+}
+
+// Reconcile binds every domain to the newest valid certificate covering it,
+// wherever one expiring earlier is bound. Domains bound to certificates the
+// keeper neither uploaded nor imported are only reported, unless takeOver is
+// set. Unbound domains are left to Run.
+func (k *Keeper) Reconcile(ctx context.Context, takeOver bool) *Report {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	report := newReport()
+	defer func() { report.Finished = time.Now() }()
+
+	inventory, err := k.CertManager.CasInventory(ctx)
+	if err != nil {
+		log.Printf("list cas certificates failed: %v", err)
+		report.Failed = append(report.Failed, "cas")
+		return report
+	}
+
+agents:
+	for _, serviceAgent := range k.ServiceAgents {
+		for item := range serviceAgent.Bindings(ctx) {
+			if item.Err != nil {
+				log.Printf("discovery failed: %v", item.Err)
+				continue
+			}
+
+			certReq := item.Request
+			binding := certReq.Binding()
+			if binding.CertId == 0 && binding.CertName == "" {
+				continue
+			}
+
+			cert := newestCertificate(inventory, certReq.Domain())
+			if cert == nil || binding.Uses(cert.Id, cert.Name) {
+				continue
+			}
+
+			// never rebound to a certificate expiring earlier
+			bound := boundCertificate(binding, inventory)
+			notAfter := binding.NotAfter
+			if notAfter.IsZero() && bound != nil {
+				notAfter = bound.NotAfter
+			}
+			if !notAfter.IsZero() && !notAfter.Before(cert.NotAfter) {
+				continue
+			}
+
+			if !takeOver && !keeperBound(binding, bound) {
+				report.Foreign = append(report.Foreign, certReq.ServiceName()+"/"+certReq.Domain())
+				continue
+			}
+
+			if k.stopping(ctx, report) {
+				report.Stopped = true
+				report.Skipped++
+				break agents
+			}
+
+			log.Printf("reconcile %s/%s: %s bound, %s expires later", certReq.ServiceName(), certReq.Domain(), binding.CertName, cert.Name)
+			deployCert := &cert_helper.Certificate{CommonName: k.CertManager.CommonName(ctx, certReq.Domain()), CasCertificateId: cert.Id}
+			deployCert.SetCasName(cert.Name)
+			report.add(certReq, k.deploy(ctx, certReq, deployCert))
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,117 @@
+package keeper
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/verifier"
+)
+
+// Report is the outcome of a run. A run stopped at its deadline is partial,
+// the domains left are due again on the next run.
+type Report struct {
+	Started  time.Time
+	Finished time.Time
+	// Deployed and Failed hold service/domain of the bindings touched
+	Deployed []string
+	Failed   []string
+	// Stale are the domains still serving the old certificate
+	Stale []string
+	// Backoff holds service/domain of the bindings waiting for their common
+	// name to be retried, Stuck the common names failing for too long.
+	Backoff []string
+	Stuck   []string
+	// Deferred holds service/domain of the bindings whose issuance is held
+	// back by the rate limits, Budget the projected use of the limits.
+	Deferred []string
+	Budget   []string
+	// Stopped is set when the run stopped early, at its deadline or with its
+	// shard done. Skipped counts the domains discovered but not deployed.
+	Stopped bool
+	Skipped int
+	// Resumed counts the domains done by earlier runs of the pass
+	Resumed int
+	// Halted holds the rollouts stopped by a failed canary, until resumed
+	Halted []string
+	// Foreign holds service/domain of the bindings a reconcile left on
+	// certificates the keeper neither uploaded nor imported.
+	Foreign []string
+}
+
+func newReport() *Report {
+	return &Report{Started: time.Now()}
+}
+
+// add records the outcome of a deployment.
+func (r *Report) add(certReq agent.CertRequest, err error) {
+	name := certReq.ServiceName() + "/" + certReq.Domain()
+
+	if kind := held(err); kind != "" {
+		log.Printf("%s: %v", certReq.Domain(), err)
+		r.hold(kind, name)
+	} else if err != nil {
+		log.Printf("%s: %v", certReq.Domain(), err)
+		r.Failed = append(r.Failed, name)
+
+		var staleErr *verifier.StaleError
+		if errors.As(err, &staleErr) {
+			r.Stale = append(r.Stale, certReq.Domain())
+		}
+	} else {
+		r.Deployed = append(r.Deployed, name)
+	}
+}
+
+// hold records a binding held back without a failure, see held.
+func (r *Report) hold(kind, name string) {
+	switch kind {
+	case "backoff":
+		r.Backoff = append(r.Backoff, name)
+	case "deferred":
+		r.Deferred = append(r.Deferred, name)
+	}
+}
+
+// halt records a rollout halted by a failed canary with the domains left.
+func (r *Report) halt(state *RolloutState, left int) {
+	r.Halted = append(r.Halted, fmt.Sprintf("%s (%d, %d domains left): %s", state.CommonName, state.CertId, left, state.Error))
+}
+
+func (r *Report) Log() {
+	log.Printf("run finished in %s: %d deployed, %d failed", r.Finished.Sub(r.Started).Round(time.Second), len(r.Deployed), len(r.Failed))
+
+	if len(r.Failed) > 0 {
+		log.Printf("failed: %s", strings.Join(r.Failed, ", "))
+	}
+	if len(r.Stale) > 0 {
+		log.Printf("domains still serving old certificates: %s", strings.Join(r.Stale, ", "))
+	}
+	if len(r.Backoff) > 0 {
+		log.Printf("waiting to retry issuance: %s", strings.Join(r.Backoff, ", "))
+	}
+	if len(r.Deferred) > 0 {
+		log.Printf("issuance deferred to later runs: %s", strings.Join(r.Deferred, ", "))
+	}
+	for _, budget := range r.Budget {
+		log.Printf("rate limit budget: %s", budget)
+	}
+	for _, halted := range r.Halted {
+		log.Printf("rollout halted: %s, fix it and run resume-rollout", halted)
+	}
+	for _, stuck := range r.Stuck {
+		log.Printf("stuck: %s, fix it and run reset-failures", stuck)
+	}
+	if len(r.Foreign) > 0 {
+		log.Printf("bound to certificates not managed by the keeper, take over to rebind: %s", strings.Join(r.Foreign, ", "))
+	}
+	if r.Resumed > 0 {
+		log.Printf("%d domains were done by earlier runs of this pass", r.Resumed)
+	}
+	if r.Stopped {
+		log.Printf("run stopped early, %d discovered domains and any not yet discovered are left for the next run", r.Skipped)
+	}
+}
@@ -0,0 +1,277 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alibabacloud-go/tea/tea"
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"golang.org/x/time/rate"
+)
+
+// Policy is the retry policy of a service, like cas or cdn.
+type Policy struct {
+	Attempts  int           `mapstructure:"attempts"`
+	BaseDelay time.Duration `mapstructure:"base-delay"`
+	MaxDelay  time.Duration `mapstructure:"max-delay"`
+	// Budget is the number of retries the service may spend in total, 0 is
+	// unlimited. Once spent, calls are attempted only once.
+	Budget int `mapstructure:"budget"`
+}
+
+var DefaultPolicy = Policy{
+	Attempts:  5,
+	BaseDelay: time.Second,
+	MaxDelay:  30 * time.Second,
+}
+
+// Retrier retries the retryable errors of aliyun apis with exponential
+// backoff and jitter, and limits the rate of every api on the client side.
+type Retrier struct {
+	mu       sync.Mutex
+	policies map[string]Policy
+	spent    map[string]int
+	limiters map[string]*rate.Limiter
+	rate     rate.Limit
+	burst    int
+
+	sleep func(context.Context, time.Duration) error
+}
+
+func NewRetrier() *Retrier {
+	return &Retrier{
+		policies: make(map[string]Policy),
+		spent:    make(map[string]int),
+		limiters: make(map[string]*rate.Limiter),
+		rate:     rate.Inf,
+		sleep:    sleep,
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Default is the retrier shared by the agents and the cert manager.
+var Default = NewRetrier()
+
+func (r *Retrier) SetPolicy(service string, policy Policy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.policies[service] = policy
+}
+
+// SetRateLimit limits every api to perSecond calls, 0 is unlimited.
+func (r *Retrier) SetRateLimit(perSecond float64, burst int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rate, r.burst = rate.Inf, 0
+	if perSecond > 0 {
+		r.rate, r.burst = rate.Limit(perSecond), max(burst, 1)
+	}
+	r.limiters = make(map[string]*rate.Limiter)
+}
+
+func (r *Retrier) policy(service string) Policy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if policy, ok := r.policies[service]; ok {
+		return policy
+	}
+
+	return DefaultPolicy
+}
+
+func (r *Retrier) limiter(service, api string) *rate.Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := service + "/" + api
+	if _, ok := r.limiters[key]; !ok {
+		r.limiters[key] = rate.NewLimiter(r.rate, r.burst)
+	}
+
+	return r.limiters[key]
+}
+
+// spend takes a retry from the budget of the service.
+func (r *Retrier) spend(service string, policy Policy) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if policy.Budget > 0 && r.spent[service] >= policy.Budget {
+		return false
+	}
+
+	r.spent[service]++
+	return true
+}
+
+func backoff(policy Policy, attempt int) time.Duration {
+	delay := policy.BaseDelay << (attempt - 1)
+	if delay <= 0 || (policy.MaxDelay > 0 && delay > policy.MaxDelay) {
+		delay = policy.MaxDelay
+	}
+
+	// full jitter over the upper half
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable,
+// or the attempts or the budget of the service are exhausted. No attempt is
+// made once the context is done, and no retry that would outlast it.
+func (r *Retrier) Do(ctx context.Context, service, api string, fn func() error) error {
+	return r.do(ctx, service, api, Retryable, fn)
+}
+
+// Create is Do for apis creating resources. A call failing on the server side
+// or timing out may have taken effect, so only throttled calls are retried.
+func (r *Retrier) Create(ctx context.Context, service, api string, fn func() error) error {
+	return r.do(ctx, service, api, Throttled, fn)
+}
+
+func (r *Retrier) do(ctx context.Context, service, api string, retryable func(error) bool, fn func() error) error {
+	policy := r.policy(service)
+	limiter := r.limiter(service, api)
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		err := fn()
+		if err == nil || !retryable(err) || attempt >= policy.Attempts {
+			return err
+		}
+
+		if !r.spend(service, policy) {
+			return fmt.Errorf("retry budget of %s exhausted: %w", service, err)
+		}
+
+		delay := backoff(policy, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+
+		log.Printf("%s %s failed, retry in %s: %v", service, api, delay.Round(time.Millisecond), err)
+		if sleepErr := r.sleep(ctx, delay); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+// Call is Do for apis with a result.
+func Call[T any](ctx context.Context, r *Retrier, service, api string, fn func() (T, error)) (T, error) {
+	var result T
+
+	err := r.Do(ctx, service, api, func() error {
+		var err error
+		result, err = fn()
+		return err
+	})
+
+	return result, err
+}
+
+// CallCreate is Create for apis with a result.
+func CallCreate[T any](ctx context.Context, r *Retrier, service, api string, fn func() (T, error)) (T, error) {
+	var result T
+
+	err := r.Create(ctx, service, api, func() error {
+		var err error
+		result, err = fn()
+		return err
+	})
+
+	return result, err
+}
+
+var retryableCodes = []string{
+	"Throttling",
+	"ServiceUnavailable",
+	"InternalError",
+	"SystemBusy",
+	"ServiceBusy",
+	"RequestTimeout",
+}
+
+var retryableStatus = map[int]bool{429: true, 500: true, 502: true, 503: true, 504: true}
+
+func retryableCode(code string) bool {
+	for _, prefix := range retryableCodes {
+		if strings.HasPrefix(code, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Retryable reports whether the error of an aliyun api is worth a retry:
+// throttling, server side failures and network timeouts.
+func Retryable(err error) bool {
+	var teaErr *tea.SDKError
+	if errors.As(err, &teaErr) {
+		return retryableCode(tea.StringValue(teaErr.Code)) || retryableStatus[tea.IntValue(teaErr.StatusCode)]
+	}
+
+	var serverErr *sdkerrors.ServerError
+	if errors.As(err, &serverErr) {
+		return retryableCode(serverErr.ErrorCode()) || retryableStatus[serverErr.HttpStatus()]
+	}
+
+	var ossErr oss.ServiceError
+	if errors.As(err, &ossErr) {
+		return retryableCode(ossErr.Code) || retryableStatus[ossErr.StatusCode]
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+
+	return false
+}
+
+// Throttled reports whether the error of an aliyun api is a throttling, the
+// call was rejected without taking effect.
+func Throttled(err error) bool {
+	var teaErr *tea.SDKError
+	if errors.As(err, &teaErr) {
+		return strings.HasPrefix(tea.StringValue(teaErr.Code), "Throttling") || tea.IntValue(teaErr.StatusCode) == 429
+	}
+
+	var serverErr *sdkerrors.ServerError
+	if errors.As(err, &serverErr) {
+		return strings.HasPrefix(serverErr.ErrorCode(), "Throttling") || serverErr.HttpStatus() == 429
+	}
+
+	var ossErr oss.ServiceError
+	if errors.As(err, &ossErr) {
+		return strings.HasPrefix(ossErr.Code, "Throttling") || ossErr.StatusCode == 429
+	}
+
+	return false
+}
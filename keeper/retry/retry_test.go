@@ -0,0 +1,169 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alibabacloud-go/tea/tea"
+)
+
+// fakeClient fails with throttling errors before it succeeds.
+type fakeClient struct {
+	throttles int
+	calls     int
+}
+
+func (c *fakeClient) Describe() (string, error) {
+	c.calls++
+	if c.calls <= c.throttles {
+		return "", tea.NewSDKError(map[string]interface{}{
+			"code":       "Throttling.User",
+			"statusCode": 400,
+			"message":    "Request was denied due to user flow control.",
+		})
+	}
+
+	return "ok", nil
+}
+
+func newTestRetrier() (*Retrier, *[]time.Duration) {
+	r := NewRetrier()
+	delays := []time.Duration{}
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	return r, &delays
+}
+
+func TestRetryThrottling(t *testing.T) {
+	r, delays := newTestRetrier()
+	r.SetPolicy("cdn", Policy{Attempts: 5, BaseDelay: time.Second, MaxDelay: 3 * time.Second})
+
+	client := &fakeClient{throttles: 4}
+	result, err := Call(context.Background(), r, "cdn", "Describe", client.Describe)
+	if err != nil || result != "ok" {
+		t.Fatalf("got %q, %v", result, err)
+	}
+
+	if len(*delays) != 4 {
+		t.Fatalf("expected 4 retries, got %d", len(*delays))
+	}
+	for i, max := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if d := (*delays)[i]; d < max/2 || d > max {
+			t.Errorf("delay %d is %s, expected between %s and %s", i, d, max/2, max)
+		}
+	}
+
+	client = &fakeClient{throttles: 5}
+	if _, err := Call(context.Background(), r, "cdn", "Describe", client.Describe); !Retryable(err) || client.calls != 5 {
+		t.Errorf("expected throttling after 5 attempts, got %v after %d", err, client.calls)
+	}
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	r, delays := newTestRetrier()
+
+	calls := 0
+	err := r.Do(context.Background(), "cas", "Delete", func() error {
+		calls++
+		return tea.NewSDKError(map[string]interface{}{"code": "InvalidParameter", "statusCode": 400})
+	})
+	if err == nil || calls != 1 || len(*delays) != 0 {
+		t.Errorf("expected a single attempt, got %d: %v", calls, err)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	r, _ := newTestRetrier()
+	r.SetPolicy("oss", Policy{Attempts: 5, BaseDelay: time.Millisecond, Budget: 3})
+
+	client := &fakeClient{throttles: 2}
+	if _, err := Call(context.Background(), r, "oss", "Describe", client.Describe); err != nil {
+		t.Fatal(err)
+	}
+
+	// one retry left in the budget
+	client = &fakeClient{throttles: 2}
+	_, err := Call(context.Background(), r, "oss", "Describe", client.Describe)
+	if err == nil || !strings.Contains(err.Error(), "budget") || client.calls != 2 {
+		t.Errorf("expected budget exhausted after 2 calls, got %v after %d", err, client.calls)
+	}
+
+	// other services have their own budget
+	client = &fakeClient{throttles: 2}
+	if _, err := Call(context.Background(), r, "cdn", "Describe", client.Describe); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	r, _ := newTestRetrier()
+	r.SetRateLimit(50, 1)
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		r.Do(context.Background(), "cdn", "Describe", func() error { return nil })
+	}
+	// the first call is free, the other five wait 20ms each
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("6 calls at 50/s took %s", elapsed)
+	}
+
+	// apis are limited separately
+	start = time.Now()
+	r.Do(context.Background(), "cdn", "Other", func() error { return nil })
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("first call of another api waited %s", elapsed)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	if Retryable(errors.New("plain")) {
+		t.Error("plain errors are not retryable")
+	}
+	if !Retryable(tea.NewSDKError(map[string]interface{}{"code": "ServiceUnavailable", "statusCode": 503})) {
+		t.Error("service unavailable should be retryable")
+	}
+}
+
+func TestRetryCreate(t *testing.T) {
+	r, _ := newTestRetrier()
+
+	client := &fakeClient{throttles: 2}
+	if _, err := CallCreate(context.Background(), r, "cas", "Upload", client.Describe); err != nil || client.calls != 3 {
+		t.Errorf("expected throttled creates to be retried, got %v after %d", err, client.calls)
+	}
+
+	// a create failing on the server may have taken effect
+	calls := 0
+	err := r.Create(context.Background(), "cas", "Upload", func() error {
+		calls++
+		return tea.NewSDKError(map[string]interface{}{"code": "ServiceUnavailable", "statusCode": 503})
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected a single attempt, got %d: %v", calls, err)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	r, delays := newTestRetrier()
+	r.SetPolicy("cas", Policy{Attempts: 5, BaseDelay: time.Minute, MaxDelay: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client := &fakeClient{throttles: 1}
+	if _, err := Call(ctx, r, "cas", "Describe", client.Describe); !Retryable(err) || client.calls != 1 || len(*delays) != 0 {
+		t.Errorf("expected no retry past the deadline, got %v after %d", err, client.calls)
+	}
+
+	cancel()
+	client = &fakeClient{}
+	if _, err := Call(ctx, r, "cas", "Describe", client.Describe); !errors.Is(err, context.Canceled) || client.calls != 0 {
+		t.Errorf("expected no call after cancel, got %v after %d", err, client.calls)
+	}
+}
@@ -0,0 +1,97 @@
+package keeper
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+)
+
+// revokedCertificate loads the certificate to revoke, by cas id or by common
+// name from storage, with its cas id.
+func (k *Keeper) revokedCertificate(ctx context.Context, target string) (*cert_helper.Certificate, error) {
+	var cert *cert_helper.Certificate
+	var err error
+
+	if certId, parseErr := strconv.ParseInt(target, 10, 64); parseErr == nil {
+		cert, err = k.CertManager.GetCasCertificate(ctx, certId)
+	} else {
+		cert, err = k.CertManager.LoadCertificate(ctx, target)
+		if err == nil && cert.Certificate == nil {
+			return nil, fmt.Errorf("no certificate of %s in storage", target)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load certificate failed: %v", err)
+	}
+
+	cert.CasCertificateId, err = k.CertManager.FindCasCertificateId(ctx, cert)
+	if err != nil {
+		return nil, fmt.Errorf("look up certificate in cas failed: %v", err)
+	}
+
+	return cert, nil
+}
+
+// Revoke replaces a certificate, by cas id or common name, e.g. after its key
+// leaked. A new certificate is issued and deployed to every domain bound to
+// the old one first, the old one is only revoked and deleted from cas once
+// no domain serves it anymore.
+func (k *Keeper) Revoke(ctx context.Context, target string, reason uint) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	oldCert, err := k.revokedCertificate(ctx, target)
+	if err != nil {
+		return err
+	}
+	oldCasName := oldCert.CasName()
+
+	newCert, err := k.CertManager.ReissueCertificate(ctx, oldCert.CommonName)
+	if err != nil {
+		// the new certificate may be in storage already, retry by cas id
+		return fmt.Errorf("reissue certificate failed, revoke by cas id %d to retry: %v", oldCert.CasCertificateId, err)
+	}
+	log.Printf("reissued certificate of %s (cas id %d)", newCert.CommonName, newCert.CasCertificateId)
+
+	failed := 0
+	for _, serviceAgent := range k.ServiceAgents {
+		for item := range serviceAgent.Bindings(ctx) {
+			if item.Err != nil {
+				log.Printf("discovery failed: %v", item.Err)
+				failed++
+				continue
+			}
+
+			certReq := item.Request
+			if !certReq.Binding().Uses(oldCert.CasCertificateId, oldCasName) {
+				continue
+			}
+
+			log.Printf("rebind %s domain %s", certReq.ServiceName(), certReq.Domain())
+			if err := k.deploy(ctx, certReq, newCert); err != nil {
+				log.Printf("rebind %s failed: %v", certReq.Domain(), err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d domains failed to rebind, revoke by cas id %d once they are fixed", failed, oldCert.CasCertificateId)
+	}
+
+	log.Printf("revoke certificate of %s (cas id %d, reason %d)", oldCert.CommonName, oldCert.CasCertificateId, reason)
+	if err := k.CertManager.RevokeCertificate(ctx, oldCert, reason); err != nil {
+		return fmt.Errorf("revoke certificate failed: %v", err)
+	}
+
+	if oldCert.CasCertificateId != 0 {
+		if err := k.CertManager.DeleteCasCertificate(ctx, oldCert.CasCertificateId); err != nil {
+			return fmt.Errorf("delete old certificate from cas failed: %v", err)
+		}
+	}
+
+	return nil
+}
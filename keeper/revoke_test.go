@@ -0,0 +1,62 @@
+package keeper
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	k, storage := c.keeper(t)
+	if report := k.Run(ctx); len(report.Failed) != 0 {
+		t.Fatalf("run failed: %+v", report)
+	}
+	oldId := c.CdnBinding("www.example.test")
+	serial := c.Certificate(oldId).X509Certificate().SerialNumber.Text(16)
+
+	// a failed reissue leaves the old certificate bound and not revoked
+	c.Fail("UploadUserCertificate", errors.New("upload failed"))
+	k, _ = c.keeper(t)
+	if err := k.Revoke(ctx, "*.example.test", 1); err == nil {
+		t.Fatal("expected the revoke to fail with the reissue")
+	}
+	if id := c.CdnBinding("www.example.test"); id != oldId {
+		t.Errorf("www.example.test is bound to %d, expected %d", id, oldId)
+	}
+	if c.Certificate(oldId) == nil {
+		t.Errorf("certificate %d is deleted", oldId)
+	}
+	if data, _ := storage.Read(ctx, "local-ca/revoked/"+serial); data != nil {
+		t.Errorf("certificate %d is revoked", oldId)
+	}
+
+	// the failed reissue is in storage, the retry goes by cas id
+	c.Fail("UploadUserCertificate", nil)
+	k, _ = c.keeper(t)
+	if err := k.Revoke(ctx, strconv.FormatInt(oldId, 10), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	newId := c.CdnBinding("www.example.test")
+	if newId == oldId || newId == 0 {
+		t.Fatalf("www.example.test is still bound to %d", newId)
+	}
+	if id := c.LiveBinding("live.example.test"); id != newId {
+		t.Errorf("live.example.test is bound to %d, expected %d", id, newId)
+	}
+	if c.Certificate(oldId) != nil {
+		t.Errorf("revoked certificate %d is not deleted", oldId)
+	}
+	if data, _ := storage.Read(ctx, "local-ca/revoked/"+serial); data == nil {
+		t.Errorf("certificate %d is not revoked", oldId)
+	}
+
+	// the rebind is recorded for rollback like any deployment
+	if data, _ := storage.Read(ctx, "history/cdn/www.example.test.json"); data == nil {
+		t.Error("rebind is not recorded in the history")
+	}
+}
@@ -0,0 +1,571 @@
+package keeper
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent_cdn"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent_live"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/agent_oss"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/fake_cloud"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/storage_oss"
+)
+
+func testCertificate(t *testing.T, commonName string, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    notAfter.AddDate(0, 0, -90),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// testCloud has a purchased *.shop.test certificate for an unbound cdn
+// domain, an expiring keeper certificate of *.example.test bound on cdn, oss
+// and live, and an expired keeper certificate nothing is bound to.
+type testCloud struct {
+	*fake_cloud.Cloud
+	shopId, oldId, expiredId int64
+}
+
+func newTestCloud(t *testing.T) *testCloud {
+	c := &testCloud{Cloud: fake_cloud.New()}
+	now := time.Now()
+
+	certPem, keyPem := testCertificate(t, "*.shop.test", now.AddDate(0, 6, 0))
+	c.shopId = c.AddCertificate("shop_test", certPem, keyPem, true)
+	c.AddCdnDomain("www.shop.test", 0)
+
+	certPem, keyPem = testCertificate(t, "*.example.test", now.AddDate(0, 0, 3))
+	c.oldId = c.AddCertificate("sslkeeper-example_test-old", certPem, keyPem, false)
+	c.AddCdnDomain("www.example.test", c.oldId)
+	c.AddBucket("assets", "cn-hangzhou")
+	c.AddBucketCname("assets", "img.example.test", c.oldId)
+	c.AddLiveDomain("live.example.test", c.oldId)
+
+	certPem, keyPem = testCertificate(t, "*.old.test", now.AddDate(0, 0, -1))
+	c.expiredId = c.AddCertificate("sslkeeper-old_test-expired", certPem, keyPem, false)
+
+	c.AddBucket("keeper", "cn-hangzhou")
+	return c
+}
+
+// keeper returns a keeper on the fake cloud, certificates are issued by a
+// local ca kept in the keeper bucket.
+func (c *testCloud) keeper(t *testing.T) (*Keeper, *storage_oss.OssBucketHelper) {
+	storage := &storage_oss.OssBucketHelper{OssBucket: c.Bucket("keeper"), OssKeyPrefix: "ssl-keeper"}
+
+	issuer, err := cert_helper.NewLocalCAIssuer(context.Background(), storage, "local-ca", 90*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certManager := cert_helper.NewCertManagerWithClient(c.Cas(), issuer, storage)
+	if err := certManager.AddTrustedRoots(issuer.CACertificate()); err != nil {
+		t.Fatal(err)
+	}
+
+	aliConfig := aliapi.Config{
+		RegionId:        tea.String("cn-hangzhou"),
+		AccessKeyId:     tea.String("test-key"),
+		AccessKeySecret: tea.String("test-secret"),
+	}
+
+	return &Keeper{
+		ServiceAgents: []agent.ServiceCertAgent{
+			agent_cdn.NewCdnCertAgentWithClient(c.Cdn(), "", ""),
+			agent_oss.NewOssCertAgentWithClient(aliConfig, c.Oss()),
+			agent_live.NewLiveCertAgentWithClient(c.Live()),
+		},
+		Storage:       storage,
+		CertManager:   certManager,
+		CleanupPolicy: cert_helper.CleanupPolicy{Retain: 1},
+	}, storage
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	k, storage := c.keeper(t)
+	report := k.Run(ctx)
+	if len(report.Failed) != 0 || len(report.Deployed) != 4 {
+		t.Fatalf("expected 4 deployed domains, got %+v", report)
+	}
+
+	// the purchased certificate is reused, nothing issued for it
+	if id := c.CdnBinding("www.shop.test"); id != c.shopId {
+		t.Errorf("www.shop.test is bound to %d, expected the purchased %d", id, c.shopId)
+	}
+
+	newId := c.CdnBinding("www.example.test")
+	if newId == 0 || newId == c.oldId {
+		t.Fatalf("www.example.test is still bound to %d", newId)
+	}
+	if id := c.OssBinding("assets", "img.example.test"); id != newId {
+		t.Errorf("img.example.test is bound to %d, expected %d", id, newId)
+	}
+	if id := c.LiveBinding("live.example.test"); id != newId {
+		t.Errorf("live.example.test is bound to %d, expected %d", id, newId)
+	}
+
+	cert := c.Certificate(newId)
+	if cert.OrderType != "UPLOAD" || !strings.HasPrefix(cert.Name, "sslkeeper-example_test-") {
+		t.Errorf("unexpected certificate %s (%s)", cert.Name, cert.OrderType)
+	}
+	if calls := c.Calls("UploadUserCertificate"); calls != 1 {
+		t.Errorf("expected 1 upload, got %d", calls)
+	}
+	if data, err := storage.Read(ctx, "*.example.test/cert.pem"); err != nil || data == nil {
+		t.Errorf("issued certificate is not in storage: %v", err)
+	}
+
+	// the expired certificate is cleaned up, the replaced one retained
+	if c.Certificate(c.expiredId) != nil {
+		t.Errorf("expired certificate %d is not deleted", c.expiredId)
+	}
+	if c.Certificate(c.oldId) == nil {
+		t.Errorf("previous certificate %d is deleted", c.oldId)
+	}
+
+	k, _ = c.keeper(t)
+	report = k.Run(ctx)
+	if len(report.Deployed)+len(report.Failed) != 0 {
+		t.Errorf("expected nothing to deploy, got %+v", report)
+	}
+	if calls := c.Calls("UploadUserCertificate"); calls != 1 {
+		t.Errorf("expected no new upload, got %d", calls-1)
+	}
+}
+
+func TestRunExactPurchased(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	certPem, keyPem := testCertificate(t, "www.example.test", time.Now().AddDate(1, 0, 0))
+	exactId := c.AddCertificate("www_example_test", certPem, keyPem, true)
+
+	k, _ := c.keeper(t)
+	if report := k.Run(ctx); len(report.Failed) != 0 || len(report.Deployed) != 4 {
+		t.Fatalf("expected 4 deployed domains, got %+v", report)
+	}
+
+	// the purchased certificate of the exact name is used for it only
+	if id := c.CdnBinding("www.example.test"); id != exactId {
+		t.Errorf("www.example.test is bound to %d, expected the purchased %d", id, exactId)
+	}
+	if id := c.LiveBinding("live.example.test"); id == exactId || id == c.oldId {
+		t.Errorf("live.example.test is bound to %d", id)
+	}
+}
+
+// discoveryAgent records the discoveries started on the agent.
+type discoveryAgent struct {
+	agent.ServiceCertAgent
+	started []string
+}
+
+func (a *discoveryAgent) CertRequest(ctx context.Context) <-chan agent.Discovered {
+	a.started = append(a.started, "CertRequest")
+	return a.ServiceCertAgent.CertRequest(ctx)
+}
+
+func (a *discoveryAgent) Bindings(ctx context.Context) <-chan agent.Discovered {
+	a.started = append(a.started, "Bindings")
+	return a.ServiceCertAgent.Bindings(ctx)
+}
+
+func TestDeployForce(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	k, _ := c.keeper(t)
+	if report := k.Run(ctx); len(report.Failed) != 0 {
+		t.Fatalf("run failed: %+v", report)
+	}
+	currentId := c.CdnBinding("www.example.test")
+
+	k, _ = c.keeper(t)
+	renewed, err := k.CertManager.RenewCertificate(ctx, "*.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not due, nothing to deploy unless forced
+	if failed := k.Deploy(ctx, []string{"www.example.test"}, false); failed != 0 {
+		t.Fatalf("%d deployments failed", failed)
+	}
+	if id := c.CdnBinding("www.example.test"); id != currentId {
+		t.Fatalf("www.example.test is deployed without force")
+	}
+
+	// forced, only the bindings are discovered
+	agents := []*discoveryAgent{}
+	for i, serviceAgent := range k.ServiceAgents {
+		agents = append(agents, &discoveryAgent{ServiceCertAgent: serviceAgent})
+		k.ServiceAgents[i] = agents[i]
+	}
+	if failed := k.Deploy(ctx, []string{"www.example.test"}, true); failed != 0 {
+		t.Fatalf("%d deployments failed", failed)
+	}
+	for _, a := range agents {
+		if fmt.Sprint(a.started) != "[Bindings]" {
+			t.Errorf("expected only the bindings discovered, got %v", a.started)
+		}
+	}
+	if id := c.CdnBinding("www.example.test"); id != renewed.CasCertificateId {
+		t.Errorf("www.example.test is bound to %d, expected %d", id, renewed.CasCertificateId)
+	}
+	if id := c.LiveBinding("live.example.test"); id != currentId {
+		t.Errorf("live.example.test is bound to %d, expected %d", id, currentId)
+	}
+}
+
+func TestRunDiscoveryFailure(t *testing.T) {
+	c := newTestCloud(t)
+	c.Fail("DescribeDomainCertificateInfo", errors.New("cdn is down"))
+
+	k, _ := c.keeper(t)
+	report := k.Run(context.Background())
+	if len(report.Failed) != 0 || len(report.Deployed) != 2 {
+		t.Fatalf("expected oss and live deployed, got %+v", report)
+	}
+
+	if id := c.CdnBinding("www.example.test"); id != c.oldId {
+		t.Errorf("www.example.test is bound to %d, expected it untouched", id)
+	}
+
+	// the cdn bindings are unknown, cleanup must not delete anything
+	if c.Certificate(c.expiredId) == nil {
+		t.Errorf("certificate %d is deleted with incomplete bindings", c.expiredId)
+	}
+}
+
+func TestRunShards(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	// one domain per run, the last run finishes the pass and cleans up
+	for run := 1; run <= 4; run++ {
+		k, _ := c.keeper(t)
+		k.Shard = 1
+
+		report := k.Run(ctx)
+		if len(report.Deployed) != 1 || report.Resumed != 0 || report.Stopped != (run < 4) {
+			t.Fatalf("run %d: unexpected report %+v", run, report)
+		}
+		if deleted := c.Certificate(c.expiredId) == nil; deleted != (run == 4) {
+			t.Errorf("run %d: expired certificate deleted %v", run, deleted)
+		}
+	}
+
+	if calls := c.Calls("UploadUserCertificate"); calls != 1 {
+		t.Errorf("expected 1 upload across the runs, got %d", calls)
+	}
+
+	k, storage := c.keeper(t)
+	journal := &Journal{}
+	if data, err := storage.Read(ctx, journalKey); err != nil || json.Unmarshal(data, journal) != nil {
+		t.Fatalf("journal is not readable: %v", err)
+	}
+	if journal.Finished.IsZero() || journal.Runs != 4 || len(journal.Processed) != 4 {
+		t.Errorf("unexpected journal %+v", journal)
+	}
+
+	// a new pass starts after a finished one
+	c.Fail("SetCdnDomainSSLCertificate", errors.New("cdn is down"))
+	c.AddCdnDomain("new.example.test", 0)
+	if report := k.Run(ctx); len(report.Failed) != 1 || report.Resumed != 0 {
+		t.Errorf("expected new.example.test to fail, got %+v", report)
+	}
+}
+
+func TestRunResumesFailedPass(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+	c.Fail("PutBucketCname", errors.New("oss is down"))
+
+	// the failed domain is not retried until the pass is over
+	k, _ := c.keeper(t)
+	k.Shard = 3
+	if report := k.Run(ctx); len(report.Deployed) != 2 || len(report.Failed) != 1 || !report.Stopped {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	c.Fail("PutBucketCname", nil)
+	k, _ = c.keeper(t)
+	report := k.Run(ctx)
+	if len(report.Deployed) != 1 || report.Resumed != 1 || report.Stopped {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if c.OssBinding("assets", "img.example.test") != c.oldId {
+		t.Errorf("failed domain was retried within the pass")
+	}
+
+	k, _ = c.keeper(t)
+	if report := k.Run(ctx); len(report.Deployed) != 1 || c.OssBinding("assets", "img.example.test") == c.oldId {
+		t.Errorf("failed domain is not retried by the next pass, got %+v", report)
+	}
+}
+
+func TestRunResumesCutOffDomain(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+	c.Fail("PutBucketCname", context.Canceled)
+
+	// a domain cut off by the end of the run is not done in the pass
+	k, storage := c.keeper(t)
+	k.Shard = 3
+	if report := k.Run(ctx); len(report.Deployed) != 2 || len(report.Failed) != 1 || !report.Stopped {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	journal := &Journal{}
+	if data, err := storage.Read(ctx, journalKey); err != nil || json.Unmarshal(data, journal) != nil {
+		t.Fatalf("journal is not readable: %v", err)
+	}
+	if _, ok := journal.Processed["oss/img.example.test"]; ok || len(journal.Processed) != 2 {
+		t.Errorf("cut off domain is journaled as processed: %v", journal.Processed)
+	}
+
+	c.Fail("PutBucketCname", nil)
+	k, _ = c.keeper(t)
+	report := k.Run(ctx)
+	if len(report.Deployed) != 2 || report.Deployed[0] != "oss/img.example.test" || report.Stopped {
+		t.Fatalf("expected the cut off domain resumed, got %+v", report)
+	}
+}
+
+// failingIssuer fails to obtain certificates with the error of obtain, nil
+// lets the issuer obtain them.
+type failingIssuer struct {
+	cert_helper.Issuer
+	obtain func(ctx context.Context) error
+}
+
+func (i *failingIssuer) Obtain(ctx context.Context, names []string, privateKey crypto.PrivateKey) (*cert_helper.Certificate, error) {
+	if err := i.obtain(ctx); err != nil {
+		return nil, err
+	}
+
+	return i.Issuer.Obtain(ctx, names, privateKey)
+}
+
+// failIssuer makes the issuer of *.example.test fail with obtain.
+func failIssuer(k *Keeper, obtain func(ctx context.Context) error) {
+	k.CertManager.SetIssuer("*.example.test", &failingIssuer{Issuer: k.CertManager.Issuer(""), obtain: obtain})
+}
+
+func TestRunBackoff(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+	issuerErr := errors.New("ca is down")
+
+	run := func() *Report {
+		k, _ := c.keeper(t)
+		k.Backoff = BackoffPolicy{Base: time.Hour, StuckAfter: 2}
+		failIssuer(k, func(ctx context.Context) error { return issuerErr })
+		return k.Run(ctx)
+	}
+
+	// the other domains of the common name wait instead of failing again
+	report := run()
+	if len(report.Failed) != 1 || len(report.Backoff) != 2 || len(report.Stuck) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	report = run()
+	if len(report.Failed) != 0 || len(report.Backoff) != 3 {
+		t.Fatalf("expected every domain in backoff, got %+v", report)
+	}
+
+	// two hours later the second failure makes it stuck
+	k, _ := c.keeper(t)
+	failures, err := k.LoadFailures(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures["*.example.test"].Last = failures["*.example.test"].Last.Add(-2 * time.Hour)
+	if err := k.saveFailures(ctx, failures); err != nil {
+		t.Fatal(err)
+	}
+
+	report = run()
+	if len(report.Failed) != 1 || len(report.Stuck) != 1 || !strings.HasPrefix(report.Stuck[0], "*.example.test (2 failures") {
+		t.Fatalf("expected *.example.test stuck, got %+v", report)
+	}
+
+	reset, err := k.ResetFailures(ctx, nil)
+	if err != nil || len(reset) != 1 {
+		t.Fatalf("unexpected reset %v: %v", reset, err)
+	}
+
+	issuerErr = nil
+	if report := run(); len(report.Deployed) != 3 || len(report.Backoff) != 0 {
+		t.Errorf("expected the domains deployed after the reset, got %+v", report)
+	}
+}
+
+func TestRunBackoffSkipsOtherFailures(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	// failures of cas are no failures of the issuer
+	c.Fail("UploadUserCertificate", errors.New("cas is down"))
+	k, _ := c.keeper(t)
+	k.Backoff = BackoffPolicy{Base: time.Hour}
+	if report := k.Run(ctx); len(report.Failed) != 3 || len(report.Backoff) != 0 {
+		t.Fatalf("expected the domains failed without backoff, got %+v", report)
+	}
+
+	// nor is the run ending while the issuer works
+	c.Fail("UploadUserCertificate", nil)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	k, _ = c.keeper(t)
+	k.Backoff = BackoffPolicy{Base: time.Hour}
+	failIssuer(k, func(ctx context.Context) error {
+		cancel()
+		return ctx.Err()
+	})
+	k.Run(runCtx)
+
+	if failures, err := k.LoadFailures(ctx); err != nil || len(failures) != 0 {
+		t.Errorf("expected no failures, got %v: %v", failures, err)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	policy := BackoffPolicy{Base: time.Hour, Max: 6 * time.Hour}
+
+	for attempts, want := range []time.Duration{0, time.Hour, 2 * time.Hour, 4 * time.Hour, 6 * time.Hour, 6 * time.Hour} {
+		if delay := policy.delay(attempts); delay != want {
+			t.Errorf("delay after %d failures is %s, expected %s", attempts, delay, want)
+		}
+	}
+}
+
+func TestRunDeferred(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	k, storage := c.keeper(t)
+	k.Backoff = BackoffPolicy{Base: time.Hour}
+	schedule := cert_helper.NewIssuanceSchedule(storage, cert_helper.RateLimits{PerDomain: 1, Window: 7 * 24 * time.Hour})
+	if err := schedule.Record(ctx, []string{"*.example.test"}); err != nil {
+		t.Fatal(err)
+	}
+	k.CertManager.SetIssuanceSchedule("local-ca", schedule)
+
+	report := k.Run(ctx)
+	if len(report.Deferred) != 3 || len(report.Failed) != 0 || len(report.Backoff) != 0 || len(report.Deployed) != 1 {
+		t.Fatalf("expected the example.test domains deferred, got %+v", report)
+	}
+	if len(report.Budget) != 1 || !strings.HasPrefix(report.Budget[0], "example.test: 1 of 1 used, 1 deferred, 2 projected") {
+		t.Errorf("unexpected budget %v", report.Budget)
+	}
+	if c.CdnBinding("www.example.test") != c.oldId {
+		t.Errorf("www.example.test is rebound")
+	}
+
+	// deferring is no failure
+	if failures, err := k.LoadFailures(ctx); err != nil || len(failures) != 0 {
+		t.Errorf("expected no failures, got %v: %v", failures, err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloud(t)
+
+	certPem, keyPem := testCertificate(t, "*.example.test", time.Now().AddDate(0, 2, 0))
+	newId := c.AddCertificate("sslkeeper-example_test-new", certPem, keyPem, false)
+	certPem, keyPem = testCertificate(t, "*.example.test", time.Now().AddDate(0, 1, 0))
+	purchasedId := c.AddCertificate("example_test", certPem, keyPem, true)
+	c.AddCdnDomain("static.example.test", purchasedId)
+	certPem, keyPem = testCertificate(t, "*.example.test", time.Now().AddDate(0, 0, 10))
+	importedId := c.AddCertificate("imported-example_test-old", certPem, keyPem, false)
+	c.AddCdnDomain("imported.example.test", importedId)
+	certPem, keyPem = testCertificate(t, "ev.example.test", time.Now().AddDate(1, 0, 0))
+	evId := c.AddCertificate("ev_example_test", certPem, keyPem, true)
+	c.AddCdnDomain("ev.example.test", evId)
+
+	k, _ := c.keeper(t)
+	report := k.Reconcile(ctx, false)
+	if len(report.Failed) != 0 || len(report.Deployed) != 4 {
+		t.Fatalf("expected 4 deployed domains, got %+v", report)
+	}
+	if id := c.CdnBinding("imported.example.test"); id != newId {
+		t.Errorf("imported.example.test is bound to %d, expected %d", id, newId)
+	}
+	if len(report.Foreign) != 1 || report.Foreign[0] != "cdn/static.example.test" {
+		t.Errorf("expected static.example.test reported as foreign, got %v", report.Foreign)
+	}
+
+	if id := c.CdnBinding("www.example.test"); id != newId {
+		t.Errorf("www.example.test is bound to %d, expected %d", id, newId)
+	}
+	if id := c.OssBinding("assets", "img.example.test"); id != newId {
+		t.Errorf("img.example.test is bound to %d, expected %d", id, newId)
+	}
+	if id := c.LiveBinding("live.example.test"); id != newId {
+		t.Errorf("live.example.test is bound to %d, expected %d", id, newId)
+	}
+	if id := c.CdnBinding("static.example.test"); id != purchasedId {
+		t.Errorf("static.example.test is bound to %d without take over", id)
+	}
+	if id := c.CdnBinding("www.shop.test"); id != 0 {
+		t.Errorf("unbound www.shop.test is bound to %d", id)
+	}
+	if calls := c.Calls("UploadUserCertificate"); calls != 0 {
+		t.Errorf("expected no upload, got %d", calls)
+	}
+
+	k, _ = c.keeper(t)
+	report = k.Reconcile(ctx, true)
+	if len(report.Failed) != 0 || len(report.Deployed) != 1 || len(report.Foreign) != 0 {
+		t.Fatalf("expected static.example.test taken over, got %+v", report)
+	}
+	if id := c.CdnBinding("static.example.test"); id != newId {
+		t.Errorf("static.example.test is bound to %d, expected %d", id, newId)
+	}
+	// taking over never binds a certificate expiring earlier
+	if id := c.CdnBinding("ev.example.test"); id != evId {
+		t.Errorf("ev.example.test is bound to %d, expected %d", id, evId)
+	}
+}
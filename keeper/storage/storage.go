@@ -1,6 +1,9 @@
 package storage
 
+import "context"
+
 type StorageService interface {
-	Read(key string) ([]byte, error)
-	Write(key string, data []byte) error
+	Read(ctx context.Context, key string) ([]byte, error)
+	Write(ctx context.Context, key string, data []byte) error
+	Delete(ctx context.Context, key string) error
 }
@@ -2,42 +2,61 @@ package storage_oss
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 
 	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/retry"
+	"github.com/geektheripper/alicdn-ssl-keeper/utils"
 )
 
+// Bucket is the part of the oss bucket api the keeper calls, *oss.Bucket
+// implements it.
+type Bucket interface {
+	GetObject(objectKey string, options ...oss.Option) (io.ReadCloser, error)
+	PutObject(objectKey string, reader io.Reader, options ...oss.Option) error
+	DeleteObject(objectKey string, options ...oss.Option) error
+}
+
 type OssBucketHelper struct {
-	OssBucket    *oss.Bucket
+	OssBucket    Bucket
 	OssKeyPrefix string
 }
 
-func NewOssBucketHelper(aliConfig aliapi.Config, ossEndPoinets, ossBucket, ossKeyPrefix string) *OssBucketHelper {
+func NewOssBucketHelper(aliConfig aliapi.Config, ossEndPoinets, ossBucket, ossKeyPrefix string) (*OssBucketHelper, error) {
 	if ossEndPoinets == "" {
 		ossEndPoinets = "oss-" + *aliConfig.RegionId + ".aliyuncs.com"
 	}
 
-	ossClient, err := oss.New(ossEndPoinets, *aliConfig.AccessKeyId, *aliConfig.AccessKeySecret)
+	options := []oss.ClientOption{}
+	if timeout := utils.CallTimeoutSeconds(&aliConfig); timeout > 0 {
+		options = append(options, oss.Timeout(timeout, timeout))
+	}
+
+	ossClient, err := oss.New(ossEndPoinets, *aliConfig.AccessKeyId, *aliConfig.AccessKeySecret, options...)
 	if err != nil {
-		log.Fatalf("Error creating oss client: %v", err)
+		return nil, fmt.Errorf("create oss client failed: %v", err)
 	}
 
 	ossBucketClient, err := ossClient.Bucket(ossBucket)
 	if err != nil {
-		log.Fatalf("Error getting oss bucket: %v", err)
+		return nil, fmt.Errorf("get oss bucket failed: %v", err)
 	}
 
 	return &OssBucketHelper{
 		OssBucket:    ossBucketClient,
 		OssKeyPrefix: ossKeyPrefix,
-	}
+	}, nil
 }
 
-func (o *OssBucketHelper) Read(objectName string) ([]byte, error) {
+func (o *OssBucketHelper) Read(ctx context.Context, objectName string) ([]byte, error) {
 	key := o.OssKeyPrefix + "/" + objectName
-	body, err := o.OssBucket.GetObject(key)
+	body, err := retry.Call(ctx, retry.Default, "oss", "GetObject", func() (io.ReadCloser, error) {
+		return o.OssBucket.GetObject(key, oss.WithContext(ctx))
+	})
 	if err != nil {
 		if ossErr, ok := err.(oss.ServiceError); ok && ossErr.Code == "NoSuchKey" {
 			return nil, nil
@@ -51,8 +70,16 @@ func (o *OssBucketHelper) Read(objectName string) ([]byte, error) {
 	return data, nil
 }
 
-func (o *OssBucketHelper) Write(objectName string, data []byte) error {
+func (o *OssBucketHelper) Write(ctx context.Context, objectName string, data []byte) error {
+	key := o.OssKeyPrefix + "/" + objectName
+	return retry.Default.Do(ctx, "oss", "PutObject", func() error {
+		return o.OssBucket.PutObject(key, bytes.NewReader(data), oss.WithContext(ctx))
+	})
+}
+
+func (o *OssBucketHelper) Delete(ctx context.Context, objectName string) error {
 	key := o.OssKeyPrefix + "/" + objectName
-	err := o.OssBucket.PutObject(key, bytes.NewReader(data))
-	return err
+	return retry.Default.Do(ctx, "oss", "DeleteObject", func() error {
+		return o.OssBucket.DeleteObject(key, oss.WithContext(ctx))
+	})
 }
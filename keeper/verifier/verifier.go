@@ -0,0 +1,141 @@
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// StaleError is returned when a domain still serves another certificate after
+// every attempt.
+type StaleError struct {
+	Domain   string
+	Expected string
+	Served   string
+	NotAfter time.Time
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("%s still serves certificate %s (expires %s), expected %s",
+		e.Domain, e.Served, e.NotAfter.Format("2006-01-02"), e.Expected)
+}
+
+// Verifier checks by TLS handshakes that domains serve the deployed
+// certificate, retrying while the cdn propagates it.
+type Verifier struct {
+	// Addresses overrides the host:port dialed for a domain.
+	Addresses map[string]string
+	// Resolver resolves the domains without address override, the system
+	// resolver is used if nil.
+	Resolver *net.Resolver
+	Port     string
+	Attempts int
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+func NewVerifier() *Verifier {
+	return &Verifier{
+		Addresses: map[string]string{},
+		Port:      "443",
+		Attempts:  10,
+		Interval:  30 * time.Second,
+		Timeout:   10 * time.Second,
+	}
+}
+
+// NewResolver resolves by the dns server at address, like 223.5.5.5:53.
+func NewResolver(address string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (v *Verifier) address(domain string) string {
+	if address, ok := v.Addresses[domain]; ok {
+		return address
+	}
+
+	return net.JoinHostPort(domain, v.Port)
+}
+
+// Served returns the leaf certificate the domain serves with SNI set to it.
+func (v *Verifier) Served(ctx context.Context, domain string) (*x509.Certificate, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: v.Timeout, Resolver: v.Resolver},
+		Config: &tls.Config{
+			ServerName: domain,
+			// the served certificate is compared, not verified
+			InsecureSkipVerify: true,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.Timeout)
+	defer cancel()
+
+	conn, err := dialer.DialContext(ctx, "tcp", v.address(domain))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate served")
+	}
+
+	return certs[0], nil
+}
+
+// Verify waits until the domain serves the expected certificate, the last
+// result is returned when the context is done first.
+func (v *Verifier) Verify(ctx context.Context, domain string, expected *x509.Certificate) error {
+	var lastErr error
+
+	// at least one handshake, a verifier without attempts must not pass
+	attempts := max(v.Attempts, 1)
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(v.Interval):
+			case <-ctx.Done():
+				return lastErr
+			}
+		}
+
+		served, err := v.Served(ctx, domain)
+		if err != nil {
+			lastErr = fmt.Errorf("handshake with %s failed: %w", domain, err)
+			continue
+		}
+
+		if bytes.Equal(served.Raw, expected.Raw) {
+			return nil
+		}
+
+		lastErr = &StaleError{
+			Domain:   domain,
+			Expected: Fingerprint(expected),
+			Served:   Fingerprint(served),
+			NotAfter: served.NotAfter,
+		}
+	}
+
+	return lastErr
+}
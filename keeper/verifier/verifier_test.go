@@ -0,0 +1,119 @@
+package verifier
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/geektheripper/alicdn-ssl-keeper/keeper/cert_helper"
+)
+
+type memoryStorage map[string][]byte
+
+func (s memoryStorage) Read(ctx context.Context, key string) ([]byte, error) {
+	return s[key], nil
+}
+
+func (s memoryStorage) Write(ctx context.Context, key string, data []byte) error {
+	s[key] = data
+	return nil
+}
+
+func (s memoryStorage) Delete(ctx context.Context, key string) error {
+	delete(s, key)
+	return nil
+}
+
+func issue(t *testing.T, issuer cert_helper.Issuer) (*cert_helper.Certificate, tls.Certificate) {
+	cert, err := issuer.Obtain(context.Background(), []string{"*.example.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPair, err := tls.X509KeyPair(cert.Certificate, cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, keyPair
+}
+
+// serve serves the old certificate for the first handshakes, then the new one.
+func serve(t *testing.T, old, new tls.Certificate, oldHandshakes int32) string {
+	var handshakes int32
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "www.example.test" {
+				return nil, errors.New("unexpected sni " + hello.ServerName)
+			}
+			if atomic.AddInt32(&handshakes, 1) <= oldHandshakes {
+				return &old, nil
+			}
+			return &new, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestVerifier(t *testing.T) {
+	issuer, err := cert_helper.NewLocalCAIssuer(context.Background(), memoryStorage{}, "local-ca", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldCert, oldPair := issue(t, issuer)
+	newCert, newPair := issue(t, issuer)
+
+	v := NewVerifier()
+	v.Attempts = 3
+	v.Interval = 10 * time.Millisecond
+	v.Timeout = time.Second
+
+	// propagated after two attempts
+	v.Addresses["www.example.test"] = serve(t, oldPair, newPair, 2)
+	if err := v.Verify(context.Background(), "www.example.test", newCert.X509Certificate()); err != nil {
+		t.Fatal(err)
+	}
+
+	// never propagated
+	v.Addresses["www.example.test"] = serve(t, oldPair, newPair, 3)
+	err = v.Verify(context.Background(), "www.example.test", newCert.X509Certificate())
+
+	var staleErr *StaleError
+	if !errors.As(err, &staleErr) {
+		t.Fatalf("expected stale error, got %v", err)
+	}
+	if staleErr.Served != Fingerprint(oldCert.X509Certificate()) {
+		t.Errorf("unexpected served fingerprint %s", staleErr.Served)
+	}
+
+	// no attempts configured still checks once
+	v.Attempts = 0
+	v.Addresses["www.example.test"] = serve(t, oldPair, newPair, 1)
+	if err := v.Verify(context.Background(), "www.example.test", newCert.X509Certificate()); !errors.As(err, &staleErr) {
+		t.Errorf("expected stale error without attempts, got %v", err)
+	}
+}
@@ -4,8 +4,15 @@ import (
 	"testing"
 
 	"github.com/geektheripper/alicdn-ssl-keeper/cmd"
+	"github.com/spf13/viper"
 )
 
+// TestRootCmd runs the keeper against the real account, the tests of the
+// keeper package cover the same flow on fake clients.
 func TestRootCmd(t *testing.T) {
+	if viper.GetString("access-key-id") == "" {
+		t.Skip("no aliyun credentials, set Ali_Key and Ali_Secret or a .env file")
+	}
+
 	cmd.Execute()
 }
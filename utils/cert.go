@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
@@ -32,16 +33,52 @@ func ParseRSAKey(data []byte) (*rsa.PrivateKey, error) {
 		return nil, errors.New("failed to decode private key")
 	}
 
-	if block.Type != "RSA PRIVATE KEY" {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not a rsa key")
+		}
+
+		return rsaKey, nil
+	default:
 		return nil, errors.New("failed to decode private key")
 	}
+}
 
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
+// ParsePrivateKey parses a rsa or ec private key, in PKCS#1, SEC 1 or PKCS#8.
+func ParsePrivateKey(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to decode private key")
 	}
 
-	return key, nil
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, errors.New("private key is neither a rsa nor an ec key")
+	default:
+		return nil, errors.New("failed to decode private key")
+	}
 }
 
 func ParseCertificate(data []byte) (*x509.Certificate, error) {
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"time"
+
+	aliapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	"github.com/alibabacloud-go/tea/tea"
+)
+
+// CallTimeout is the read timeout of a single api call set in the aliyun
+// config, 0 if unset. Clients of sdks that don't take the config apply it
+// themselves.
+func CallTimeout(aliConfig *aliapi.Config) time.Duration {
+	return time.Duration(tea.IntValue(aliConfig.ReadTimeout)) * time.Millisecond
+}
+
+// CallTimeoutSeconds is CallTimeout in whole seconds, at least 1 when set.
+func CallTimeoutSeconds(aliConfig *aliapi.Config) int64 {
+	timeout := CallTimeout(aliConfig)
+	if timeout <= 0 {
+		return 0
+	}
+
+	return max(int64(timeout/time.Second), 1)
+}